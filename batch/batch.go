@@ -5,6 +5,13 @@
 // See LICENSE.txt for more details.
 package batch
 
+import (
+	"errors"
+	"time"
+)
+
+var ErrShutdownTimeout = errors.New("tasks were still running when shutdown timed out")
+
 // A batch is a list of arbitrary items.
 type Batch interface {
 	Item(index int) interface{}
@@ -23,6 +30,7 @@ type BatchProcessor struct {
 	stopCommand    chan bool
 	finishedSignal chan bool
 	taskDone       chan bool
+	exited         chan struct{}
 	stopped        bool
 
 	// These are only modified from the process goroutine.
@@ -51,6 +59,9 @@ func NewBatchProcessor(callback Callback, maxTasks int) *BatchProcessor {
 		// Notifications from completed processors. Buffer size doesn't really
 		// matter but we'd rather not block to push.
 		taskDone: make(chan bool, maxTasks),
+
+		// Closed once the process routine is gone and no tasks are running.
+		exited: make(chan struct{}),
 	}
 
 	go processor.waitForBatches()
@@ -58,9 +69,13 @@ func NewBatchProcessor(callback Callback, maxTasks int) *BatchProcessor {
 	return processor
 }
 
-// Adds a batch to the batch processor.
+// Adds a batch to the batch processor. Batches added after processing has
+// stopped are dropped.
 func (this *BatchProcessor) AddBatch(batch Batch) {
-	this.batchQueue <- batch
+	select {
+	case this.batchQueue <- batch:
+	case <-this.exited:
+	}
 }
 
 // Signals that no more batches are incoming, and then waits for batch
@@ -75,6 +90,20 @@ func (this *BatchProcessor) Terminate() {
 	this.send_stop(true)
 }
 
+// Stops taking new batches, drops items that haven't started, and waits up to
+// the timeout for running tasks to finish. Returns ErrShutdownTimeout if some
+// are still running, in which case they continue in the background.
+func (this *BatchProcessor) Shutdown(timeout time.Duration) error {
+	this.Terminate()
+
+	select {
+	case <-this.exited:
+		return nil
+	case <-time.After(timeout):
+		return ErrShutdownTimeout
+	}
+}
+
 func (this *BatchProcessor) send_stop(terminate bool) {
 	// Don't re-enter this function.
 	if this.stopped {
@@ -127,6 +156,8 @@ func (this *BatchProcessor) workRemaining() bool {
 
 // This runs in its own goroutine.
 func (this *BatchProcessor) waitForBatches() {
+	defer close(this.exited)
+
 	// Setup local state.
 	stopped := false
 	terminated := false
@@ -134,6 +165,9 @@ func (this *BatchProcessor) waitForBatches() {
 	for {
 		select {
 		case batch := <-this.batchQueue:
+			if terminated {
+				continue
+			}
 			this.enqueueBatch(batch)
 
 		case <-this.taskDone:
@@ -7,10 +7,12 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
 	"runtime"
@@ -33,6 +35,7 @@ var (
 type ErrorObject struct {
 	Ip    string `json:"ip"`
 	Error string `json:"error"`
+	Kind  string `json:"kind"`
 }
 
 type ServerObject struct {
@@ -112,20 +115,28 @@ func addError(hostAndPort string, err error) {
 	addJson(hostAndPort, &ErrorObject{
 		Ip:    hostAndPort,
 		Error: err.Error(),
+		Kind:  valve.ClassifyQueryError(err).String(),
 	})
 }
 
 func main() {
-	flag_game := flag.String("game", "", "Game (hl1, hl2)")
+	flag_game := flag.String("game", "", "Game (hl1, hl2, or a name like tf2)")
 	flag_appid := flag.Int("appid", 0, "Query a single AppID")
 	flag_appids := flag.String("appids", "", "Comma-delimited list of AppIDs")
 	flag_master := flag.String("master", valve.MasterServer, "Master server address")
 	flag_j := flag.Int("j", 20, "Number of concurrent requests (more will introduce more timeouts)")
+	flag_bind := flag.String("bind", "", "Local address to send server queries from")
+	flag_maxsockets := flag.Int("maxsockets", 0, "Most server query sockets to have open at once (0 for no limit)")
 	flag_timeout := flag.Duration("timeout", time.Second*3, "Timeout for querying servers")
+	flag_master_timeout := flag.Duration("mastertimeout", time.Minute*5, "Timeout for each reply from the master")
 	flag_format := flag.String("format", "list", "JSON format (list, map, or lines)")
 	flag_outfile := flag.String("outfile", "", "Output to a file")
+	flag_gzip := flag.Bool("gzip", false, "Compress the output with gzip")
 	flag_norules := flag.Bool("norules", false, "Don't query server rules")
+	flag_minplayers := flag.Int("minplayers", 0, "Only output servers with at least this many human players")
 	flag_noinfo := flag.Bool("noinfo", false, "Don't query server info")
+	flag_shuffle := flag.Bool("shuffle", false, "Query servers in a random order")
+	flag_totals := flag.Bool("totals", false, "Print player totals to stderr when done")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: -game or -appids\n")
 		flag.PrintDefaults()
@@ -155,6 +166,20 @@ func main() {
 		sOutputBuffer = os.Stdout
 	}
 
+	// Closed before the file, so the gzip footer is written out.
+	closeOutput := func() {}
+	if *flag_gzip {
+		compressed := gzip.NewWriter(sOutputBuffer)
+		closeOutput = func() {
+			sOutputLock.Lock()
+			defer sOutputLock.Unlock()
+			compressed.Close()
+		}
+		defer closeOutput()
+
+		sOutputBuffer = compressed
+	}
+
 	if *flag_game != "" {
 		switch *flag_game {
 		case "hl1":
@@ -162,8 +187,12 @@ func main() {
 		case "hl2":
 			appids = append(appids, valve.HL2Apps...)
 		default:
-			fmt.Fprintf(os.Stderr, "Unrecognized game: %s", *flag_game)
-			os.Exit(1)
+			appid, ok := valve.AppIdByName(*flag_game)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Unrecognized game: %s\n", *flag_game)
+				os.Exit(1)
+			}
+			appids = append(appids, appid)
 		}
 	}
 
@@ -188,23 +217,30 @@ func main() {
 	}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	valve.SetMaxOpenSockets(*flag_maxsockets)
 
 	// Create a connection to the master server.
 	master, err := valve.NewMasterServerQuerier(*flag_master)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not query master: %s", err.Error())
+		fmt.Fprintf(os.Stderr, "Could not query master: %s\n", err.Error())
+		os.Exit(1)
 	}
 	defer master.Close()
 
+	master.SetTimeout(*flag_master_timeout)
+
 	// Set up the filter list.
 	master.FilterAppIds(appids)
 
+	tally := &valve.PlayerTally{}
+
 	// Initialize our batch processor, which will receive servers and query them
 	// concurrently.
 	bp := batch.NewBatchProcessor(func(item interface{}) {
 		addr := item.(*net.TCPAddr)
-		query, err := valve.NewServerQuerier(addr.String(), *flag_timeout)
+		query, err := valve.NewBoundServerQuerier(addr.String(), *flag_bind, *flag_timeout)
 		if err != nil {
+			tally.AddFailure()
 			addError(addr.String(), err)
 			return
 		}
@@ -214,9 +250,17 @@ func main() {
 		if !*flag_noinfo {
 			info, err = query.QueryInfo()
 			if err != nil {
+				tally.AddFailure()
 				addError(addr.String(), err)
 				return
 			}
+			tally.Add(info)
+
+			// The master can only filter on empty or full, so finer player
+			// counts are checked here. Totals still include these servers.
+			if info.HumanPlayers() < *flag_minplayers {
+				return
+			}
 		} else {
 			// When -noinfo is specified, create a minimal server object with just the address
 			addJson(addr.String(), &ServerObject{
@@ -243,11 +287,7 @@ func main() {
 		if info.Vac == 1 {
 			out.Vac = true
 		}
-		if info.Visibility == 0 {
-			out.Visibility = "public"
-		} else {
-			out.Visibility = "private"
-		}
+		out.Visibility = info.Visibility.String()
 		if info.Ext != nil {
 			out.AppId = info.Ext.AppId
 			out.GameVersion = info.Ext.GameVersion
@@ -288,19 +328,40 @@ func main() {
 		sOutputBuffer.Write([]byte("{\n"))
 	}
 
+	// The global source is always seeded the same before Go 1.20, so
+	// shuffle with our own. Batches can arrive from several goroutines.
+	var shuffleLock sync.Mutex
+	shuffler := rand.New(rand.NewSource(time.Now().UnixNano()))
+
 	// Query the master.
 	err = master.Query(func(servers valve.ServerList) error {
+		if *flag_shuffle {
+			shuffleLock.Lock()
+			servers.Shuffle(shuffler)
+			shuffleLock.Unlock()
+		}
 		bp.AddBatch(servers)
 		return nil
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not query the master: %s\n", err.Error())
+		// os.Exit skips deferred calls, so finish the compressed stream here
+		// to keep what was already written readable.
+		closeOutput()
 		os.Exit(1)
 	}
 
 	// Wait for batch processing to complete.
 	bp.Finish()
 
+	if *flag_totals {
+		summary := tally.Summary()
+		fmt.Fprintf(os.Stderr, "%d servers, %d players (%d humans, %d bots), %d slots\n",
+			summary.Servers, summary.Players, summary.Humans, summary.Bots, summary.MaxPlayers)
+		fmt.Fprintf(os.Stderr, "%d of %d servers responded, playing %d maps across %d games\n",
+			summary.Responded, summary.Found, summary.Maps, len(summary.Games))
+	}
+
 	if sNumServers != 0 {
 		sOutputBuffer.Write([]byte("\n"))
 	}
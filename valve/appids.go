@@ -5,6 +5,10 @@
 // See LICENSE.txt for more details.
 package valve
 
+import (
+	"strings"
+)
+
 type AppId int32
 
 const (
@@ -119,6 +123,105 @@ var HL2Apps = []AppId{
 	App_IOSoccer,
 }
 
+// Human-readable names for well-known AppIds.
+var kAppNames = map[AppId]string{
+	App_CS:               "Counter-Strike",
+	App_TFC:              "Team Fortress Classic",
+	App_DOD:              "Day of Defeat",
+	App_DMC:              "Deathmatch Classic",
+	App_OP4:              "Half-Life: Opposing Force",
+	App_Ricochet:         "Ricochet",
+	App_HL:               "Half-Life",
+	App_CS_CZ:            "Counter-Strike: Condition Zero",
+	App_SDK2006:          "Source SDK Base 2006",
+	App_SDK2007:          "Source SDK Base 2007",
+	App_CSS:              "Counter-Strike: Source",
+	App_DODS:             "Day of Defeat: Source",
+	App_HL2DM:            "Half-Life 2: Deathmatch",
+	App_HLDMS:            "Half-Life Deathmatch: Source",
+	App_TF2:              "Team Fortress 2",
+	App_L4D1:             "Left 4 Dead",
+	App_L4D2:             "Left 4 Dead 2",
+	App_AlienSwarm:       "Alien Swarm",
+	App_CSGO:             "Counter-Strike: Global Offensive",
+	App_DarkMessiah:      "Dark Messiah of Might & Magic",
+	App_TheShip:          "The Ship",
+	App_BloodyGoodTime:   "Bloody Good Time",
+	App_GarrysMod:        "Garry's Mod",
+	App_ZombiePanic:      "Zombie Panic! Source",
+	App_AgeOfChivalry:    "Age of Chivalry",
+	App_Synergy:          "Synergy",
+	App_DIPRIP:           "D.I.P.R.I.P.",
+	App_EternalSilence:   "Eternal Silence",
+	App_PVK:              "Pirates, Vikings, and Knights II",
+	App_Dystopia:         "Dystopia",
+	App_InsurgencyMod:    "Insurgency: Modern Infantry Combat",
+	App_NuclearDawn:      "Nuclear Dawn",
+	App_Smashball:        "Smashball",
+	App_EmpiresMod:       "Empires",
+	App_DinoDDay:         "Dino D-Day",
+	App_EYE:              "E.Y.E: Divine Cybermancy",
+	App_Insurgency:       "Insurgency",
+	App_NoMoreRoomInHell: "No More Room in Hell",
+	App_BladeSymphony:    "Blade Symphony",
+	App_Contagion:        "Contagion",
+	App_SDK2013:          "Source SDK Base 2013",
+	App_Neotokyo:         "NEOTOKYO",
+	App_FortressForever:  "Fortress Forever",
+	App_FistfulOfFrags:   "Fistful of Frags",
+	App_ModularCombat:    "Modular Combat",
+	App_CodenameCURE:     "Codename CURE",
+	App_BlackMesa:        "Black Mesa",
+	App_DayOfInfamy:      "Day of Infamy",
+	App_IOSoccer:         "IOSoccer",
+}
+
+// Returns the name of a well-known AppId. Unlike the game description a
+// server reports, this can't be spoofed.
+func AppName(appId AppId) (string, bool) {
+	name, ok := kAppNames[appId]
+	return name, ok
+}
+
+// Short names for popular AppIds, as used on the command line.
+var kAppShortNames = map[string]AppId{
+	"cs":      App_CS,
+	"cs16":    App_CS,
+	"tfc":     App_TFC,
+	"dod":     App_DOD,
+	"hl":      App_HL,
+	"czero":   App_CS_CZ,
+	"css":     App_CSS,
+	"dods":    App_DODS,
+	"hl2dm":   App_HL2DM,
+	"tf2":     App_TF2,
+	"l4d":     App_L4D1,
+	"l4d2":    App_L4D2,
+	"csgo":    App_CSGO,
+	"gmod":    App_GarrysMod,
+	"ins":     App_Insurgency,
+	"nmrih":   App_NoMoreRoomInHell,
+	"doi":     App_DayOfInfamy,
+	"bms":     App_BlackMesa,
+	"zps":     App_ZombiePanic,
+	"synergy": App_Synergy,
+}
+
+// Look up a well-known AppId by a short name such as "tf2", or by its full
+// name as returned by AppName. Case is ignored.
+func AppIdByName(name string) (AppId, bool) {
+	name = strings.ToLower(name)
+	if appId, ok := kAppShortNames[name]; ok {
+		return appId, true
+	}
+	for appId, appName := range kAppNames {
+		if strings.ToLower(appName) == name {
+			return appId, true
+		}
+	}
+	return App_Unknown, false
+}
+
 func IsPreOrangeBoxApp(appId AppId) bool {
 	switch appId {
 	case App_SDK2006, App_EternalSilence, App_InsurgencyMod, App_Neotokyo, App_FortressForever:
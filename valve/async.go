@@ -0,0 +1,74 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+)
+
+// A master query running in the background, started by QueryAsync.
+type QueryHandle struct {
+	results chan ServerList
+	done    chan struct{}
+	cancel  context.CancelFunc
+	err     error
+}
+
+// Start a query in the background and return right away. Batches arrive on
+// the handle's Results channel, and the query waits for each to be read, so
+// the caller must read until the channel closes or cancel the query.
+func (this *MasterServerQuerier) QueryAsync(ctx context.Context) *QueryHandle {
+	ctx, cancel := context.WithCancel(ctx)
+	handle := &QueryHandle{
+		results: make(chan ServerList),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+
+	go (func() {
+		defer cancel()
+
+		handle.err = this.QueryContext(ctx, func(servers ServerList) error {
+			select {
+			case handle.results <- servers:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		close(handle.results)
+		close(handle.done)
+	})()
+	return handle
+}
+
+// Returns the batches the master sends. The channel is closed when the query
+// ends.
+func (this *QueryHandle) Results() <-chan ServerList {
+	return this.results
+}
+
+// Returns a channel that is closed once the query has ended.
+func (this *QueryHandle) Done() <-chan struct{} {
+	return this.done
+}
+
+// Returns the error the query ended with, or nil if it succeeded. This is
+// only meaningful once Done is closed, and is always nil before then.
+func (this *QueryHandle) Err() error {
+	select {
+	case <-this.done:
+		return this.err
+	default:
+		return nil
+	}
+}
+
+// Stop the query. It ends with context.Canceled, soon after the current
+// exchange with the master.
+func (this *QueryHandle) Cancel() {
+	this.cancel()
+}
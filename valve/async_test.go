@@ -0,0 +1,46 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"testing"
+)
+
+func TestQueryAsync(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 3), makeServerList(2, 2), makeServerList(3, 1)})
+	querier := newTestMasterQuerier(t, master)
+
+	handle := querier.QueryAsync(context.Background())
+	found := 0
+	for servers := range handle.Results() {
+		found += len(servers)
+	}
+	<-handle.Done()
+	if err := handle.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if found != 6 {
+		t.Errorf("expected 6 servers, got %d", found)
+	}
+}
+
+func TestQueryAsyncCancel(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 3), makeServerList(2, 2), makeServerList(3, 1)})
+	querier := newTestMasterQuerier(t, master)
+
+	handle := querier.QueryAsync(context.Background())
+	if servers := <-handle.Results(); len(servers) != 3 {
+		t.Fatalf("expected the first batch, got %d servers", len(servers))
+	}
+	handle.Cancel()
+	for range handle.Results() {
+	}
+	<-handle.Done()
+	if err := handle.Err(); err != context.Canceled {
+		t.Errorf("expected the query to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Servers change their challenge about once a minute.
+const kDefaultChallengeTTL = time.Minute
+
+// Challenges for many servers, keyed by "ip:port", so that queriers given the
+// cache (see ServerQuerier.SetChallengeCache) can skip the handshake. Entries
+// expire, since servers change their challenge every so often. It is safe to
+// share between goroutines.
+type ChallengeCache struct {
+	lock       sync.Mutex
+	challenges map[string]cachedChallenge
+	ttl        time.Duration
+	clock      clock
+
+	prewarmAddr     string
+	prewarmInterval time.Duration
+}
+
+type cachedChallenge struct {
+	challenge []byte
+	stored    time.Time
+}
+
+func NewChallengeCache() *ChallengeCache {
+	return &ChallengeCache{
+		challenges: map[string]cachedChallenge{},
+		ttl:        kDefaultChallengeTTL,
+		clock:      realClock{},
+	}
+}
+
+// Set how long a challenge is kept. The default is a minute. Zero keeps
+// challenges forever.
+func (this *ChallengeCache) SetTTL(ttl time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.ttl = ttl
+}
+
+// Send Prewarm's requests from a local address, so that traffic leaves
+// through a particular interface. A bare IP is given any free port.
+func (this *ChallengeCache) SetPrewarmLocalAddr(localAddr string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.prewarmAddr = localAddr
+}
+
+// Limit how many requests Prewarm sends per second. Zero, the default,
+// disables the limit.
+func (this *ChallengeCache) SetPrewarmRate(perSecond int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if perSecond <= 0 {
+		this.prewarmInterval = 0
+		return
+	}
+	this.prewarmInterval = time.Second / time.Duration(perSecond)
+}
+
+func (this *ChallengeCache) setClock(clock clock) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.clock = clock
+}
+
+// Returns the challenge for a server, or nil if there is none or it expired.
+func (this *ChallengeCache) Get(address string) []byte {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.challenges[address]
+	if !ok {
+		return nil
+	}
+	if this.expired(entry) {
+		delete(this.challenges, address)
+		return nil
+	}
+	return entry.challenge
+}
+
+func (this *ChallengeCache) Put(address string, challenge []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.challenges[address] = cachedChallenge{
+		challenge: append([]byte{}, challenge...),
+		stored:    this.clock.Now(),
+	}
+}
+
+// Returns how many servers have a challenge that hasn't expired.
+func (this *ChallengeCache) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	count := 0
+	for _, entry := range this.challenges {
+		if !this.expired(entry) {
+			count++
+		}
+	}
+	return count
+}
+
+// This must be called with the lock held.
+func (this *ChallengeCache) expired(entry cachedChallenge) bool {
+	return this.ttl > 0 && this.clock.Now().Sub(entry.stored) >= this.ttl
+}
+
+// Fetch challenges for every server in a single burst: an A2S_INFO request is
+// sent to each from one socket, and then challenge replies are collected until
+// every server has answered or the timeout passes. Servers that answer with
+// anything else, or not at all, are left out. A large burst may see more
+// packets dropped than usual, which SetPrewarmRate can help with. The socket
+// counts against SetMaxOpenSockets. Returns how many challenges were added.
+func (this *ChallengeCache) Prewarm(ctx context.Context, servers ServerList, timeout time.Duration) (int, error) {
+	addrs := servers.UDPAddrs()
+	if len(addrs) == 0 {
+		return 0, nil
+	}
+
+	this.lock.Lock()
+	localAddr := this.prewarmAddr
+	interval := this.prewarmInterval
+	clock := this.clock
+	this.lock.Unlock()
+
+	socket, err := openServerSocket(ctx, addrs[0].String(), localAddr, timeout, true)
+	if err != nil {
+		return 0, err
+	}
+	defer socket.Close()
+	socket.SetVerifySource(false)
+
+	request := (&ServerQuerier{infoPayload: kInfoPayload}).buildInfoQuery().Bytes()
+	pending := map[string]bool{}
+	for i, addr := range addrs {
+		if i > 0 && interval > 0 {
+			if err := clock.SleepContext(ctx, interval); err != nil {
+				return 0, err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := socket.sendTo(request, addr); err != nil {
+			continue
+		}
+		pending[addr.String()] = true
+	}
+
+	recvCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	added := 0
+	for len(pending) > 0 {
+		packet, err := socket.RecvContext(recvCtx)
+		if err == ErrResponseTruncated {
+			continue
+		}
+		if err != nil {
+			if err == context.DeadlineExceeded && ctx.Err() == nil {
+				break
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return added, err
+		}
+
+		from := socket.source.String()
+		if len(packet) < 9 || int32(binary.LittleEndian.Uint32(packet)) != PacketHeaderSimple {
+			continue
+		}
+		if packet[4] != S2C_CHALLENGE || !pending[from] {
+			continue
+		}
+		delete(pending, from)
+		this.Put(from, packet[5:9])
+		added++
+	}
+	if err := ctx.Err(); err != nil {
+		return added, err
+	}
+	return added, nil
+}
@@ -0,0 +1,138 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPrewarmChallenges(t *testing.T) {
+	info := encodeSourceInfo(makeTestInfo())
+	servers := ServerList{}
+	mocks := []*mockServer{}
+	for i := 0; i < 3; i++ {
+		server := newMockServer(t, respondToInfoAndPlayers(info, nil))
+		addr := server.conn.LocalAddr().(*net.UDPAddr)
+		servers = append(servers, &net.TCPAddr{IP: addr.IP.To4(), Port: addr.Port})
+		mocks = append(mocks, server)
+	}
+
+	cache := NewChallengeCache()
+	added, err := cache.Prewarm(context.Background(), servers, time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 || cache.Len() != 3 {
+		t.Fatalf("expected 3 challenges, got %d", added)
+	}
+	if challenge := cache.Get(servers[0].String()); !bytes.Equal(challenge, kTestChallenge) {
+		t.Errorf("expected the test challenge, got %v", challenge)
+	}
+
+	// With the cache, A2S_INFO goes out once, already carrying the challenge.
+	querier := newTestServerQuerier(t, mocks[0])
+	querier.SetChallengeCache(cache)
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if sends := querier.SocketStats().Sends; sends != 1 {
+		t.Errorf("expected the handshake to be skipped, got %d sends", sends)
+	}
+
+	// Without it, the handshake costs a round trip.
+	querier = newTestServerQuerier(t, mocks[1])
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if sends := querier.SocketStats().Sends; sends != 2 {
+		t.Errorf("expected a handshake without the cache, got %d sends", sends)
+	}
+}
+
+func TestPrewarmOptions(t *testing.T) {
+	info := encodeSourceInfo(makeTestInfo())
+	servers := ServerList{}
+	mocks := []*mockServer{}
+	for i := 0; i < 3; i++ {
+		server := newMockServer(t, respondToInfoAndPlayers(info, nil))
+		addr := server.conn.LocalAddr().(*net.UDPAddr)
+		servers = append(servers, &net.TCPAddr{IP: addr.IP.To4(), Port: addr.Port})
+		mocks = append(mocks, server)
+	}
+
+	// Requests are paced, and sent from the bound address.
+	cache := NewChallengeCache()
+	clock := newFakeClock()
+	cache.setClock(clock)
+	cache.SetPrewarmRate(10)
+	cache.SetPrewarmLocalAddr("127.0.0.1")
+	added, err := cache.Prewarm(context.Background(), servers, time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 {
+		t.Errorf("expected 3 challenges, got %d", added)
+	}
+	if slept := clock.Slept(); slept != time.Millisecond*200 {
+		t.Errorf("expected two waits of 100ms, got %v", slept)
+	}
+	for _, server := range mocks {
+		sources := server.Sources()
+		if len(sources) != 1 || !sources[0].(*net.UDPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("expected one request from 127.0.0.1, got %v", sources)
+		}
+	}
+
+	// The socket waits for a slot under SetMaxOpenSockets.
+	SetMaxOpenSockets(OpenSockets() + 1)
+	defer SetMaxOpenSockets(0)
+	newTestServerQuerier(t, mocks[0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := NewChallengeCache().Prewarm(ctx, servers, time.Millisecond*200); err != context.DeadlineExceeded {
+		t.Errorf("expected Prewarm to wait for a socket, got %v", err)
+	}
+}
+
+func TestChallengeCacheTTL(t *testing.T) {
+	server := newMockServer(t, respondToInfoAndPlayers(encodeSourceInfo(makeTestInfo()), nil))
+
+	clock := newFakeClock()
+	cache := NewChallengeCache()
+	cache.setClock(clock)
+	cache.SetTTL(time.Second * 30)
+
+	querier := newTestServerQuerier(t, server)
+	cache.Put(querier.socket.remote.String(), kTestChallenge)
+	querier.SetChallengeCache(cache)
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if sends := querier.SocketStats().Sends; sends != 1 {
+		t.Fatalf("expected the cached challenge to be used, got %d sends", sends)
+	}
+
+	// Once the challenge expires, the next query has to handshake again, and
+	// the new challenge goes back in the cache.
+	clock.Sleep(time.Second * 31)
+	if cache.Len() != 0 {
+		t.Errorf("expected the challenge to expire")
+	}
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if sends := querier.SocketStats().Sends; sends != 3 {
+		t.Errorf("expected a handshake after the challenge expired, got %d sends", sends)
+	}
+	if challenge := cache.Get(querier.socket.remote.String()); !bytes.Equal(challenge, kTestChallenge) {
+		t.Errorf("expected the new challenge to be cached, got %v", challenge)
+	}
+}
@@ -0,0 +1,84 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var kCSVColumns = []string{
+	"ip", "port", "name", "map", "players", "maxplayers", "bots", "ping", "vac", "version",
+}
+
+// Writes each server an Orchestrator finds as a CSV row, for loading into a
+// spreadsheet. The first row names the columns. Ping is in milliseconds.
+// Servers that didn't answer are left out, and progress isn't saved.
+type CSVSink struct {
+	lock   sync.Mutex
+	writer *csv.Writer
+	header bool
+}
+
+func NewCSVSink(w io.Writer) *CSVSink {
+	return &CSVSink{
+		writer: csv.NewWriter(w),
+	}
+}
+
+// Implements OrchestratorSink.StoreServer. Each row is flushed as it is
+// written.
+func (this *CSVSink) StoreServer(ctx context.Context, server *OrchestratedServer) error {
+	if server.Info == nil {
+		return nil
+	}
+	info := server.Info
+
+	ip, port, err := net.SplitHostPort(server.Address)
+	if err != nil {
+		return err
+	}
+	version := ""
+	if info.Ext != nil {
+		version = info.Ext.GameVersion
+	}
+	row := []string{
+		ip,
+		port,
+		info.Name,
+		info.MapName,
+		strconv.Itoa(int(info.Players)),
+		strconv.Itoa(int(info.MaxPlayers)),
+		strconv.Itoa(int(info.Bots)),
+		strconv.FormatInt(info.Ping.Milliseconds(), 10),
+		strconv.Itoa(int(info.Vac)),
+		version,
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !this.header {
+		if err := this.writer.Write(kCSVColumns); err != nil {
+			return err
+		}
+		this.header = true
+	}
+	if err := this.writer.Write(row); err != nil {
+		return err
+	}
+	this.writer.Flush()
+	return this.writer.Error()
+}
+
+// Implements OrchestratorSink.SaveProgress. This does nothing.
+func (this *CSVSink) SaveProgress(ctx context.Context, progress OrchestratorProgress) error {
+	return nil
+}
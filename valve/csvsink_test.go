@@ -0,0 +1,59 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCSVSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewCSVSink(&out)
+
+	first := makeTestInfo()
+	first.Name = `Bob's "Best", Server`
+	first.Ping = time.Millisecond * 42
+	second := makeTestInfo()
+	second.Name = "Plain"
+	second.Vac = 0
+
+	servers := []*OrchestratedServer{
+		{Address: "10.0.1.1:27015", Info: first},
+		{Address: "10.0.1.2:27015", Err: errors.New("timed out")},
+		{Address: "10.0.1.3:27016", Info: second},
+	}
+	for _, server := range servers {
+		if err := sink.StoreServer(context.Background(), server); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected a header and 2 rows, got %v", rows)
+	}
+	if !reflect.DeepEqual(rows[0], kCSVColumns) {
+		t.Errorf("unexpected header: %v", rows[0])
+	}
+	expected := []string{
+		"10.0.1.1", "27015", `Bob's "Best", Server`, "cp_dustbowl", "12", "24", "2", "42", "1", "7648638",
+	}
+	if !reflect.DeepEqual(rows[1], expected) {
+		t.Errorf("expected %q, got %q", expected, rows[1])
+	}
+	if rows[2][0] != "10.0.1.3" || rows[2][1] != "27016" || rows[2][2] != "Plain" || rows[2][8] != "0" {
+		t.Errorf("unexpected row: %q", rows[2])
+	}
+}
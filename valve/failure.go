@@ -0,0 +1,115 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+)
+
+// A broad reason a server query failed, for summing up a scan, such as "3000
+// timed out, 50 malformed".
+type FailureKind int
+
+const (
+	FailureNone FailureKind = iota
+	// No reply, or only part of a split reply, arrived in time.
+	FailureTimeout
+	// A reply arrived but couldn't be parsed.
+	FailureMalformed
+	// The address couldn't be resolved, or the network couldn't carry the query.
+	FailureConnectError
+	// The address can't be queried at all, such as a Steam relay placeholder.
+	FailureUnqueryable
+	// The host is up, but nothing is listening on the query port.
+	FailurePortClosed
+	// Anything else.
+	FailureOther
+)
+
+// Returns the failure kind as a string.
+func (this FailureKind) String() string {
+	switch this {
+	case FailureNone:
+		return "none"
+	case FailureTimeout:
+		return "timeout"
+	case FailureMalformed:
+		return "malformed"
+	case FailureConnectError:
+		return "connect error"
+	case FailureUnqueryable:
+		return "unqueryable"
+	case FailurePortClosed:
+		return "port closed"
+	default:
+		return "other"
+	}
+}
+
+// Errors that mean the server answered with something we couldn't parse.
+var kMalformedReplyErrors = []error{
+	ErrBadPacketHeader,
+	ErrMistakenReply,
+	ErrUnknownInfoVersion,
+	ErrUnsupportedGoldSrcInfo,
+	ErrImmediateRulesReply,
+	ErrBadChallengeResponse,
+	ErrDuplicatePacket,
+	ErrBadPacketNumber,
+	ErrConfusedChallengeReply,
+	ErrBadRulesReply,
+	ErrBadPlayersReply,
+	ErrWrongBz2Size,
+	ErrWrongBz2Checksum,
+	ErrTruncatedPacket,
+	ErrResponseTruncated,
+	ErrOutOfBounds,
+	ErrEmbeddedNull,
+	ErrMalformedPacket,
+}
+
+// Sort an error from creating a ServerQuerier or running a query into a
+// FailureKind.
+func ClassifyQueryError(err error) FailureKind {
+	if err == nil {
+		return FailureNone
+	}
+	if errors.Is(err, ErrUnqueryableAddress) {
+		return FailureUnqueryable
+	}
+	if errors.Is(err, ErrPortClosed) {
+		return FailurePortClosed
+	}
+	for _, malformed := range kMalformedReplyErrors {
+		if errors.Is(err, malformed) {
+			return FailureMalformed
+		}
+	}
+	// The parsers read past the end of a reply that is cut short, and Try
+	// turns the panic into the runtime error.
+	var runtimeErr runtime.Error
+	if errors.As(err, &runtimeErr) {
+		return FailureMalformed
+	}
+	if errors.Is(err, ErrMissingHost) || errors.Is(err, ErrMissingPort) || errors.Is(err, ErrBadPort) {
+		return FailureConnectError
+	}
+	if errors.Is(err, ErrPartialResponse) || errors.Is(err, context.DeadlineExceeded) {
+		return FailureTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return FailureTimeout
+		}
+		return FailureConnectError
+	}
+	return FailureOther
+}
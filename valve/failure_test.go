@@ -0,0 +1,66 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassifyQueryError(t *testing.T) {
+	queryInfo := func(address string) error {
+		querier, err := NewServerQuerier(address, time.Millisecond*50)
+		if err != nil {
+			return err
+		}
+		defer querier.Close()
+		_, err = querier.QueryInfo()
+		return err
+	}
+
+	silent := newMockServer(t, func(request []byte) [][]byte {
+		return nil
+	})
+	garbled := newMockServer(t, func(request []byte) [][]byte {
+		return [][]byte{{0xff, 0xff, 0xff, 0xff, 0x99, 0x01}}
+	})
+	truncated := newMockServer(t, func(request []byte) [][]byte {
+		return [][]byte{{0xff, 0xff, 0xff, 0xff, 0x49, 0x11}}
+	})
+
+	// A port with nothing listening on it, so the OS refuses the query.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.LocalAddr().String()
+	closed.Close()
+
+	cases := []struct {
+		name     string
+		err      error
+		expected FailureKind
+	}{
+		{"success", nil, FailureNone},
+		{"silent server", queryInfo(silent.Addr()), FailureTimeout},
+		{"garbled reply", queryInfo(garbled.Addr()), FailureMalformed},
+		{"truncated reply", queryInfo(truncated.Addr()), FailureMalformed},
+		{"refused port", queryInfo(refused), FailurePortClosed},
+		{"bad address", queryInfo("not an address"), FailureConnectError},
+		{"relay placeholder", queryInfo("169.254.1.1:27015"), FailureUnqueryable},
+		{"dumped packet", &PacketError{Err: ErrBadRulesReply}, FailureMalformed},
+		{"wrapped partial", fmt.Errorf("rules: %w", ErrPartialResponse), FailureTimeout},
+		{"anything else", errors.New("oops"), FailureOther},
+	}
+	for _, test := range cases {
+		if kind := ClassifyQueryError(test.err); kind != test.expected {
+			t.Errorf("%s: expected %v, got %v (from %v)", test.name, test.expected, kind, test.err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Builds a list of master server filters. Every condition applies to the same
+// query, so a server must match all of them. The builder can be reused for
+// multiple queriers.
+type FilterBuilder struct {
+	tokens []string
+}
+
+func NewFilterBuilder() *FilterBuilder {
+	return &FilterBuilder{}
+}
+
+func (this *FilterBuilder) add(key string, value string) *FilterBuilder {
+	this.tokens = append(this.tokens, fmt.Sprintf("\\%s\\%s", key, EscapeFilterValue(value)))
+	return this
+}
+
+// Make a value safe to use in a filter. The master has no way to escape a
+// backslash, which would start a new key, or a null, which would end the
+// filter string, so both are removed.
+func EscapeFilterValue(value string) string {
+	return strings.NewReplacer("\\", "", "\x00", "").Replace(value)
+}
+
+// Adds an arbitrary filter key and value.
+func (this *FilterBuilder) Raw(key string, value string) *FilterBuilder {
+	return this.add(key, value)
+}
+
+// Only servers running the given app.
+func (this *FilterBuilder) AppId(appId AppId) *FilterBuilder {
+	return this.add("appid", fmt.Sprintf("%d", appId))
+}
+
+// Only servers running the given map.
+func (this *FilterBuilder) Map(name string) *FilterBuilder {
+	return this.add("map", name)
+}
+
+// Only servers running the given mod directory, such as "tf".
+func (this *FilterBuilder) GameDir(dir string) *FilterBuilder {
+	return this.add("gamedir", dir)
+}
+
+// Only servers whose names match a pattern (wildcards are allowed).
+func (this *FilterBuilder) NameMatch(pattern string) *FilterBuilder {
+	return this.add("name_match", pattern)
+}
+
+// Only servers whose versions match a pattern (wildcards are allowed).
+func (this *FilterBuilder) VersionMatch(pattern string) *FilterBuilder {
+	return this.add("version_match", pattern)
+}
+
+// Only servers with all of the given tags in sv_tags.
+func (this *FilterBuilder) GameType(tags ...string) *FilterBuilder {
+	return this.add("gametype", strings.Join(tags, ","))
+}
+
+// Only servers with no players.
+func (this *FilterBuilder) Empty() *FilterBuilder {
+	return this.add("noplayers", "1")
+}
+
+// Only servers with at least one player.
+func (this *FilterBuilder) NotEmpty() *FilterBuilder {
+	return this.add("empty", "1")
+}
+
+// Only servers that are not full.
+func (this *FilterBuilder) NotFull() *FilterBuilder {
+	return this.add("full", "1")
+}
+
+// Only servers using anti-cheat.
+func (this *FilterBuilder) Secure() *FilterBuilder {
+	return this.add("secure", "1")
+}
+
+// Only dedicated servers.
+func (this *FilterBuilder) Dedicated() *FilterBuilder {
+	return this.add("dedicated", "1")
+}
+
+// Only spectator proxy servers.
+func (this *FilterBuilder) Proxy() *FilterBuilder {
+	return this.add("proxy", "1")
+}
+
+// Only servers running on Linux.
+func (this *FilterBuilder) Linux() *FilterBuilder {
+	return this.add("linux", "1")
+}
+
+// Only servers that are not password protected.
+func (this *FilterBuilder) NoPassword() *FilterBuilder {
+	return this.add("password", "0")
+}
+
+// Returns the list of \key\value tokens.
+func (this *FilterBuilder) Build() []string {
+	return append([]string{}, this.tokens...)
+}
+
+// Replaces the filter list with the conditions from a FilterBuilder.
+func (this *MasterServerQuerier) SetFilters(filters *FilterBuilder) {
+	tokens := filters.Build()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.filters = []string{}
+	if len(tokens) > 0 {
+		this.filters = append(this.filters, strings.Join(normalizeFilterKeys(tokens), ""))
+	}
+}
@@ -0,0 +1,85 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFilterBuilder(t *testing.T) {
+	filters := NewFilterBuilder().
+		AppId(App_TF2).
+		Map("cp_dustbowl").
+		NotEmpty().
+		NotFull().
+		Secure().
+		GameType("alltalk", "nocrits").
+		Raw("region", "1")
+
+	expected := []string{
+		"\\appid\\440",
+		"\\map\\cp_dustbowl",
+		"\\empty\\1",
+		"\\full\\1",
+		"\\secure\\1",
+		"\\gametype\\alltalk,nocrits",
+		"\\region\\1",
+	}
+	if tokens := filters.Build(); fmt.Sprint(tokens) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, tokens)
+	}
+
+	querier := &MasterServerQuerier{}
+	querier.SetFilters(filters)
+	if len(querier.filters) != 1 {
+		t.Fatalf("expected one filter group, got %v", querier.filters)
+	}
+	if querier.filters[0] != "\\appid\\440\\map\\cp_dustbowl\\empty\\1\\full\\1\\secure\\1\\gametype\\alltalk,nocrits\\region\\1" {
+		t.Errorf("unexpected filter: %s", querier.filters[0])
+	}
+}
+
+func TestFilterGameByName(t *testing.T) {
+	querier := &MasterServerQuerier{}
+	if err := querier.FilterGameByName("csgo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := querier.FilterGameByName("Team Fortress 2"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(querier.filters) != "[\\appid\\730 \\appid\\440]" {
+		t.Errorf("unexpected filters: %v", querier.filters)
+	}
+
+	if err := querier.FilterGameByName("notagame"); err != ErrUnknownGame {
+		t.Errorf("expected ErrUnknownGame, got %v", err)
+	}
+}
+
+func TestEscapeFilterValue(t *testing.T) {
+	if escaped := EscapeFilterValue("de\\dust\x00"); escaped != "dedust" {
+		t.Errorf("unexpected escaped value: %q", escaped)
+	}
+
+	tokens := NewFilterBuilder().Map("de\\dust").NameMatch("a\\appid\\730").Build()
+	expected := []string{"\\map\\dedust", "\\name_match\\aappid730"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("expected %q, got %q", expected, tokens)
+	}
+
+	// Each token still parses as a single key and value.
+	for _, token := range tokens {
+		parsed, err := ParseFilterString(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parsed) != 1 {
+			t.Errorf("%q split into %q", token, parsed)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"strings"
+)
+
+// A game mode, recognized by a server keyword or a map name prefix.
+type gameModeRule struct {
+	Mode     string
+	Keywords []string
+	Prefixes []string
+}
+
+// Rules are tried in order, and keywords are checked before map names, since
+// a server can run a mode on a map made for another.
+var kGameModeRules = map[AppId][]gameModeRule{
+	App_TF2: {
+		{Mode: "mvm", Keywords: []string{"mvm"}, Prefixes: []string{"mvm_"}},
+		{Mode: "payload race", Prefixes: []string{"plr_"}},
+		{Mode: "payload", Keywords: []string{"payload"}, Prefixes: []string{"pl_"}},
+		{Mode: "control point", Prefixes: []string{"cp_"}},
+		{Mode: "capture the flag", Keywords: []string{"ctf"}, Prefixes: []string{"ctf_"}},
+		{Mode: "king of the hill", Keywords: []string{"koth"}, Prefixes: []string{"koth_"}},
+		{Mode: "arena", Keywords: []string{"arena"}, Prefixes: []string{"arena_"}},
+		{Mode: "player destruction", Prefixes: []string{"pd_"}},
+		{Mode: "special delivery", Prefixes: []string{"sd_"}},
+		{Mode: "robot destruction", Prefixes: []string{"rd_"}},
+		{Mode: "pass time", Prefixes: []string{"pass_"}},
+		{Mode: "territorial control", Prefixes: []string{"tc_"}},
+		{Mode: "training", Prefixes: []string{"tr_"}},
+	},
+	App_CSGO: {
+		{Mode: "competitive", Keywords: []string{"competitive"}},
+		{Mode: "wingman", Keywords: []string{"wingman"}},
+		{Mode: "casual", Keywords: []string{"casual"}},
+		{Mode: "deathmatch", Keywords: []string{"deathmatch"}},
+		{Mode: "arms race", Keywords: []string{"armsrace", "gungameprogressive"}, Prefixes: []string{"ar_"}},
+		{Mode: "demolition", Keywords: []string{"demolition", "gungametrbomb"}},
+		{Mode: "danger zone", Keywords: []string{"survival"}, Prefixes: []string{"dz_"}},
+		{Mode: "surf", Keywords: []string{"surf"}, Prefixes: []string{"surf_"}},
+		{Mode: "climb", Keywords: []string{"kz"}, Prefixes: []string{"kz_"}},
+		{Mode: "bomb defusal", Prefixes: []string{"de_"}},
+		{Mode: "hostage rescue", Prefixes: []string{"cs_"}},
+	},
+}
+
+// Guess the game mode, such as "payload" or "competitive", from the server's
+// keywords and map name. This is a heuristic: servers pick their own keywords
+// and maps, so it can be wrong, and it only knows a few games. An empty
+// string means the mode couldn't be guessed.
+func (this *ServerInfo) GameMode() string {
+	if this.Ext == nil {
+		return ""
+	}
+	rules := kGameModeRules[this.Ext.AppId]
+
+	keywords := map[string]bool{}
+	for _, keyword := range this.Tags() {
+		keywords[keyword] = true
+	}
+	for _, rule := range rules {
+		for _, keyword := range rule.Keywords {
+			if keywords[keyword] {
+				return rule.Mode
+			}
+		}
+	}
+
+	mapName := strings.ToLower(this.MapName)
+	for _, rule := range rules {
+		for _, prefix := range rule.Prefixes {
+			if strings.HasPrefix(mapName, prefix) {
+				return rule.Mode
+			}
+		}
+	}
+	return ""
+}
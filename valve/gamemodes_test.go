@@ -0,0 +1,45 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"testing"
+)
+
+func TestGameMode(t *testing.T) {
+	cases := []struct {
+		appId    AppId
+		mapName  string
+		keywords string
+		expected string
+	}{
+		{App_TF2, "pl_badwater", "alltalk,nocrits", "payload"},
+		{App_TF2, "plr_hightower", "", "payload race"},
+		{App_TF2, "mvm_coaltown", "", "mvm"},
+		// The keyword wins over a map made for another mode.
+		{App_TF2, "cp_dustbowl", "increased_maxplayers, MvM", "mvm"},
+		{App_TF2, "mge_training_v8", "", ""},
+		{App_CSGO, "de_dust2", "secure,competitive", "competitive"},
+		{App_CSGO, "de_dust2", "", "bomb defusal"},
+		{App_CSS, "de_dust2", "", ""},
+	}
+	for _, test := range cases {
+		info := &ServerInfo{
+			MapName: test.mapName,
+			Ext: &ExtendedInfo{
+				AppId:               test.appId,
+				GameModeDescription: test.keywords,
+			},
+		}
+		if mode := info.GameMode(); mode != test.expected {
+			t.Errorf("%d %s %q: expected %q, got %q", test.appId, test.mapName, test.keywords, test.expected, mode)
+		}
+	}
+
+	if mode := (&ServerInfo{MapName: "pl_upward"}).GameMode(); mode != "" {
+		t.Errorf("expected no mode without extended info, got %q", mode)
+	}
+}
@@ -7,32 +7,166 @@ package valve
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const kMaxFilterLength = 190
 const kDefaultMasterTimeout = time.Minute * 5
+const kDefaultPingTimeout = time.Second * 5
 
 var ErrBadResponseHeader = fmt.Errorf("bad response header")
-var kMasterResponseHeader = []byte{0xff, 0xff, 0xff, 0xff, 0x66, 0x0a}
+var ErrMalformedFilter = fmt.Errorf("malformed filter string")
+var ErrUnknownGame = fmt.Errorf("unknown game name")
+var ErrMaxDurationExceeded = fmt.Errorf("query ran out of time")
+var ErrBadStartAddress = fmt.Errorf("start address must be an IPv4 address and port")
+var ErrNoMasters = fmt.Errorf("no master servers to choose from")
+var ErrByteBudgetExceeded = fmt.Errorf("query received more bytes than allowed")
+var ErrBadTargetAddress = fmt.Errorf("target must be an IPv4 address and port")
+var ErrServerCountMismatch = fmt.Errorf("master's server count doesn't match its list")
+var ErrMalformedPacket = fmt.Errorf("master reply is too short to hold a server")
+var ErrTooManyFilters = fmt.Errorf("a single batch can only be queried with one filter")
+
+// Returned by callbacks to end a query once the server or batch limit is
+// reached.
+var errServerLimit = fmt.Errorf("server limit reached")
+
+// Returned by FindServer's callback to end a query once the target is seen.
+var errServerFound = fmt.Errorf("server found")
 var kNullIP = net.IP([]byte{0, 0, 0, 0})
 
 // The callback the master query tool uses to notify of a batch of servers that
 // has just been received.
 type MasterQueryCallback func(batch ServerList) error
 
+// Notified of how long the master took to answer each batch. Batches are
+// numbered from 0 within each filter list sent.
+type BatchTimingFunc func(batch int, rtt time.Duration)
+
+// Notified of the filter string sent for each batch, numbered as for
+// BatchTimingFunc.
+type FilterStringFunc func(batch int, filter string)
+
+// Counters for batch requests sent to the master, for judging packet loss.
+type MasterStats struct {
+	// Batch requests sent, including retries.
+	Attempts int64
+	// Requests sent again because the previous attempt got no usable reply.
+	Retries int64
+	// Retries as a fraction of attempts. Zero if nothing was sent.
+	LossRatio float64
+}
+
+// How servers are told apart when removing duplicates from the master's list.
+type DedupMode int
+
+const (
+	// Servers are the same if both IP and port match. This is the default.
+	DedupByAddress DedupMode = iota
+	// Servers on the same IP are the same, whatever their port, so only the
+	// first port listed for each IP is kept.
+	DedupByIP
+)
+
+// Returns the key that duplicates of addr share.
+func (this DedupMode) key(addr *net.TCPAddr) string {
+	if this == DedupByIP {
+		return addr.IP.String()
+	}
+	return addr.String()
+}
+
+// Anything that can list servers like the master, such as MasterServerQuerier
+// or WebMasterQuerier.
+type MasterQuerier interface {
+	Query(callback MasterQueryCallback) error
+	QueryContext(ctx context.Context, callback MasterQueryCallback) error
+}
+
 // Class for querying the master server.
+//
+// A querier may be shared between goroutines. Queries are serialized, since
+// they share a single socket, and filters cannot change while a query is
+// running.
 type MasterServerQuerier struct {
-	cn          *UdpSocket
+	lock sync.Mutex
+	// Changing cn needs both locks, so that SocketStats and RemoteAddr can
+	// read it while a query holds the main one. The counters of sockets it
+	// replaced are kept in retiredStats.
+	cnLock       sync.Mutex
+	cn           *UdpSocket
+	retiredStats SocketStats
+
 	hostAndPort string
 	filters     []string
+	andFilters  string
+	clock       clock
+	bestEffort  bool
+	dumpPackets bool
+
+	optimizeBatching bool
+	noTerminator     bool
+	redial           bool
+	seedFromHighest  bool
+	dedup            DedupMode
+	maxServers       int
+	maxBatches       int
+	scanRetries      int
+	scanRetryDelay   time.Duration
+	maxBytes         int64
+	callbackBatch    int
+	maxDuration      time.Duration
+	maxDurationError bool
+	startAddress     string
+
+	// Set if the master asked for a challenge, and sent with every query.
+	challenge []byte
+
+	responseHeader []byte
+	headerWindow   int
+	countPrefix    bool
+	clientId       string
+
+	// Ranges queried in parallel, and where this querier's range ends.
+	parallelSeeds []*net.TCPAddr
+	stopAddress   *net.TCPAddr
+
+	retainPackets bool
+	rawPackets    [][]byte
+
+	batchTiming  BatchTimingFunc
+	filterString FilterStringFunc
+	lastRtt      time.Duration
+
+	// Checkpoints, and the progress of the current query.
+	checkpointSink  CheckpointSink
+	checkpointEvery int
+	progress        Checkpoint
+
+	statsLock sync.Mutex
+	stats     MasterStats
 }
 
 // Create a new master server querier on the given host and port.
 func NewMasterServerQuerier(hostAndPort string) (*MasterServerQuerier, error) {
-	cn, err := NewUdpSocket(hostAndPort, kDefaultMasterTimeout)
+	return NewMasterServerQuerierProtocol(hostAndPort, ProtocolUDP)
+}
+
+// Same as NewMasterServerQuerier, but talking to the master over the given
+// protocol, such as a mirror that serves the list over TCP.
+func NewMasterServerQuerierProtocol(hostAndPort string, protocol SocketProtocol) (*MasterServerQuerier, error) {
+	if err := ValidateHostPort(hostAndPort); err != nil {
+		return nil, err
+	}
+	cn, err := NewSocket(hostAndPort, kDefaultMasterTimeout, protocol)
 	if err != nil {
 		return nil, err
 	}
@@ -43,128 +177,1196 @@ func NewMasterServerQuerier(hostAndPort string) (*MasterServerQuerier, error) {
 	return &MasterServerQuerier{
 		cn:          cn,
 		hostAndPort: hostAndPort,
+		clock:       realClock{},
 	}, nil
 }
 
+// Replace the time source for the querier and its socket.
+func (this *MasterServerQuerier) setClock(clock clock) {
+	this.clock = clock
+	this.cn.clock = clock
+}
+
+// If enabled, parse errors come back as a PacketError with a hex dump of the
+// packet. This is off by default, since the dump includes the whole reply.
+func (this *MasterServerQuerier) SetDumpPackets(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.dumpPackets = enabled
+}
+
 // Adds by AppIds to the filter list.
 func (this *MasterServerQuerier) FilterAppIds(appIds []AppId) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	for _, appId := range appIds {
 		this.filters = append(this.filters, fmt.Sprintf("\\appid\\%d", appId))
 	}
 }
 
+// Adds a filter for a game given by name, such as "tf2" or "Team Fortress 2".
+// Unknown names fail with ErrUnknownGame.
+func (this *MasterServerQuerier) FilterGameByName(name string) error {
+	appId, ok := AppIdByName(name)
+	if !ok {
+		return ErrUnknownGame
+	}
+	this.FilterAppIds([]AppId{appId})
+	return nil
+}
+
+// Excludes servers running the given app. Unlike other filters, this is not
+// part of the \or\ block, so it applies to every query.
+func (this *MasterServerQuerier) FilterNotAppId(appId AppId) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.andFilters += fmt.Sprintf("\\napp\\%d", appId)
+}
+
+// Asks the master to list only one server for each hashed address, so that
+// servers sharing an address come back as one entry. Like FilterNotAppId, this
+// applies to every query rather than being part of the \or\ block.
+func (this *MasterServerQuerier) FilterCollapseAddrHash() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	const kCollapse = "\\collapse_addr_hash\\1"
+	if !strings.Contains(this.andFilters, kCollapse) {
+		this.andFilters += kCollapse
+	}
+}
+
+// Adds conditions that every server must match, such as \map\cp_dustbowl.
+// Filters from FilterAppIds and AddRawFilter are alternatives, joined with
+// \or\, but these are sent outside the \or\ block, so they apply to every
+// query along with whichever alternative matched.
+func (this *MasterServerQuerier) AddAndFilter(filter string) error {
+	normalized, err := normalizeFilterString(filter)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.andFilters += normalized
+	return nil
+}
+
 func (this *MasterServerQuerier) ClearFilters() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	this.filters = []string{}
+	this.andFilters = ""
+}
+
+// Sets the filter list to a single Valve-style filter string, such as
+// \appid\440\empty\1. All of its conditions apply to the same query.
+func (this *MasterServerQuerier) SetFilterString(filter string) error {
+	filters, err := parseFilterList(filter)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.filters = filters
+	return nil
+}
+
+// Adds a raw Valve-style filter string to the filter list. Its conditions apply
+// to the same query.
+func (this *MasterServerQuerier) AddRawFilter(filter string) error {
+	filters, err := parseFilterList(filter)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.filters = append(this.filters, filters...)
+	return nil
+}
+
+// Parse a filter string and normalize its keys, giving it back as one string.
+// An empty filter gives an empty string.
+func normalizeFilterString(filter string) (string, error) {
+	tokens, err := ParseFilterString(filter)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(normalizeFilterKeys(tokens), ""), nil
+}
+
+// Parse a filter string into a filter list holding it as a single entry, or
+// an empty list if the filter is empty.
+func parseFilterList(filter string) ([]string, error) {
+	normalized, err := normalizeFilterString(filter)
+	if err != nil {
+		return nil, err
+	}
+	if normalized == "" {
+		return []string{}, nil
+	}
+	return []string{normalized}, nil
 }
 
-func computeNextFilterList(filters []string) ([]string, []string) {
-	return filters[0:1], filters[1:]
+// The master matches filter keys case-sensitively, and silently returns
+// nothing for a key like \AppId. Lowercase the keys, but not the values.
+func normalizeFilterKeys(tokens []string) []string {
+	normalized := make([]string, len(tokens))
+	for i, token := range tokens {
+		end := strings.Index(token[1:], "\\") + 1
+		normalized[i] = strings.ToLower(token[:end]) + token[end:]
+	}
+	return normalized
+}
+
+// Split a combined filter string like \appid\440\empty\1 into its
+// individual \key\value tokens. Values may be empty, as in \hostname\, and
+// a single trailing backslash is ignored.
+func ParseFilterString(filter string) ([]string, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(filter, "\\") {
+		return nil, ErrMalformedFilter
+	}
+
+	// The master would see the filter cut off at a null byte.
+	if strings.IndexByte(filter, 0) != -1 {
+		return nil, ErrEmbeddedNull
+	}
+
+	parts := strings.Split(filter[1:], "\\")
+	if len(parts)%2 != 0 {
+		if parts[len(parts)-1] != "" {
+			return nil, ErrMalformedFilter
+		}
+		parts = parts[:len(parts)-1]
+	}
+
+	tokens := []string{}
+	for i := 0; i < len(parts); i += 2 {
+		if parts[i] == "" {
+			return nil, ErrMalformedFilter
+		}
+		tokens = append(tokens, "\\"+parts[i]+"\\"+parts[i+1])
+	}
+	return tokens, nil
+}
+
+// Take the first filter from the list, to send as a query by itself.
+func nextSingleFilter(filters []string) ([]string, []string) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return filters[:1], filters[1:]
+}
+
+// Take as many filters from the front of the list as fit in one query, with
+// reserved bytes left over for whatever else goes along with them. They are
+// combined with \or\, which counts conditions rather than filters, so a
+// filter with more than one condition has to be sent by itself.
+func computeNextFilterList(filters []string, reserved int) ([]string, []string) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	count := 1
+	if filterConditions(filters[0]) == 1 {
+		length := reserved + len(filters[0])
+		for count < len(filters) && filterConditions(filters[count]) == 1 {
+			header := fmt.Sprintf("\\or\\%d", count+1)
+			if len(header)+length+len(filters[count]) > kMaxFilterLength {
+				break
+			}
+			length += len(filters[count])
+			count++
+		}
+	}
+	return filters[:count], filters[count:]
+}
+
+// Returns the number of \key\value conditions in a filter.
+func filterConditions(filter string) int {
+	return strings.Count(filter, "\\") / 2
 }
 
 // Query the master. Since the master server has timeout problems with lots of
 // subsequent requests, we sleep for two seconds in between each batch request.
 // This means the querying process is quite slow.
 func (this *MasterServerQuerier) Query(callback MasterQueryCallback) error {
-	filters, remaining := computeNextFilterList(this.filters)
+	return this.QueryContext(context.Background(), callback)
+}
+
+// Query the master, stopping early if the context is cancelled. Concurrent
+// calls wait for each other.
+func (this *MasterServerQuerier) QueryContext(ctx context.Context, callback MasterQueryCallback) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	parent := ctx
+	if this.maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.maxDuration)
+		defer cancel()
+	}
+
+	chunked, flush := chunkServers(callback, this.callbackBatch)
+	callback = this.skipDelivered(this.limitBatches(this.limitBytes(this.limitServers(chunked))))
+
+	this.progress = Checkpoint{}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if len(this.parallelSeeds) > 0 {
+			err = this.queryParallelSeeds(ctx, callback)
+		} else {
+			err = this.queryRegion(ctx, RegionAll, callback)
+		}
+		if attempt >= this.scanRetries || !isGarbledMasterReply(err) {
+			break
+		}
+		if sleepErr := this.clock.SleepContext(ctx, this.scanRetryDelay<<uint(attempt)); sleepErr != nil {
+			err = sleepErr
+			break
+		}
+	}
+	if flushErr := flush(); flushErr != nil {
+		return flushErr
+	}
+	if err == errServerLimit {
+		return nil
+	}
+	timedOut := err == context.DeadlineExceeded || ctx.Err() == context.DeadlineExceeded
+	if err != nil && timedOut && parent.Err() == nil {
+		// Out of time, but everything received so far was delivered.
+		if this.maxDurationError {
+			return ErrMaxDurationExceeded
+		}
+		return nil
+	}
+	return err
+}
+
+// Cap how long Query and QueryContext may run, or 0 for no cap. When time is
+// up, the query ends without an error, and the callback will have seen every
+// server received until then.
+func (this *MasterServerQuerier) SetMaxDuration(duration time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.maxDuration = duration
+}
+
+// If enabled, running out of time fails with ErrMaxDurationExceeded instead.
+func (this *MasterServerQuerier) SetMaxDurationError(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.maxDurationError = enabled
+}
+
+// Stop queries after this many servers have been delivered, or never if 0.
+// The batch that reaches the limit is cut short so that exactly this many are
+// delivered.
+func (this *MasterServerQuerier) SetMaxServers(max int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.maxServers = max
+}
+
+// Wrap a callback to enforce the server limit. This must be called with the
+// lock held.
+func (this *MasterServerQuerier) limitServers(callback MasterQueryCallback) MasterQueryCallback {
+	if this.maxServers <= 0 {
+		return callback
+	}
+
+	remaining := this.maxServers
+	return func(batch ServerList) error {
+		if len(batch) < remaining {
+			remaining -= len(batch)
+			return callback(batch)
+		}
+
+		batch = batch[:remaining]
+		remaining = 0
+		if err := callback(batch); err != nil {
+			return err
+		}
+		return errServerLimit
+	}
+}
+
+// Start the whole query over, up to this many times, if the master sends a
+// reply that isn't a valid batch, such as a stray packet. This is separate from
+// the retries for each batch, which only cover lost replies. The first retry
+// waits for delay, and each one after waits twice as long as the last. Servers
+// the callback already saw aren't delivered again.
+func (this *MasterServerQuerier) SetScanRetries(retries int, delay time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.scanRetries = retries
+	this.scanRetryDelay = delay
+}
+
+// Check whether a query failed on a reply that wasn't a valid batch.
+func isGarbledMasterReply(err error) bool {
+	return errors.Is(err, ErrBadResponseHeader) || errors.Is(err, ErrMalformedPacket)
+}
+
+// Wrap a callback to drop servers delivered by an earlier attempt, if the query
+// may be started over. This must be called with the lock held.
+func (this *MasterServerQuerier) skipDelivered(callback MasterQueryCallback) MasterQueryCallback {
+	if this.scanRetries <= 0 {
+		return callback
+	}
+
+	delivered := map[string]bool{}
+	return func(batch ServerList) error {
+		fresh := ServerList{}
+		for _, addr := range batch {
+			key := this.dedup.key(addr)
+			if !delivered[key] {
+				delivered[key] = true
+				fresh = append(fresh, addr)
+			}
+		}
+		if len(fresh) == 0 && len(batch) > 0 {
+			return nil
+		}
+		return callback(fresh)
+	}
+}
+
+// Stop queries after this many batches have been received from the master, or
+// never if 0. This ends the query cleanly, without an error, even though the
+// master's list didn't end.
+func (this *MasterServerQuerier) SetMaxBatches(max int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.maxBatches = max
+}
+
+// Wrap a callback to enforce the batch limit. This must be called with the
+// lock held.
+func (this *MasterServerQuerier) limitBatches(callback MasterQueryCallback) MasterQueryCallback {
+	if this.maxBatches <= 0 {
+		return callback
+	}
+
+	remaining := this.maxBatches
+	return func(batch ServerList) error {
+		remaining--
+		if err := callback(batch); err != nil {
+			return err
+		}
+		if remaining == 0 {
+			return errServerLimit
+		}
+		return nil
+	}
+}
+
+// Hand servers to the callback in chunks of this many, gathering them across
+// batches from the master, or pass each batch on as it arrives if 0. Whatever
+// is left when the query ends is delivered as a final, smaller chunk.
+func (this *MasterServerQuerier) SetCallbackBatchSize(size int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.callbackBatch = size
+}
+
+// Wrap a callback to deliver servers in chunks of the given size, or as-is if
+// the size is 0 or less. The returned function delivers anything still
+// buffered, and must be called once the query is over.
+func chunkServers(callback MasterQueryCallback, size int) (MasterQueryCallback, func() error) {
+	if size <= 0 {
+		return callback, func() error { return nil }
+	}
+
+	pending := ServerList{}
+	failed := false
+	chunked := func(batch ServerList) error {
+		pending = append(pending, batch...)
+		for len(pending) >= size {
+			chunk := pending[:size]
+			pending = append(ServerList{}, pending[size:]...)
+			if err := callback(chunk); err != nil {
+				failed = true
+				return err
+			}
+		}
+		return nil
+	}
+	flush := func() error {
+		// Don't call back again once the callback has asked to stop.
+		if failed || len(pending) == 0 {
+			return nil
+		}
+		chunk := pending
+		pending = nil
+		return callback(chunk)
+	}
+	return chunked, flush
+}
+
+// Stop queries with ErrByteBudgetExceeded once they have received more than
+// this many bytes, or never if 0. The check is made after each batch has gone
+// to the callback, so everything received is still delivered. Only this
+// querier's own socket is counted, not those used for parallel seeds, except
+// that QueryAllRegions also counts the masters it queries for other regions.
+func (this *MasterServerQuerier) SetMaxReceivedBytes(max int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.maxBytes = max
+}
+
+// Wrap a callback to enforce the byte budget. This must be called with the
+// lock held.
+func (this *MasterServerQuerier) limitBytes(callback MasterQueryCallback) MasterQueryCallback {
+	if this.maxBytes <= 0 {
+		return callback
+	}
+
+	counter := this.newReceivedCounter()
+	received := int64(0)
+	return func(batch ServerList) error {
+		if err := callback(batch); err != nil {
+			return err
+		}
+		received += counter.next()
+		if received > this.maxBytes {
+			return ErrByteBudgetExceeded
+		}
+		return nil
+	}
+}
+
+// Counts the bytes a querier receives, even if a redial or
+// SelectFastestMaster replaces its socket partway through.
+type receivedCounter struct {
+	querier *MasterServerQuerier
+	socket  *UdpSocket
+	last    int64
+}
+
+// This must be called with the lock held.
+func (this *MasterServerQuerier) newReceivedCounter() *receivedCounter {
+	return &receivedCounter{
+		querier: this,
+		socket:  this.cn,
+		last:    this.cn.Stats().BytesReceived,
+	}
+}
+
+// Returns how many bytes arrived since the last call. This must be called
+// with the querier's lock held.
+func (this *receivedCounter) next() int64 {
+	bytes := int64(0)
+	if cn := this.querier.cn; cn != this.socket {
+		// The old socket is closed, so its count is final.
+		bytes = this.socket.Stats().BytesReceived - this.last
+		this.socket, this.last = cn, 0
+	}
+	now := this.socket.Stats().BytesReceived
+	bytes += now - this.last
+	this.last = now
+	return bytes
+}
+
+// Change how long to wait for each reply from the master. The default is five
+// minutes.
+func (this *MasterServerQuerier) SetTimeout(timeout time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.cn.SetTimeout(timeout)
+}
+
+// Change how many queries are sent to the master per minute. The default
+// stays under Valve's limit. Zero disables the limit, which is only useful
+// for private or mock masters.
+func (this *MasterServerQuerier) SetRateLimit(ratePerMinute int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.cn.SetRateLimit(ratePerMinute)
+}
+
+// Some third-party masters never send the null terminator, and just stop
+// replying after the last batch. If enabled, running out of retries after a
+// batch has been received ends the list instead of failing the query.
+func (this *MasterServerQuerier) SetAllowMissingTerminator(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.noTerminator = enabled
+}
+
+// The master's host name is resolved once, but Valve balances masters through
+// DNS, so a long query can outlive the backend it started on. If enabled, a
+// batch that fails twice in a row makes the querier look the name up again,
+// skipping the DNS cache, and switch to a new socket before trying again.
+func (this *MasterServerQuerier) SetRedialOnFailure(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.redial = enabled
+}
+
+// Resolve the master again and replace the socket. This must be called with
+// the lock held.
+func (this *MasterServerQuerier) redialMaster() error {
+	if host, _, err := net.SplitHostPort(this.hostAndPort); err == nil {
+		sDnsCache.forget(host)
+	}
+
+	cn, err := NewSocket(this.hostAndPort, this.cn.timeout, this.cn.protocol)
+	if err != nil {
+		return err
+	}
+	cn.wait = this.cn.wait
+	cn.next = this.cn.next
+	cn.clock = this.cn.clock
+
+	this.replaceSocket(cn)
+	this.challenge = nil
+	return nil
+}
+
+// Switch to a new socket, closing the old one. This must be called with the
+// lock held.
+func (this *MasterServerQuerier) replaceSocket(cn *UdpSocket) {
+	this.cnLock.Lock()
+	defer this.cnLock.Unlock()
+
+	this.cn.Close()
+	this.retiredStats = this.retiredStats.add(this.cn.Stats())
+	this.cn = cn
+}
+
+// If enabled, single-condition filters, such as those from FilterAppIds, are
+// combined into \or\ queries up to the master's length limit, after sorting
+// them shortest first so they pack into fewer round trips. By default, each
+// filter is sent as its own query. This doesn't change which servers are
+// returned.
+func (this *MasterServerQuerier) SetOptimizeBatching(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.optimizeBatching = enabled
+}
+
+// If enabled, every reply from the master is kept, so that a strange query
+// can be parsed again offline. This is off by default, since the packets are
+// never released. Replies on separate sockets, from other masters in
+// QueryAllRegions or from parallel seeds, aren't kept.
+func (this *MasterServerQuerier) SetRetainRawPackets(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.retainPackets = enabled
+}
+
+// Returns the replies kept since SetRetainRawPackets was enabled, in the order
+// they arrived.
+func (this *MasterServerQuerier) RawPackets() [][]byte {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return append([][]byte{}, this.rawPackets...)
+}
+
+// Set a function to be told the round trip time of each batch, from sending
+// the query to receiving the reply, not counting the wait for the rate limit.
+// It only sees batches received on this querier's own socket. Nil turns it
+// off.
+func (this *MasterServerQuerier) SetBatchTimingFunc(fn BatchTimingFunc) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.batchTiming = fn
+}
+
+// Set a function to be told the exact filter string sent for each batch,
+// including any \or\ header and and-filters, for debugging unexpected
+// results. Nil turns it off. With parallel seeds or region mirrors, each
+// master numbers its own batches, and the function may be called from several
+// goroutines at once.
+func (this *MasterServerQuerier) SetFilterStringFunc(fn FilterStringFunc) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.filterString = fn
+}
+
+// Some community masters want queries to name the client. If set, the
+// identifier is sent as one more string after the filter. Valve's master
+// doesn't expect it, so it's off by default.
+func (this *MasterServerQuerier) SetClientIdentifier(id string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.clientId = id
+}
+
+// Expect a different header on master responses, for third-party masters
+// that otherwise speak the same protocol. Nil restores HeaderMasterResponse.
+func (this *MasterServerQuerier) SetResponseHeader(header []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.responseHeader = nil
+	if header != nil {
+		this.responseHeader = append([]byte{}, header...)
+	}
+}
+
+// Look for the response header within the first n bytes of each response,
+// for mirrors that pad the front of it, and skip whatever comes before. The
+// default, 0, requires the header at the very start.
+func (this *MasterServerQuerier) SetHeaderSearchWindow(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.headerWindow = n
+}
+
+// Drop any padding before the response header, within the search window.
+// This must be called with the lock held.
+func (this *MasterServerQuerier) skipPadding(packet []byte) []byte {
+	if this.headerWindow <= 0 {
+		return packet
+	}
+
+	header := this.expectedHeader()
+	limit := this.headerWindow + len(header)
+	if limit > len(packet) {
+		limit = len(packet)
+	}
+	if offset := bytes.Index(packet[:limit], header); offset > 0 {
+		return packet[offset:]
+	}
+	return packet
+}
+
+// Expect a little-endian uint16 count of servers after the response header,
+// as some third-party masters send. The count doesn't include the terminator,
+// and a list that doesn't match it fails with ErrServerCountMismatch. Valve's
+// masters don't send a count, so this is off by default.
+func (this *MasterServerQuerier) SetHasCountPrefix(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.countPrefix = enabled
+}
+
+// This must be called with the lock held.
+func (this *MasterServerQuerier) expectedHeader() []byte {
+	if this.responseHeader != nil {
+		return this.responseHeader
+	}
+	return HeaderMasterResponse
+}
+
+// Start queries after the given "ip:port" instead of at the beginning of the
+// list. The master orders servers by address, so a high seed returns only the
+// tail of the list. An empty string starts at the beginning again.
+func (this *MasterServerQuerier) SetStartAddress(hostAndPort string) error {
+	if hostAndPort != "" {
+		addr, err := parseSeedAddress(hostAndPort)
+		if err != nil {
+			return err
+		}
+		hostAndPort = addr.String()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.startAddress = hostAndPort
+	return nil
+}
+
+// Parse an "ip:port" seed. The master only pages through IPv4 addresses.
+func parseSeedAddress(hostAndPort string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(hostAndPort)
+	if err != nil {
+		return nil, ErrBadStartAddress
+	}
+	ip := net.ParseIP(host).To4()
+	number, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrBadStartAddress
+	}
+	return &net.TCPAddr{IP: ip, Port: int(number)}, nil
+}
+
+// This must be called with the lock held.
+func (this *MasterServerQuerier) queryRegion(ctx context.Context, region byte, callback MasterQueryCallback) error {
+	all := this.filters
+	next := nextSingleFilter
+	if this.optimizeBatching {
+		all = append([]string{}, this.filters...)
+		sort.SliceStable(all, func(i, j int) bool {
+			return len(all[i]) < len(all[j])
+		})
+		// The top-level filters and the client id are sent with every query.
+		reserved := len(this.andFilters) + len(this.clientId)
+		next = func(filters []string) ([]string, []string) {
+			return computeNextFilterList(filters, reserved)
+		}
+	}
+
+	filters, remaining := next(all)
 	for {
-		if err := this.tryQuery(callback, filters); err != nil {
+		if err := this.tryQuery(ctx, region, callback, filters); err != nil {
 			return err
 		}
 
 		if len(remaining) == 0 {
 			break
 		}
-		filters, remaining = computeNextFilterList(remaining)
+		filters, remaining = next(remaining)
 	}
 	return nil
 }
 
+// Choose what counts as a duplicate server. Duplicates are always dropped, and
+// by default a server is a duplicate only if its IP and port were both seen
+// already.
+func (this *MasterServerQuerier) SetDeduplicate(mode DedupMode) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.dedup = mode
+}
+
+// If enabled, the next batch is asked for after the highest address seen so
+// far, rather than the last one in the batch. The master should list servers
+// in address order, but one that doesn't would otherwise have servers skipped
+// or listed again. In this mode, a batch that doesn't go past the highest
+// address ends the query, since asking again would loop.
+func (this *MasterServerQuerier) SetSeedFromHighestAddress(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.seedFromHighest = enabled
+}
+
+// Query a single batch of servers from the master, starting after the given
+// seed address ("" or "0.0.0.0:0" for the first batch). This does not retry,
+// but the request still waits for SetRateLimit like any other. It returns the
+// seed for the next batch, and whether the list is complete. Query sends each
+// filter as its own pass over the list, which a single batch can't do, so this
+// fails with ErrTooManyFilters if there is more than one.
+func (this *MasterServerQuerier) QueryBatch(ctx context.Context, seed string) (ServerList, string, bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.filters) > 1 {
+		return nil, "", false, ErrTooManyFilters
+	}
+
+	if seed == "" {
+		seed = "0.0.0.0:0"
+	}
+	this.countAttempt(false)
+	packet, err := this.exchange(ctx, this.buildQuery(RegionAll, seed, this.filters))
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	servers, done, err := this.parseResponse(packet)
+	if err != nil {
+		return nil, "", false, withPacketDump(this.dumpPackets, err, packet)
+	}
+
+	// An empty batch without a terminator also ends the list.
+	if done || len(servers) == 0 {
+		return servers, "", true, nil
+	}
+	return servers, servers[len(servers)-1].String(), false, nil
+}
+
+// Page through the master's list until the given "ip:port" shows up, using
+// the querier's filters. This returns true as soon as it does, without asking
+// for any more batches, or false if the list ended without it.
+func (this *MasterServerQuerier) FindServer(ctx context.Context, target string) (bool, error) {
+	addr, err := parseSeedAddress(target)
+	if err != nil {
+		return false, ErrBadTargetAddress
+	}
+
+	err = this.QueryContext(ctx, func(batch ServerList) error {
+		for _, server := range batch {
+			if server.IP.Equal(addr.IP) && server.Port == addr.Port {
+				return errServerFound
+			}
+		}
+		return nil
+	})
+	if err == errServerFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// Check that the master is reachable by sending a single query and waiting up
+// to five seconds (or the context's deadline) for a valid response header.
+func (this *MasterServerQuerier) Ping(ctx context.Context) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, kDefaultPingTimeout)
+	defer cancel()
+
+	packet, err := this.exchange(ctx, this.buildQuery(RegionAll, "0.0.0.0:0", this.filters))
+	if err != nil {
+		return err
+	}
+	packet = this.skipPadding(packet)
+	if header := this.expectedHeader(); len(packet) < len(header) || bytes.Compare(packet[0:len(header)], header) != 0 {
+		return withPacketDump(this.dumpPackets, newMasterHeaderError(packet), packet)
+	}
+	return nil
+}
+
+// Ping each of the given masters in turn, and switch this querier over to the
+// one with the lowest round trip time. Masters that fail the ping are skipped;
+// if none pass, the last error is returned and the querier is unchanged.
+func (this *MasterServerQuerier) SelectFastestMaster(ctx context.Context, hosts []string) (string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var best *MasterServerQuerier
+	bestHost := ""
+	err := ErrNoMasters
+	for _, host := range hosts {
+		other, cloneErr := this.clone(host)
+		if cloneErr != nil {
+			err = cloneErr
+			continue
+		}
+		if err = other.Ping(ctx); err != nil {
+			other.Close()
+			continue
+		}
+		if best != nil && best.lastRtt <= other.lastRtt {
+			other.Close()
+			continue
+		}
+		if best != nil {
+			best.Close()
+		}
+		best = other
+		bestHost = host
+	}
+	if best == nil {
+		return "", err
+	}
+
+	this.replaceSocket(best.cn)
+	this.hostAndPort = bestHost
+	this.challenge = best.challenge
+	return bestHost, nil
+}
+
 // Build a packet to query the master server, given an initial starting server
 // ("0.0.0.0:0" for the initial batch) and an optional list of filter strings.
 func BuildMasterQuery(hostAndPort string, filters []string) []byte {
+	return BuildRegionMasterQuery(RegionAll, hostAndPort, filters)
+}
+
+// Same as BuildMasterQuery, but only for servers in one region.
+func BuildRegionMasterQuery(region byte, hostAndPort string, filters []string) []byte {
+	return buildMasterQuery(region, hostAndPort, filters, "")
+}
+
+// Returns the length of the packet BuildMasterQuery would produce, without
+// building it. Useful for keeping queries under the path MTU.
+func MasterQuerySize(hostAndPort string, filters []string) int {
+	// Query type, region, and the null-terminated seed.
+	size := 2 + len(hostAndPort) + 1
+	switch len(filters) {
+	case 0:
+		size += 2
+	case 1:
+		size += len(filters[0]) + 1
+	default:
+		size += len(fmt.Sprintf("\\or\\%d", len(filters)))
+		for _, filter := range filters {
+			size += len(filter)
+		}
+		size++
+	}
+	return size
+}
+
+// Build a query with this querier's and-filters and client identifier. This
+// must be called with the lock held.
+func (this *MasterServerQuerier) buildQuery(region byte, seed string, filters []string) []byte {
+	query := buildMasterQuery(region, seed, filters, this.andFilters)
+	if this.clientId != "" {
+		query = append(append(query, this.clientId...), 0)
+	}
+	return query
+}
+
+// Build a master query whose filters are combined with \or\, followed by
+// top-level filters that apply regardless of which alternative matched.
+func buildMasterQuery(region byte, hostAndPort string, filters []string, andFilters string) []byte {
 	packet := PacketBuilder{}
-	packet.WriteByte(0x31) // Magic number
-	packet.WriteByte(0xFF) // All regions.
+	packet.WriteByte(A2M_GET_SERVERS_BATCH2)
+	packet.WriteByte(region)
 	packet.WriteCString(hostAndPort)
 
-	if len(filters) == 0 {
+	if len(filters) == 0 && andFilters == "" {
 		packet.WriteByte(0)
 		packet.WriteByte(0)
-	} else if len(filters) == 1 {
-		packet.WriteCString(filters[0])
 	} else {
-		header := fmt.Sprintf("\\or\\%d", len(filters))
-		packet.WriteBytes([]byte(header))
-		for _, filter := range filters {
-			packet.WriteBytes([]byte(filter))
-		}
-		packet.WriteByte(0)
+		packet.WriteCString(masterFilterString(filters, andFilters))
 	}
 	return packet.Bytes()
 }
 
-func (this *MasterServerQuerier) tryQuery(callback MasterQueryCallback, filters []string) error {
-	query := BuildMasterQuery("0.0.0.0:0", filters)
-	if err := this.cn.Send(query); err != nil {
-		return err
+// The filter part of a master query, as it goes out on the wire.
+func masterFilterString(filters []string, andFilters string) string {
+	if len(filters) <= 1 {
+		return strings.Join(filters, "") + andFilters
 	}
+	return fmt.Sprintf("\\or\\%d", len(filters)) + strings.Join(filters, "") + andFilters
+}
 
-	packet, err := this.cn.Recv()
-	if err != nil {
-		return err
+// Returned when a master reply doesn't start with the expected header. Format
+// is a guess at what the reply was instead. This unwraps to
+// ErrBadResponseHeader.
+type MasterHeaderError struct {
+	Format string
+}
+
+func (this *MasterHeaderError) Error() string {
+	return fmt.Sprintf("%v (%s)", ErrBadResponseHeader, this.Format)
+}
+
+func (this *MasterHeaderError) Unwrap() error {
+	return ErrBadResponseHeader
+}
+
+// Replies that might come back instead of a master batch, most specific
+// first.
+var kKnownMasterReplies = []struct {
+	prefix []byte
+	format string
+}{
+	{HeaderMasterResponse, "Valve master batch"},
+	{[]byte{0xff, 0xff, 0xff, 0xff, M2A_SERVER_BATCH}, "master batch with an unknown version"},
+	{[]byte{0xff, 0xff, 0xff, 0xff, S2C_CHALLENGE}, "challenge request"},
+	{[]byte{0xff, 0xff, 0xff, 0xff, S2A_INFO_SOURCE}, "game server info reply, not a master"},
+	{[]byte{0xff, 0xff, 0xff, 0xff, S2A_INFO_GOLDSRC}, "game server info reply, not a master"},
+	{[]byte{0xfe, 0xff, 0xff, 0xff}, "split packet"},
+}
+
+// Work out what an unexpected master reply looks like, so that a change in
+// the protocol is easier to spot.
+func newMasterHeaderError(packet []byte) error {
+	for _, known := range kKnownMasterReplies {
+		if bytes.HasPrefix(packet, known.prefix) {
+			return &MasterHeaderError{Format: known.format}
+		}
 	}
+	return &MasterHeaderError{Format: "unknown format"}
+}
+
+// Parse a single master response packet into the list of servers it contains,
+// in order. If the null terminator is present, done is true and anything after
+// it is treated as padding and ignored.
+func ParseMasterResponse(packet []byte) (servers ServerList, done bool, err error) {
+	return parseMasterResponse(packet, HeaderMasterResponse, false)
+}
 
-	// Sanity check the header.
-	if len(packet) < 6 || bytes.Compare(packet[0:6], kMasterResponseHeader) != 0 {
-		return ErrBadResponseHeader
+// Parse a response with the querier's expected format. This must be called
+// with the lock held.
+func (this *MasterServerQuerier) parseResponse(packet []byte) (ServerList, bool, error) {
+	return parseMasterResponse(this.skipPadding(packet), this.expectedHeader(), this.countPrefix)
+}
+
+func parseMasterResponse(packet []byte, header []byte, countPrefix bool) (servers ServerList, done bool, err error) {
+	// Sanity check the header. Every batch has one.
+	if len(packet) < len(header) || bytes.Compare(packet[0:len(header)], header) != 0 {
+		return nil, false, newMasterHeaderError(packet)
 	}
 
 	// Chop off the response header.
-	packet = packet[6:]
+	packet = packet[len(header):]
+
+	if countPrefix {
+		if len(packet) < 2 {
+			return nil, false, ErrOutOfBounds
+		}
+		count := int(binary.LittleEndian.Uint16(packet))
+		servers, done, err = parseMasterResponse(packet[2:], nil, false)
+		if err == nil && len(servers) != count {
+			return nil, false, fmt.Errorf("%w: expected %d, got %d", ErrServerCountMismatch, count, len(servers))
+		}
+		return servers, done, err
+	}
+
+	// Nothing after the header ends the list, as a terminator would, but a
+	// few bytes that can't be an address mean the reply is broken.
+	if len(packet) == 0 {
+		return ServerList{}, true, nil
+	}
+	if len(packet) < 6 {
+		return nil, false, ErrMalformedPacket
+	}
+
+	reader := NewPacketReader(packet)
+	serverCount := len(packet) / 6
+
+	// Allocate everything up front, since responses can hold hundreds of
+	// servers. Addresses and IPs are carved out of shared backing arrays.
+	servers = make(ServerList, 0, serverCount)
+	addrs := make([]net.TCPAddr, serverCount)
+	ips := make([]byte, serverCount*net.IPv4len)
+	for i := 0; i < serverCount; i++ {
+		ip := net.IP(ips[i*net.IPv4len : (i+1)*net.IPv4len : (i+1)*net.IPv4len])
+		copy(ip, reader.Slice(net.IPv4len))
+		port, err := reader.ReadPort()
+		if err != nil {
+			return nil, false, err
+		}
+
+		// The list is terminated with 0s.
+		if ip.Equal(kNullIP) && port == 0 {
+			return servers, true, nil
+		}
+
+		addr := &addrs[i]
+		addr.IP = ip
+		addr.Port = int(port)
+		servers = append(servers, addr)
+	}
+	return servers, false, nil
+}
+
+// Send a query and wait for the reply. Masters aren't known to do this yet,
+// but if one answers with an S2C_CHALLENGE like game servers do, the query is
+// sent again with the challenge appended, and the challenge is kept for later
+// queries. This must be called with the lock held.
+func (this *MasterServerQuerier) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		if err := this.cn.Send(append(query[:len(query):len(query)], this.challenge...)); err != nil {
+			return nil, err
+		}
+		sent := this.clock.Now()
+
+		packet, err := this.cn.RecvContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		this.lastRtt = this.clock.Now().Sub(sent)
+
+		if this.retainPackets {
+			this.rawPackets = append(this.rawPackets, packet)
+		}
+
+		challenge, ok := parseMasterChallenge(packet)
+		if !ok || attempt > 0 {
+			return packet, nil
+		}
+		this.challenge = challenge
+	}
+}
+
+// Check for a challenge reply: the simple packet header, S2C_CHALLENGE, and
+// four bytes of challenge.
+func parseMasterChallenge(packet []byte) ([]byte, bool) {
+	if len(packet) != 9 || int32(binary.LittleEndian.Uint32(packet)) != PacketHeaderSimple {
+		return nil, false
+	}
+	if packet[4] != S2C_CHALLENGE {
+		return nil, false
+	}
+	return append([]byte{}, packet[5:]...), true
+}
+
+func (this *MasterServerQuerier) tryQuery(ctx context.Context, region byte, callback MasterQueryCallback, filters []string) error {
+	seed := "0.0.0.0:0"
+	if this.startAddress != "" {
+		seed = this.startAddress
+	}
+
+	query := this.buildQuery(region, seed, filters)
+	this.countAttempt(false)
+	packet, err := this.exchange(ctx, query)
+	if err != nil {
+		return err
+	}
 
 	seen := map[string]bool{}
+	var highest *net.TCPAddr
 
-	done := false
-	ip := kNullIP
-	port := uint16(0)
-	for {
-		reader := NewPacketReader(packet)
-		serverCount := len(packet) / 6
+	for number := 0; ; number++ {
+		if this.batchTiming != nil {
+			this.batchTiming(number, this.lastRtt)
+		}
+		if this.filterString != nil {
+			this.filterString(number, masterFilterString(filters, this.andFilters))
+		}
 
-		if serverCount == 0 {
+		servers, done, err := this.parseResponse(packet)
+		if err != nil {
+			return withPacketDump(this.dumpPackets, err, packet)
+		}
+
+		// A batch holding only the terminator is a normal end of the list, and
+		// still goes to the callback. A batch with no servers at all isn't
+		// well-formed, but it ends the list too rather than failing the query.
+		if len(servers) == 0 && !done {
 			break
 		}
 
-		servers := ServerList{}
-		for i := 0; i < serverCount; i++ {
-			ip, err = reader.ReadIPv4()
-			if err != nil {
-				return err
-			}
-			port, err = reader.ReadPort()
-			if err != nil {
-				return err
+		batch := ServerList{}
+		pastEnd := false
+		for _, addr := range servers {
+			key := this.dedup.key(addr)
+			if _, found := seen[key]; found {
+				continue
 			}
 
-			// The list is terminated with 0s.
-			if ip.Equal(kNullIP) && port == 0 {
-				done = true
+			// Stop once past the end of our range. Out of order, the rest of
+			// the batch may still be in range.
+			if this.stopAddress != nil && compareAddrs(addr, this.stopAddress) > 0 {
+				pastEnd = true
+				if this.seedFromHighest {
+					continue
+				}
 				break
 			}
 
-			addr := &net.TCPAddr{
-				IP:   ip,
-				Port: int(port),
-			}
-			if _, found := seen[addr.String()]; found {
-				continue
-			}
-
-			servers = append(servers, addr)
-			seen[addr.String()] = true
+			batch = append(batch, addr)
+			seen[key] = true
+		}
+		if pastEnd {
+			done = true
 		}
 
-		if err := callback(servers); err != nil {
+		if err := callback(batch); err != nil {
 			return err
 		}
 
@@ -172,29 +1374,101 @@ func (this *MasterServerQuerier) tryQuery(callback MasterQueryCallback, filters
 			break
 		}
 
-		// Attempt to get the next batch 4 more times.
-		for i := 1; ; i++ {
-			address := fmt.Sprintf("%s:%d", ip.String(), port)
-			query := BuildMasterQuery(address, filters)
-			if err = this.cn.Send(query); err != nil {
-				return err
+		next := servers[len(servers)-1]
+		if this.seedFromHighest {
+			previous := highest
+			for _, addr := range servers {
+				if highest == nil || compareAddrs(addr, highest) > 0 {
+					highest = addr
+				}
 			}
+			if previous != nil && compareAddrs(highest, previous) <= 0 {
+				// Nothing past the last seed, so asking again would loop.
+				break
+			}
+			next = highest
+		}
+		if err := this.checkpoint(ctx, next.String(), len(batch)); err != nil {
+			return err
+		}
 
-			if packet, err = this.cn.Recv(); err == nil {
+		// Attempt to get the next batch 4 more times.
+		for i := 1; ; i++ {
+			query := this.buildQuery(region, next.String(), filters)
+			this.countAttempt(i > 1)
+			if packet, err = this.exchange(ctx, query); err == nil {
 				// Ok, keep going.
 				break
 			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == ErrPortClosed {
+				return err
+			}
 
 			// Maximum number of retries before we give up.
 			if i == 4 {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() && this.noTerminator {
+					return nil
+				}
 				return err
 			}
+
+			// If the lookup fails, keep trying the master we have.
+			if this.redial && i >= 2 {
+				this.redialMaster()
+			}
 		}
 	}
 
 	return nil
 }
 
+func (this *MasterServerQuerier) countAttempt(retry bool) {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+
+	this.stats.Attempts++
+	if retry {
+		this.stats.Retries++
+	}
+}
+
+// Returns how many batch requests have been sent over the querier's lifetime,
+// and how many of them were retries. This can be called while a query is
+// running.
+func (this *MasterServerQuerier) Stats() MasterStats {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+
+	stats := this.stats
+	if stats.Attempts > 0 {
+		stats.LossRatio = float64(stats.Retries) / float64(stats.Attempts)
+	}
+	return stats
+}
+
+// Returns the traffic counters of the socket used to query the master,
+// including any sockets it replaced after a redial or SelectFastestMaster.
+func (this *MasterServerQuerier) SocketStats() SocketStats {
+	this.cnLock.Lock()
+	defer this.cnLock.Unlock()
+
+	return this.retiredStats.add(this.cn.Stats())
+}
+
+// Returns the resolved address of the master server.
+func (this *MasterServerQuerier) RemoteAddr() net.Addr {
+	this.cnLock.Lock()
+	defer this.cnLock.Unlock()
+
+	return this.cn.RemoteAddr()
+}
+
 func (this *MasterServerQuerier) Close() {
+	this.cnLock.Lock()
+	defer this.cnLock.Unlock()
+
 	this.cn.Close()
 }
@@ -0,0 +1,2204 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A master query as seen by the mock master.
+type mockQuery struct {
+	region    byte
+	seed      string
+	filter    string
+	challenge []byte
+}
+
+// A fake master server on localhost. By default, each query is answered with
+// the batch that follows the seed address, and the last batch is terminated.
+type mockMaster struct {
+	conn    net.PacketConn
+	batches []ServerList
+
+	// Optional override for building replies. Returning nil sends nothing.
+	respond func(query *mockQuery) [][]byte
+
+	lock    sync.Mutex
+	queries []*mockQuery
+}
+
+func newMockMaster(t *testing.T, batches []ServerList) *mockMaster {
+	return newMockMasterOn(t, "127.0.0.1:0", batches)
+}
+
+// Same as newMockMaster, but listens on the given address. The test is
+// skipped if it can't be bound, since some systems only have 127.0.0.1.
+func newMockMasterOn(t *testing.T, address string, batches []ServerList) *mockMaster {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skipf("can't bind to %s: %v", address, err)
+	}
+
+	master := &mockMaster{
+		conn:    conn,
+		batches: batches,
+	}
+	go master.serve()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return master
+}
+
+func (this *mockMaster) Addr() string {
+	return this.conn.LocalAddr().String()
+}
+
+func (this *mockMaster) SetRespond(respond func(query *mockQuery) [][]byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.respond = respond
+}
+
+func (this *mockMaster) Queries() []*mockQuery {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]*mockQuery{}, this.queries...)
+}
+
+func (this *mockMaster) serve() {
+	buffer := make([]byte, kMaxPacketSize)
+	for {
+		n, addr, err := this.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		query, err := parseMockQuery(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		this.lock.Lock()
+		this.queries = append(this.queries, query)
+		respond := this.respond
+		this.lock.Unlock()
+
+		if respond == nil {
+			respond = this.batchReply
+		}
+		for _, reply := range respond(query) {
+			this.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+func (this *mockMaster) batchReply(query *mockQuery) [][]byte {
+	index := 0
+	if query.seed != "0.0.0.0:0" {
+		index = -1
+		for i, batch := range this.batches {
+			if len(batch) > 0 && batch[len(batch)-1].String() == query.seed {
+				index = i + 1
+				break
+			}
+		}
+	}
+	if index < 0 || index >= len(this.batches) {
+		return [][]byte{encodeMasterResponse(nil, true)}
+	}
+	return [][]byte{encodeMasterResponse(this.batches[index], index == len(this.batches)-1)}
+}
+
+func parseMockQuery(packet []byte) (query *mockQuery, err error) {
+	err = Try(func() error {
+		reader := NewPacketReader(packet)
+		if reader.ReadUint8() != A2M_GET_SERVERS_BATCH2 {
+			return fmt.Errorf("not a master query")
+		}
+		query = &mockQuery{}
+		query.region = reader.ReadUint8()
+		query.seed = reader.ReadString()
+		query.filter = reader.ReadString()
+		query.challenge = packet[reader.Pos():]
+		return nil
+	})
+	return query, err
+}
+
+// Encode a master response packet for a list of servers, optionally ending it
+// with the null terminator.
+func encodeMasterResponse(servers ServerList, terminate bool) []byte {
+	packet := PacketBuilder{}
+	packet.WriteBytes(HeaderMasterResponse)
+	for _, addr := range servers {
+		packet.WriteBytes(addr.IP.To4())
+		packet.WriteByte(byte(addr.Port >> 8))
+		packet.WriteByte(byte(addr.Port))
+	}
+	if terminate {
+		packet.WriteBytes([]byte{0, 0, 0, 0, 0, 0})
+	}
+	return packet.Bytes()
+}
+
+// Make a list of count servers, starting from 10.0.<block>.1:27015.
+func makeServerList(block, count int) ServerList {
+	servers := ServerList{}
+	for i := 0; i < count; i++ {
+		servers = append(servers, &net.TCPAddr{
+			IP:   net.IPv4(10, 0, byte(block), byte(i+1)).To4(),
+			Port: 27015,
+		})
+	}
+	return servers
+}
+
+func newTestMasterQuerier(t *testing.T, master *mockMaster) *MasterServerQuerier {
+	querier, err := NewMasterServerQuerier(master.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(querier.Close)
+
+	// Don't rate limit or wait minutes for a lost packet.
+	querier.cn.wait = 0
+	querier.cn.SetTimeout(time.Second)
+	querier.FilterAppIds([]AppId{App_TF2})
+	return querier
+}
+
+func TestConcurrentQueryContext(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 3), makeServerList(2, 3)})
+	querier := newTestMasterQuerier(t, master)
+
+	var wg sync.WaitGroup
+	counts := make([]int, 2)
+	errs := make([]error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go (func(i int) {
+			defer wg.Done()
+			errs[i] = querier.QueryContext(context.Background(), func(batch ServerList) error {
+				counts[i] += len(batch)
+				return nil
+			})
+		})(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 2; i++ {
+		if errs[i] != nil {
+			t.Errorf("query %d failed: %v", i, errs[i])
+		}
+		if counts[i] != 6 {
+			t.Errorf("query %d: expected 6 servers, got %d", i, counts[i])
+		}
+	}
+}
+
+func TestParseMasterResponseTrailingGarbage(t *testing.T) {
+	packet := encodeMasterResponse(makeServerList(1, 2), true)
+	packet = append(packet, 0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03)
+
+	servers, done, err := ParseMasterResponse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		t.Errorf("expected the terminator to be found")
+	}
+	if len(servers) != 2 {
+		t.Errorf("expected 2 servers, got %d", len(servers))
+	}
+
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		return [][]byte{packet}
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	count := 0
+	err = querier.Query(func(batch ServerList) error {
+		count += len(batch)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 servers, got %d", count)
+	}
+	if len(master.Queries()) != 1 {
+		t.Errorf("expected the scan to end after one query, got %d", len(master.Queries()))
+	}
+}
+
+func TestParseMasterResponseShortRemainder(t *testing.T) {
+	// Just the header ends the list.
+	servers, done, err := ParseMasterResponse(append([]byte{}, HeaderMasterResponse...))
+	if err != nil || !done || len(servers) != 0 {
+		t.Errorf("expected an empty, finished list, got %v, %v, %v", servers, done, err)
+	}
+
+	// Three bytes can't be an address.
+	packet := append(append([]byte{}, HeaderMasterResponse...), 10, 0, 1)
+	if _, _, err := ParseMasterResponse(packet); err != ErrMalformedPacket {
+		t.Errorf("expected ErrMalformedPacket, got %v", err)
+	}
+}
+
+// A resolver that maps every host to localhost and counts lookups.
+type stubResolver struct {
+	lock    sync.Mutex
+	lookups int
+}
+
+func (this *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.lookups++
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func TestMasterResolvesOnce(t *testing.T) {
+	resolver := &stubResolver{}
+	SetResolver(resolver)
+	t.Cleanup(func() {
+		SetResolver(net.DefaultResolver)
+	})
+
+	master := newMockMaster(t, []ServerList{makeServerList(1, 2), makeServerList(2, 2), makeServerList(3, 2)})
+	_, port, _ := net.SplitHostPort(master.Addr())
+
+	for i := 0; i < 2; i++ {
+		querier, err := NewMasterServerQuerier("master.test:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer querier.Close()
+		querier.cn.wait = 0
+		querier.FilterAppIds([]AppId{App_TF2})
+
+		if ip := querier.RemoteAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("expected master to resolve to localhost, got %s", ip)
+		}
+
+		count := 0
+		err = querier.Query(func(batch ServerList) error {
+			count += len(batch)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 6 {
+			t.Errorf("expected 6 servers, got %d", count)
+		}
+	}
+
+	if resolver.lookups != 1 {
+		t.Errorf("expected one DNS lookup, got %d", resolver.lookups)
+	}
+}
+
+// A resolver that blocks lookups of "slow.test" until released.
+type blockingResolver struct {
+	release chan struct{}
+}
+
+func (this *blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host == "slow.test" {
+		select {
+		case <-this.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func TestSlowLookupDoesNotBlockOthers(t *testing.T) {
+	resolver := &blockingResolver{release: make(chan struct{})}
+	cache := newDnsCache(resolver, time.Minute)
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := cache.lookup("slow.test")
+		slow <- err
+	}()
+
+	fast := make(chan error, 1)
+	go func() {
+		_, err := cache.lookup("fast.test")
+		fast <- err
+	}()
+
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("lookup of one host was blocked by a slow lookup of another")
+	}
+
+	close(resolver.release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookupTimesOut(t *testing.T) {
+	resolver := &blockingResolver{release: make(chan struct{})}
+	defer close(resolver.release)
+
+	cache := newDnsCache(resolver, time.Minute)
+	cache.timeout = time.Millisecond * 10
+
+	if _, err := cache.lookup("slow.test"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the lookup to time out, got %v", err)
+	}
+}
+
+func BenchmarkParseMasterResponse(b *testing.B) {
+	packet := encodeMasterResponse(makeServerList(1, 230), true)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseMasterResponse(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseMasterResponseAllocs(t *testing.T) {
+	packet := encodeMasterResponse(makeServerList(1, 230), true)
+
+	// Allocations must not grow with the number of servers.
+	allocs := testing.AllocsPerRun(100, func() {
+		ParseMasterResponse(packet)
+	})
+	if allocs > 5 {
+		t.Errorf("expected at most 5 allocations, got %v", allocs)
+	}
+}
+
+func TestParseFilterString(t *testing.T) {
+	tokens, err := ParseFilterString("\\appid\\440\\empty\\1\\map\\cp_dustbowl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"\\appid\\440", "\\empty\\1", "\\map\\cp_dustbowl"}
+	if fmt.Sprint(tokens) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, tokens)
+	}
+
+	tokens, err = ParseFilterString("\\appid\\440\\")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0] != "\\appid\\440" {
+		t.Errorf("expected trailing backslash to be ignored, got %v", tokens)
+	}
+
+	for _, filter := range []string{"appid\\440", "\\appid\\440\\empty", "\\\\440"} {
+		if _, err := ParseFilterString(filter); err != ErrMalformedFilter {
+			t.Errorf("expected %q to be malformed, got %v", filter, err)
+		}
+	}
+
+	querier := &MasterServerQuerier{}
+	if err := querier.SetFilterString("\\appid\\440\\empty\\1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(querier.filters) != 1 || querier.filters[0] != "\\appid\\440\\empty\\1" {
+		t.Errorf("unexpected filters: %v", querier.filters)
+	}
+}
+
+func TestQueryBatch(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 3), makeServerList(2, 2)})
+	querier := newTestMasterQuerier(t, master)
+
+	servers, seed, done, err := querier.QueryBatch(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 || done || seed != "10.0.1.3:27015" {
+		t.Fatalf("unexpected first batch: %v, %q, %v", servers, seed, done)
+	}
+
+	servers, seed, done, err = querier.QueryBatch(context.Background(), seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || !done || seed != "" {
+		t.Fatalf("unexpected second batch: %v, %q, %v", servers, seed, done)
+	}
+	if servers[0].String() != "10.0.2.1:27015" {
+		t.Errorf("expected second batch to start at 10.0.2.1:27015, got %s", servers[0])
+	}
+
+	// Filters with several conditions can't be combined into one query.
+	querier.ClearFilters()
+	for _, filter := range []string{"\\appid\\440\\empty\\1", "\\appid\\550\\full\\1"} {
+		if err := querier.AddRawFilter(filter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := len(master.Queries())
+	if _, _, _, err := querier.QueryBatch(context.Background(), ""); err != ErrTooManyFilters {
+		t.Errorf("expected ErrTooManyFilters, got %v", err)
+	}
+	if queries := len(master.Queries()); queries != before {
+		t.Errorf("expected nothing to be sent, got %d more queries", queries-before)
+	}
+}
+
+func TestNormalizeFilterKeys(t *testing.T) {
+	querier := &MasterServerQuerier{}
+	if err := querier.AddRawFilter("\\AppId\\440"); err != nil {
+		t.Fatal(err)
+	}
+	if err := querier.AddRawFilter("\\APPID\\550\\Name_Match\\FooBar"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"\\appid\\440", "\\appid\\550\\name_match\\FooBar"}
+	if fmt.Sprint(querier.filters) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, querier.filters)
+	}
+
+	if err := querier.SetFilterString("\\Map\\CP_Dustbowl"); err != nil {
+		t.Fatal(err)
+	}
+	if len(querier.filters) != 1 || querier.filters[0] != "\\map\\CP_Dustbowl" {
+		t.Errorf("unexpected filters: %v", querier.filters)
+	}
+}
+
+// A clock that only moves when something sleeps.
+type fakeClock struct {
+	lock  sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (this *fakeClock) Now() time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.now
+}
+
+func (this *fakeClock) Sleep(d time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.now = this.now.Add(d)
+	this.slept += d
+}
+
+func (this *fakeClock) SleepContext(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	this.Sleep(d)
+	return nil
+}
+
+func (this *fakeClock) Slept() time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.slept
+}
+
+func TestRateLimitWithFakeClock(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 2), makeServerList(2, 2), makeServerList(3, 2)})
+	querier := newTestMasterQuerier(t, master)
+
+	clock := newFakeClock()
+	querier.setClock(clock)
+	querier.cn.SetRateLimit(15)
+
+	start := time.Now()
+	err := querier.Query(func(batch ServerList) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three queries means two waits between them.
+	if clock.Slept() != querier.cn.wait*2 {
+		t.Errorf("expected to sleep %v, slept %v", querier.cn.wait*2, clock.Slept())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected no real delay, took %v", elapsed)
+	}
+}
+
+type memoryStore struct {
+	calls   int
+	servers ServerList
+}
+
+func (this *memoryStore) StoreBatch(ctx context.Context, servers ServerList) error {
+	this.calls++
+	this.servers = append(this.servers, servers...)
+	return nil
+}
+
+func TestQueryToStore(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3), makeServerList(3, 3), makeServerList(4, 1)}
+
+	// Without coalescing, every master batch is one store call.
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+	store := &memoryStore{}
+	if err := querier.QueryToStore(context.Background(), store, 0); err != nil {
+		t.Fatal(err)
+	}
+	if store.calls != 4 || len(store.servers) != 10 {
+		t.Errorf("expected 4 calls storing 10 servers, got %d calls storing %d", store.calls, len(store.servers))
+	}
+
+	// With coalescing, there are fewer, bigger calls.
+	store = &memoryStore{}
+	if err := querier.QueryToStore(context.Background(), store, 5); err != nil {
+		t.Fatal(err)
+	}
+	if store.calls != 2 || len(store.servers) != 10 {
+		t.Errorf("expected 2 calls storing 10 servers, got %d calls storing %d", store.calls, len(store.servers))
+	}
+
+	seen := map[string]bool{}
+	for _, addr := range store.servers {
+		seen[addr.String()] = true
+	}
+	if len(seen) != 10 {
+		t.Errorf("expected 10 distinct servers, got %d", len(seen))
+	}
+}
+
+func TestPing(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 3)})
+	querier := newTestMasterQuerier(t, master)
+	if err := querier.Ping(context.Background()); err != nil {
+		t.Errorf("expected ping to succeed, got %v", err)
+	}
+
+	silent := newMockMaster(t, nil)
+	silent.SetRespond(func(query *mockQuery) [][]byte {
+		return nil
+	})
+	querier = newTestMasterQuerier(t, silent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	start := time.Now()
+	if err := querier.Ping(ctx); err == nil {
+		t.Errorf("expected ping to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("expected ping to give up quickly, took %v", elapsed)
+	}
+}
+
+func TestQueryAllRegionsWithHosts(t *testing.T) {
+	// The default master returns the same servers for every region.
+	defaultMaster := newMockMaster(t, []ServerList{makeServerList(1, 2)})
+	east := newMockMaster(t, []ServerList{makeServerList(2, 3)})
+	west := newMockMaster(t, []ServerList{makeServerList(3, 1), makeServerList(4, 1)})
+	querier := newTestMasterQuerier(t, defaultMaster)
+
+	hosts := map[byte]string{
+		RegionUSEast: east.Addr(),
+		RegionUSWest: west.Addr(),
+	}
+
+	servers := ServerList{}
+	err := querier.QueryAllRegions(context.Background(), hosts, func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers) != 7 {
+		t.Errorf("expected 7 merged servers, got %d: %v", len(servers), servers)
+	}
+	if queries := east.Queries(); len(queries) != 1 || queries[0].region != RegionUSEast {
+		t.Errorf("expected one US East query on its master, got %v", queries)
+	}
+	if queries := west.Queries(); len(queries) != 2 || queries[0].region != RegionUSWest {
+		t.Errorf("expected two US West queries on its master, got %v", queries)
+	}
+	if queries := defaultMaster.Queries(); len(queries) != len(Regions)-2 {
+		t.Errorf("expected the default master to get the other regions, got %d queries", len(queries))
+	}
+}
+
+func TestQueryRegionsWithRequery(t *testing.T) {
+	// Europe has 10 servers, but the master stops each query after 4. Every
+	// other region has the same 2 servers.
+	europe := makeServerList(5, 10)
+	others := makeServerList(1, 2)
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		if query.region != RegionEurope {
+			return [][]byte{encodeMasterResponse(others, true)}
+		}
+		start := 0
+		for i, addr := range europe {
+			if addr.String() == query.seed {
+				start = i + 1
+			}
+		}
+		end := start + 4
+		if end > len(europe) {
+			end = len(europe)
+		}
+		return [][]byte{encodeMasterResponse(europe[start:end], true)}
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	servers := ServerList{}
+	err := querier.QueryRegionsWithRequery(context.Background(), 4, func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers) != 12 {
+		t.Errorf("expected all 12 servers, got %d: %v", len(servers), servers)
+	}
+	europeQueries := 0
+	for _, query := range master.Queries() {
+		if query.region == RegionEurope {
+			europeQueries++
+		}
+	}
+	if total := len(master.Queries()); europeQueries != 3 || total != len(Regions)+2 {
+		t.Errorf("expected Europe to be queried 3 times, got %d of %d", europeQueries, total)
+	}
+
+	// The first three regions send 24 bytes each and Europe sends 36, so the
+	// budget runs out on Europe's first query.
+	querier = newTestMasterQuerier(t, master)
+	querier.SetMaxReceivedBytes(100)
+	before := len(master.Queries())
+	err = querier.QueryRegionsWithRequery(context.Background(), 4, func(ServerList) error { return nil })
+	if err != ErrByteBudgetExceeded {
+		t.Fatalf("expected ErrByteBudgetExceeded, got %v", err)
+	}
+	if queries := len(master.Queries()) - before; queries != 4 {
+		t.Errorf("expected 4 queries within the budget, got %d", queries)
+	}
+}
+
+func TestQueryAllRegionsBestEffort(t *testing.T) {
+	defaultMaster := newMockMaster(t, nil)
+	east := newMockMaster(t, []ServerList{makeServerList(2, 3)})
+	broken := newMockMaster(t, nil)
+	broken.SetRespond(func(query *mockQuery) [][]byte {
+		return [][]byte{[]byte("garbage")}
+	})
+	south := newMockMaster(t, []ServerList{makeServerList(3, 2)})
+
+	hosts := map[byte]string{
+		RegionUSEast:       east.Addr(),
+		RegionUSWest:       broken.Addr(),
+		RegionSouthAmerica: south.Addr(),
+	}
+	query := func(querier *MasterServerQuerier) (int, error) {
+		var lock sync.Mutex
+		count := 0
+		err := querier.QueryAllRegions(context.Background(), hosts, func(batch ServerList) error {
+			lock.Lock()
+			defer lock.Unlock()
+			count += len(batch)
+			return nil
+		})
+		return count, err
+	}
+
+	// By default, the broken region fails the whole query.
+	querier := newTestMasterQuerier(t, defaultMaster)
+	if _, err := query(querier); !errors.Is(err, ErrBadResponseHeader) {
+		t.Errorf("expected ErrBadResponseHeader, got %v", err)
+	}
+
+	querier.SetBestEffortRegions(true)
+	count, err := query(querier)
+	errs, ok := err.(RegionErrors)
+	if !ok {
+		t.Fatalf("expected RegionErrors, got %v", err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[RegionUSWest], ErrBadResponseHeader) {
+		t.Errorf("expected only US West to fail, got %v", errs)
+	}
+	if count != 5 {
+		t.Errorf("expected 5 servers from the working regions, got %d", count)
+	}
+
+	// Cancellation is still reported as such.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := querier.QueryAllRegions(ctx, hosts, func(ServerList) error { return nil }); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestEmptyValueFilters(t *testing.T) {
+	tokens, err := ParseFilterString("\\hostname\\\\proxy\\1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0] != "\\hostname\\" || tokens[1] != "\\proxy\\1" {
+		t.Errorf("unexpected tokens: %q", tokens)
+	}
+
+	master := newMockMaster(t, []ServerList{makeServerList(1, 1)})
+	querier := newTestMasterQuerier(t, master)
+	querier.ClearFilters()
+	querier.FilterAppIds([]AppId{App_TF2})
+	if err := querier.AddRawFilter("\\proxy\\1\\hostname\\"); err != nil {
+		t.Fatal(err)
+	}
+	if err := querier.Query(func(ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := master.Queries()
+	if len(queries) != 2 {
+		t.Fatalf("expected one query per filter, got %d", len(queries))
+	}
+	if queries[0].filter != "\\appid\\440" || queries[1].filter != "\\proxy\\1\\hostname\\" {
+		t.Errorf("unexpected filters: %q, %q", queries[0].filter, queries[1].filter)
+	}
+
+	expected := append([]byte{A2M_GET_SERVERS_BATCH2, RegionAll}, []byte("0.0.0.0:0\x00\\proxy\\1\\hostname\\\x00")...)
+	if packet := BuildMasterQuery("0.0.0.0:0", []string{"\\proxy\\1\\hostname\\"}); !bytes.Equal(packet, expected) {
+		t.Errorf("expected packet %q, got %q", expected, packet)
+	}
+}
+
+func TestDumpPackets(t *testing.T) {
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		return [][]byte{[]byte("garbage reply")}
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	err := querier.Query(func(ServerList) error { return nil })
+	if _, ok := err.(*MasterHeaderError); !ok {
+		t.Errorf("expected a plain MasterHeaderError, got %v", err)
+	}
+
+	querier.SetDumpPackets(true)
+	err = querier.Query(func(ServerList) error { return nil })
+	if !errors.Is(err, ErrBadResponseHeader) {
+		t.Fatalf("expected ErrBadResponseHeader, got %v", err)
+	}
+	if _, ok := err.(*PacketError); !ok {
+		t.Errorf("expected a PacketError, got %T", err)
+	}
+	if !strings.Contains(err.Error(), "67 61 72 62 61 67 65") || !strings.Contains(err.Error(), "|garbage reply|") {
+		t.Errorf("expected a hex dump of the reply, got %q", err.Error())
+	}
+}
+
+func TestOptimizeBatching(t *testing.T) {
+	// Single-condition filters of the given total lengths.
+	makeFilter := func(length int) string {
+		return "\\gametype\\" + strings.Repeat("x", length-len("\\gametype\\"))
+	}
+	filters := []string{makeFilter(80), makeFilter(120), makeFilter(40), makeFilter(40)}
+
+	query := func(optimize bool, andFilter string) []*mockQuery {
+		master := newMockMaster(t, []ServerList{makeServerList(1, 1)})
+		querier := newTestMasterQuerier(t, master)
+		querier.ClearFilters()
+		for _, filter := range filters {
+			if err := querier.AddRawFilter(filter); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if andFilter != "" {
+			if err := querier.AddAndFilter(andFilter); err != nil {
+				t.Fatal(err)
+			}
+		}
+		querier.SetOptimizeBatching(optimize)
+		if err := querier.Query(func(ServerList) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		return master.Queries()
+	}
+
+	queries := query(false, "")
+	if len(queries) != len(filters) {
+		t.Fatalf("expected %d queries in list order, got %d", len(filters), len(queries))
+	}
+	for i, query := range queries {
+		if query.filter != filters[i] {
+			t.Errorf("query %d: expected %q, got %q", i, filters[i], query.filter)
+		}
+	}
+
+	queries = query(true, "")
+	if len(queries) != 2 {
+		t.Fatalf("expected 2 queries when optimized, got %d", len(queries))
+	}
+	expected := "\\or\\3" + filters[2] + filters[3] + filters[0]
+	if queries[0].filter != expected || queries[1].filter != filters[1] {
+		t.Errorf("unexpected filters: %q, %q", queries[0].filter, queries[1].filter)
+	}
+
+	// A top-level filter goes out with every query, so it takes up room. The
+	// first query was 165 bytes, and this filter adds 30.
+	andFilter := "\\map\\" + strings.Repeat("x", 25)
+	queries = query(true, andFilter)
+	if len(queries) != 3 {
+		t.Fatalf("expected 3 queries with a top-level filter, got %d", len(queries))
+	}
+	for i, query := range queries {
+		if len(query.filter) > kMaxFilterLength || !strings.HasSuffix(query.filter, andFilter) {
+			t.Errorf("query %d: expected at most %d bytes ending in the top-level filter, got %q", i, kMaxFilterLength, query.filter)
+		}
+	}
+	if expected := "\\or\\2" + filters[2] + filters[3] + andFilter; queries[0].filter != expected {
+		t.Errorf("expected %q, got %q", expected, queries[0].filter)
+	}
+
+	// Filters with several conditions can't be combined with others.
+	many, rest := computeNextFilterList([]string{"\\appid\\440\\empty\\1", "\\appid\\550"}, 0)
+	if len(many) != 1 || len(rest) != 1 {
+		t.Errorf("expected a multi-condition filter to be sent alone, got %q", many)
+	}
+}
+
+func TestMissingTerminator(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 2)}
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		// Serve both batches without a terminator, then go silent.
+		if query.seed == "0.0.0.0:0" {
+			return [][]byte{encodeMasterResponse(batches[0], false)}
+		}
+		if query.seed == batches[0][2].String() {
+			return [][]byte{encodeMasterResponse(batches[1], false)}
+		}
+		return nil
+	})
+	querier := newTestMasterQuerier(t, master)
+	querier.cn.SetTimeout(time.Millisecond * 20)
+
+	count := 0
+	callback := func(batch ServerList) error {
+		count += len(batch)
+		return nil
+	}
+	if err := querier.Query(callback); err == nil {
+		t.Errorf("expected a timeout without the terminator")
+	}
+
+	querier.SetAllowMissingTerminator(true)
+	count = 0
+	if err := querier.Query(callback); err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("expected 5 servers, got %d", count)
+	}
+}
+
+func TestMasterStats(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3)}
+	master := newMockMaster(t, batches)
+
+	// Drop the first two requests for the second batch.
+	var lock sync.Mutex
+	dropped := 0
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		lock.Lock()
+		defer lock.Unlock()
+		if query.seed != "0.0.0.0:0" && dropped < 2 {
+			dropped++
+			return nil
+		}
+		return master.batchReply(query)
+	})
+	querier := newTestMasterQuerier(t, master)
+	querier.cn.SetTimeout(time.Millisecond * 20)
+
+	if stats := querier.Stats(); stats != (MasterStats{}) {
+		t.Errorf("expected no stats before a query, got %+v", stats)
+	}
+	if err := querier.Query(func(ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := MasterStats{Attempts: 4, Retries: 2, LossRatio: 0.5}
+	if stats := querier.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestMasterTimeout(t *testing.T) {
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		return nil
+	})
+	querier := newTestMasterQuerier(t, master)
+	querier.SetTimeout(time.Millisecond * 50)
+
+	start := time.Now()
+	err := querier.Query(func(ServerList) error { return nil })
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("expected the query to fail quickly, took %s", elapsed)
+	}
+}
+
+// A canned server list, standing in for a master.
+type fakeMasterQuerier struct {
+	servers ServerList
+}
+
+func (this *fakeMasterQuerier) Query(callback MasterQueryCallback) error {
+	return this.QueryContext(context.Background(), callback)
+}
+
+func (this *fakeMasterQuerier) QueryContext(ctx context.Context, callback MasterQueryCallback) error {
+	return callback(this.servers)
+}
+
+func TestMasterQuerierInterface(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 2)})
+	fake := &fakeMasterQuerier{servers: makeServerList(2, 3)}
+
+	queriers := []MasterQuerier{
+		newTestMasterQuerier(t, master),
+		NewWebMasterQuerier(""),
+		fake,
+	}
+
+	// Callers only need the interface.
+	count := func(querier MasterQuerier) int {
+		total := 0
+		err := querier.Query(func(batch ServerList) error {
+			total += len(batch)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+	if n := count(queriers[0]); n != 2 {
+		t.Errorf("expected 2 servers from the UDP master, got %d", n)
+	}
+	if n := count(queriers[2]); n != 3 {
+		t.Errorf("expected 3 servers from the fake, got %d", n)
+	}
+}
+
+func TestMaxServers(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3), makeServerList(3, 3)}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+	querier.SetMaxServers(4)
+
+	servers := ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 4 || servers[3].String() != "10.0.2.1:27015" {
+		t.Errorf("expected exactly the first 4 servers, got %v", servers)
+	}
+	if len(master.Queries()) != 2 {
+		t.Errorf("expected the query to stop at the limit, got %d queries", len(master.Queries()))
+	}
+
+	// Servers still pending in the store are flushed when the limit ends the
+	// query early.
+	store := &memoryStore{}
+	if err := querier.QueryToStore(context.Background(), store, 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.servers) != 4 || store.calls != 1 {
+		t.Errorf("expected one store call with 4 servers, got %d calls with %d", store.calls, len(store.servers))
+	}
+}
+
+func TestMaxBatches(t *testing.T) {
+	batches := []ServerList{}
+	for i := 1; i <= 5; i++ {
+		batches = append(batches, makeServerList(i, 3))
+	}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+	querier.SetMaxBatches(2)
+
+	delivered := []ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		delivered = append(delivered, batch)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 2 || delivered[1][2].String() != batches[1][2].String() {
+		t.Errorf("expected the first 2 batches, got %v", delivered)
+	}
+	if len(master.Queries()) != 2 {
+		t.Errorf("expected the query to stop at the limit, got %d queries", len(master.Queries()))
+	}
+}
+
+func TestScanRetries(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3)}
+	master := newMockMaster(t, batches)
+
+	// The first request for the second batch gets a stray packet.
+	var lock sync.Mutex
+	garbled := false
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		lock.Lock()
+		defer lock.Unlock()
+		if query.seed != "0.0.0.0:0" && !garbled {
+			garbled = true
+			return [][]byte{{0xde, 0xad, 0xbe, 0xef, 0x00, 0x00}}
+		}
+		return master.batchReply(query)
+	})
+	querier := newTestMasterQuerier(t, master)
+	clock := newFakeClock()
+	querier.setClock(clock)
+	querier.SetScanRetries(2, time.Second)
+
+	servers := ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 6 {
+		t.Errorf("expected each server once, got %v", servers)
+	}
+	if queries := len(master.Queries()); queries != 4 {
+		t.Errorf("expected the scan to start over, got %d queries", queries)
+	}
+	if slept := clock.Slept(); slept != time.Second {
+		t.Errorf("expected one backoff of a second, got %v", slept)
+	}
+
+	// Without retries, the stray packet fails the query.
+	lock.Lock()
+	garbled = false
+	lock.Unlock()
+	querier.SetScanRetries(0, 0)
+	if err := querier.Query(func(ServerList) error { return nil }); !errors.Is(err, ErrBadResponseHeader) {
+		t.Errorf("expected ErrBadResponseHeader, got %v", err)
+	}
+
+	// The backoff stops when the query runs out of time.
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		return [][]byte{{0xde, 0xad, 0xbe, 0xef, 0x00, 0x00}}
+	})
+	querier.setClock(realClock{})
+	querier.SetScanRetries(1, time.Hour)
+	querier.SetMaxDuration(time.Millisecond * 100)
+	querier.SetMaxDurationError(true)
+	start := time.Now()
+	if err := querier.Query(func(ServerList) error { return nil }); err != ErrMaxDurationExceeded {
+		t.Errorf("expected ErrMaxDurationExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the backoff to stop at the deadline, took %v", elapsed)
+	}
+}
+
+func TestSeedFromHighestAddress(t *testing.T) {
+	servers := makeServerList(1, 9)
+
+	// Serve the three servers after the seed, highest first.
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		seed, err := net.ResolveTCPAddr("tcp", query.seed)
+		if err != nil {
+			return nil
+		}
+		batch := ServerList{}
+		for _, addr := range servers {
+			if compareAddrs(addr, seed) > 0 && len(batch) < 3 {
+				batch = append(ServerList{addr}, batch...)
+			}
+		}
+		last := batch[0].String() == servers[len(servers)-1].String()
+		return [][]byte{encodeMasterResponse(batch, last)}
+	})
+	querier := newTestMasterQuerier(t, master)
+	querier.SetSeedFromHighestAddress(true)
+
+	received := map[string]bool{}
+	err := querier.Query(func(batch ServerList) error {
+		for _, addr := range batch {
+			received[addr.String()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != len(servers) {
+		t.Errorf("expected all %d servers, got %d", len(servers), len(received))
+	}
+	queries := master.Queries()
+	if len(queries) != 3 || queries[1].seed != servers[2].String() || queries[2].seed != servers[5].String() {
+		t.Errorf("expected each batch's highest address as the next seed, got %d queries", len(queries))
+	}
+
+	// A master that never gets past the seed ends the query instead of looping.
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		return [][]byte{encodeMasterResponse(ServerList{servers[2], servers[0], servers[1]}, false)}
+	})
+	before := len(master.Queries())
+	if err := querier.Query(func(ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if queries := len(master.Queries()) - before; queries != 2 {
+		t.Errorf("expected the query to stop once it stalled, got %d queries", queries)
+	}
+}
+
+func TestDeduplicateMode(t *testing.T) {
+	servers := ServerList{
+		{IP: net.IPv4(10, 0, 1, 1).To4(), Port: 27015},
+		{IP: net.IPv4(10, 0, 1, 1).To4(), Port: 27016},
+		{IP: net.IPv4(10, 0, 1, 2).To4(), Port: 27015},
+	}
+	master := newMockMaster(t, []ServerList{servers})
+	querier := newTestMasterQuerier(t, master)
+
+	count := func() int {
+		received := ServerList{}
+		if err := querier.Query(func(batch ServerList) error {
+			received = append(received, batch...)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return len(received)
+	}
+	if n := count(); n != 3 {
+		t.Errorf("expected each port to be kept by default, got %d servers", n)
+	}
+	querier.SetDeduplicate(DedupByIP)
+	if n := count(); n != 2 {
+		t.Errorf("expected one server per IP, got %d servers", n)
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	batches := []ServerList{}
+	for i := 1; i <= 20; i++ {
+		batches = append(batches, makeServerList(i, 2))
+	}
+	master := newMockMaster(t, batches)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		time.Sleep(time.Millisecond * 50)
+		return master.batchReply(query)
+	})
+	querier := newTestMasterQuerier(t, master)
+	querier.SetMaxDuration(time.Millisecond * 175)
+
+	count := 0
+	callback := func(batch ServerList) error {
+		count += len(batch)
+		return nil
+	}
+
+	start := time.Now()
+	if err := querier.Query(callback); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("expected the query to stop near the cap, took %s", elapsed)
+	}
+	if count == 0 || count >= 40 {
+		t.Errorf("expected some but not all servers, got %d", count)
+	}
+
+	querier.SetMaxDurationError(true)
+	if err := querier.Query(callback); err != ErrMaxDurationExceeded {
+		t.Errorf("expected ErrMaxDurationExceeded, got %v", err)
+	}
+}
+
+func TestFilterNotAppId(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 1)})
+	querier := newTestMasterQuerier(t, master)
+	querier.ClearFilters()
+	querier.SetOptimizeBatching(true)
+	querier.FilterNotAppId(App_TF2)
+	if err := querier.Query(func(ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	querier.FilterAppIds([]AppId{App_CSS, App_CSGO})
+	if err := querier.Query(func(ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := master.Queries()
+	if len(queries) != 2 {
+		t.Fatalf("expected 2 queries, got %d", len(queries))
+	}
+	if queries[0].filter != "\\napp\\440" {
+		t.Errorf("unexpected filter: %q", queries[0].filter)
+	}
+	if expected := "\\or\\2\\appid\\240\\appid\\730\\napp\\440"; queries[1].filter != expected {
+		t.Errorf("expected filter %q, got %q", expected, queries[1].filter)
+	}
+}
+
+func TestFilterCollapseAddrHash(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 1)})
+	querier := newTestMasterQuerier(t, master)
+	querier.ClearFilters()
+	querier.SetOptimizeBatching(true)
+	querier.FilterAppIds([]AppId{App_CSS, App_CSGO})
+	querier.FilterCollapseAddrHash()
+	querier.FilterCollapseAddrHash()
+	if err := querier.Query(func(ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := parseMockQuery(querier.buildQuery(RegionAll, "0.0.0.0:0", querier.filters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "\\or\\2\\appid\\240\\appid\\730\\collapse_addr_hash\\1"
+	if built.filter != expected {
+		t.Errorf("expected filter %q, got %q", expected, built.filter)
+	}
+	if queries := master.Queries(); queries[0].filter != expected {
+		t.Errorf("expected the master to see %q, got %q", expected, queries[0].filter)
+	}
+}
+
+func TestAddAndFilter(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 1)})
+	querier := newTestMasterQuerier(t, master)
+	querier.SetOptimizeBatching(true)
+	if err := querier.AddAndFilter("\\Map\\cp_dustbowl"); err != nil {
+		t.Fatal(err)
+	}
+	if err := querier.AddAndFilter("map"); err != ErrMalformedFilter {
+		t.Errorf("expected ErrMalformedFilter, got %v", err)
+	}
+	query := func() string {
+		if err := querier.Query(func(ServerList) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		queries := master.Queries()
+		return queries[len(queries)-1].filter
+	}
+
+	// Both conditions are top-level, so the master ANDs them.
+	if filter := query(); filter != "\\appid\\440\\map\\cp_dustbowl" {
+		t.Errorf("expected the map to be ANDed with the app id, got %q", filter)
+	}
+
+	// With alternatives, the map applies to all of them.
+	querier.FilterAppIds([]AppId{App_CSS})
+	if filter := query(); filter != "\\or\\2\\appid\\440\\appid\\240\\map\\cp_dustbowl" {
+		t.Errorf("expected the map outside the \\or\\ block, got %q", filter)
+	}
+}
+
+func TestStartAddress(t *testing.T) {
+	batches := []ServerList{
+		makeServerList(1, 3),
+		makeServerList(2, 3),
+		makeServerList(3, 3),
+	}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+	querier.ClearFilters()
+
+	if err := querier.SetStartAddress("not an address"); err != ErrBadStartAddress {
+		t.Errorf("expected ErrBadStartAddress, got %v", err)
+	}
+	if err := querier.SetStartAddress(batches[0][2].String()); err != nil {
+		t.Fatal(err)
+	}
+
+	var servers ServerList
+	err := querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(append(ServerList{}, batches[1]...), batches[2]...)
+	if len(servers) != len(expected) {
+		t.Fatalf("expected %d servers, got %d", len(expected), len(servers))
+	}
+	for i := range expected {
+		if servers[i].String() != expected[i].String() {
+			t.Errorf("server %d: expected %s, got %s", i, expected[i], servers[i])
+		}
+	}
+	if queries := master.Queries(); queries[0].seed != batches[0][2].String() {
+		t.Errorf("unexpected first seed: %s", queries[0].seed)
+	}
+}
+
+func TestMasterQuerySize(t *testing.T) {
+	cases := [][]string{
+		nil,
+		{"\\appid\\440"},
+		{"\\appid\\440", "\\appid\\730", "\\map\\cp_dustbowl\\empty\\1"},
+	}
+	for _, filters := range cases {
+		for _, seed := range []string{"0.0.0.0:0", "192.168.100.200:27015"} {
+			expected := len(BuildMasterQuery(seed, filters))
+			if size := MasterQuerySize(seed, filters); size != expected {
+				t.Errorf("%s %q: expected %d bytes, got %d", seed, filters, expected, size)
+			}
+		}
+	}
+}
+
+func TestMasterChallenge(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3)}
+	master := newMockMaster(t, batches)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		if !bytes.Equal(query.challenge, kTestChallenge) {
+			return [][]byte{encodeChallenge()}
+		}
+		return master.batchReply(query)
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	count := 0
+	err := querier.Query(func(batch ServerList) error {
+		count += len(batch)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Errorf("expected 6 servers, got %d", count)
+	}
+
+	// Only the first query needed a second try.
+	if queries := master.Queries(); len(queries) != 3 {
+		t.Errorf("expected 3 queries, got %d", len(queries))
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	header := []byte{0xff, 0xff, 0xff, 0xff, 0x66, 0x0d}
+	batches := []ServerList{makeServerList(1, 2), makeServerList(2, 2)}
+	master := newMockMaster(t, batches)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		var replies [][]byte
+		for _, reply := range master.batchReply(query) {
+			replies = append(replies, append(append([]byte{}, header...), reply[len(HeaderMasterResponse):]...))
+		}
+		return replies
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	if err := querier.Query(func(ServerList) error { return nil }); !errors.Is(err, ErrBadResponseHeader) {
+		t.Fatalf("expected ErrBadResponseHeader, got %v", err)
+	}
+
+	querier.SetResponseHeader(header)
+	count := 0
+	err := querier.Query(func(batch ServerList) error {
+		count += len(batch)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("expected 4 servers, got %d", count)
+	}
+}
+
+func TestParallelSeeds(t *testing.T) {
+	all := ServerList{}
+	for block := 1; block <= 4; block++ {
+		all = append(all, makeServerList(block, 3)...)
+	}
+
+	// Answer with the next three servers after the seed, wherever it is.
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		seed, err := parseSeedAddress(query.seed)
+		if err != nil {
+			return nil
+		}
+		batch := ServerList{}
+		for _, addr := range all {
+			if compareAddrs(addr, seed) > 0 && len(batch) < 3 {
+				batch = append(batch, addr)
+			}
+		}
+		last := len(batch) == 0 || batch[len(batch)-1] == all[len(all)-1]
+		return [][]byte{encodeMasterResponse(batch, last)}
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	if err := querier.SetParallelSeeds([]string{"10.0.3.0:0", "bogus"}); err != ErrBadStartAddress {
+		t.Errorf("expected ErrBadStartAddress, got %v", err)
+	}
+	if err := querier.SetParallelSeeds([]string{"10.0.3.0:0", "0.0.0.0:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	err := querier.Query(func(batch ServerList) error {
+		for _, addr := range batch {
+			counts[addr.String()]++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counts) != len(all) {
+		t.Errorf("expected %d servers, got %d", len(all), len(counts))
+	}
+	for addr, count := range counts {
+		if count != 1 {
+			t.Errorf("%s was seen %d times", addr, count)
+		}
+	}
+
+	// Three pages for the first range, two for the second.
+	if queries := master.Queries(); len(queries) > 5 {
+		t.Errorf("expected at most 5 queries, got %d", len(queries))
+	}
+}
+
+func TestMasterHeaderDiagnosis(t *testing.T) {
+	cases := map[string]string{
+		"\xff\xff\xff\xff\x66\x0d\x01\x02":     "master batch with an unknown version",
+		"\xff\xff\xff\xff\x41\x01\x02\x03\x04": "challenge request",
+		"\xff\xff\xff\xff\x49\x11server":       "game server info reply, not a master",
+		"garbage reply":                        "unknown format",
+	}
+	for packet, format := range cases {
+		_, _, err := ParseMasterResponse([]byte(packet))
+		if !errors.Is(err, ErrBadResponseHeader) {
+			t.Errorf("%q: expected ErrBadResponseHeader, got %v", packet, err)
+			continue
+		}
+		var headerErr *MasterHeaderError
+		if !errors.As(err, &headerErr) || headerErr.Format != format {
+			t.Errorf("%q: expected %q, got %v", packet, format, err)
+		}
+	}
+}
+
+func TestRetainRawPackets(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3), makeServerList(3, 2)}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+
+	query := func() ServerList {
+		servers := ServerList{}
+		err := querier.Query(func(batch ServerList) error {
+			servers = append(servers, batch...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return servers
+	}
+
+	query()
+	if packets := querier.RawPackets(); len(packets) != 0 {
+		t.Fatalf("expected no packets by default, got %d", len(packets))
+	}
+
+	querier.SetRetainRawPackets(true)
+	servers := query()
+
+	packets := querier.RawPackets()
+	if len(packets) != len(batches) {
+		t.Fatalf("expected %d packets, got %d", len(batches), len(packets))
+	}
+	reparsed := ServerList{}
+	for _, packet := range packets {
+		batch, _, err := ParseMasterResponse(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reparsed = append(reparsed, batch...)
+	}
+	if added, removed := servers.Diff(reparsed); len(servers) != len(reparsed) || len(added) != 0 || len(removed) != 0 {
+		t.Errorf("reparsed packets don't match: %v != %v", reparsed, servers)
+	}
+}
+
+func TestBatchTiming(t *testing.T) {
+	delays := []time.Duration{20 * time.Millisecond, 60 * time.Millisecond, 40 * time.Millisecond}
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3), makeServerList(3, 2)}
+	master := newMockMaster(t, batches)
+	calls := 0
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		time.Sleep(delays[calls%len(delays)])
+		calls++
+		return master.batchReply(query)
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	numbers := []int{}
+	rtts := []time.Duration{}
+	querier.SetBatchTimingFunc(func(batch int, rtt time.Duration) {
+		numbers = append(numbers, batch)
+		rtts = append(rtts, rtt)
+	})
+	if err := querier.Query(func(batch ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(numbers, []int{0, 1, 2}) {
+		t.Fatalf("expected batches 0, 1, 2, got %v", numbers)
+	}
+	for i, rtt := range rtts {
+		if rtt < delays[i] {
+			t.Errorf("batch %d: rtt %v is less than the injected delay %v", i, rtt, delays[i])
+		}
+	}
+}
+
+func TestTerminatorOnlyBatch(t *testing.T) {
+	batch := makeServerList(1, 3)
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		if query.seed == "0.0.0.0:0" {
+			return [][]byte{encodeMasterResponse(batch, false)}
+		}
+		// Nothing but the six zero bytes.
+		return [][]byte{encodeMasterResponse(nil, true)}
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	batches := []ServerList{}
+	err := querier.Query(func(servers ServerList) error {
+		batches = append(batches, servers)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 0 {
+		t.Errorf("expected a batch of 3 and an empty final batch, got %v", batches)
+	}
+
+	servers, next, done, err := querier.QueryBatch(context.Background(), batch[2].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 0 || next != "" || !done {
+		t.Errorf("expected the end of the list, got %v, %q, %v", servers, next, done)
+	}
+}
+
+func TestSelectFastestMaster(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 2)}
+	slow := newMockMaster(t, batches)
+	slow.SetRespond(func(query *mockQuery) [][]byte {
+		time.Sleep(time.Millisecond * 100)
+		return slow.batchReply(query)
+	})
+	fast := newMockMaster(t, batches)
+	dead := newMockMaster(t, batches)
+	dead.SetRespond(func(query *mockQuery) [][]byte {
+		return nil
+	})
+	querier := newTestMasterQuerier(t, slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	host, err := querier.SelectFastestMaster(ctx, []string{slow.Addr(), fast.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != fast.Addr() || querier.RemoteAddr().String() != fast.Addr() {
+		t.Fatalf("expected %s to be chosen, got %s", fast.Addr(), host)
+	}
+
+	before := len(fast.Queries())
+	if err := querier.Query(func(servers ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(fast.Queries()) == before {
+		t.Errorf("expected queries to go to the chosen master")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if _, err := querier.SelectFastestMaster(ctx, []string{dead.Addr()}); err == nil {
+		t.Errorf("expected an error when no master answers")
+	}
+	if querier.RemoteAddr().String() != fast.Addr() {
+		t.Errorf("expected the querier to keep its master when none answer")
+	}
+	if _, err := querier.SelectFastestMaster(context.Background(), nil); err != ErrNoMasters {
+		t.Errorf("expected ErrNoMasters, got %v", err)
+	}
+}
+
+func TestMaxReceivedBytes(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 10), makeServerList(2, 10), makeServerList(3, 10)}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+
+	// Each batch is 66 bytes, so the budget runs out during the second.
+	querier.SetMaxReceivedBytes(100)
+
+	servers := ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != ErrByteBudgetExceeded {
+		t.Fatalf("expected ErrByteBudgetExceeded, got %v", err)
+	}
+	if len(servers) != 20 {
+		t.Errorf("expected the first two batches, got %d servers", len(servers))
+	}
+	if queries := master.Queries(); len(queries) != 2 {
+		t.Errorf("expected 2 queries, got %d", len(queries))
+	}
+
+	querier.SetMaxReceivedBytes(0)
+	if err := querier.Query(func(batch ServerList) error { return nil }); err != nil {
+		t.Errorf("expected no limit, got %v", err)
+	}
+}
+
+func TestReceivedCounterAcrossRedial(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 10)})
+	querier := newTestMasterQuerier(t, master)
+	counter := querier.newReceivedCounter()
+
+	// Bytes from before and after the socket is replaced both count.
+	if err := querier.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first := querier.cn.Stats().BytesReceived
+	if err := querier.redialMaster(); err != nil {
+		t.Fatal(err)
+	}
+	if err := querier.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bytes := counter.next(); first == 0 || bytes != first*2 {
+		t.Errorf("expected %d bytes over both sockets, got %d", first*2, bytes)
+	}
+	if bytes := counter.next(); bytes != 0 {
+		t.Errorf("expected nothing new, got %d bytes", bytes)
+	}
+}
+
+func TestSocketStatsAcrossRedial(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 10)})
+	querier := newTestMasterQuerier(t, master)
+
+	// Stats can be read while the querier redials.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go (func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				querier.SocketStats()
+				querier.RemoteAddr()
+			}
+		}
+	})()
+
+	for i := 0; i < 3; i++ {
+		if err := querier.Ping(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		querier.lock.Lock()
+		err := querier.redialMaster()
+		querier.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+
+	if stats := querier.SocketStats(); stats.Sends != 3 || stats.Recvs != 3 {
+		t.Errorf("expected the stats of every socket, got %+v", stats)
+	}
+}
+
+func TestMaxReceivedBytesAllRegions(t *testing.T) {
+	// Every region answers with the same 66 byte batch, so the budget runs out
+	// on the second region, whichever master it is on.
+	defaultMaster := newMockMaster(t, []ServerList{makeServerList(1, 10)})
+	other := newMockMaster(t, []ServerList{makeServerList(1, 10)})
+	allOnOther := map[byte]string{}
+	for _, region := range Regions {
+		allOnOther[region] = other.Addr()
+	}
+
+	for _, hosts := range []map[byte]string{nil, allOnOther} {
+		querier := newTestMasterQuerier(t, defaultMaster)
+		querier.SetMaxReceivedBytes(100)
+		err := querier.QueryAllRegions(context.Background(), hosts, func(ServerList) error { return nil })
+		if err != ErrByteBudgetExceeded {
+			t.Errorf("expected ErrByteBudgetExceeded, got %v", err)
+		}
+	}
+	if queries := len(defaultMaster.Queries()); queries != 2 {
+		t.Errorf("expected the default master to be queried twice, got %d", queries)
+	}
+	if queries := len(other.Queries()); queries != 2 {
+		t.Errorf("expected the other master to be queried twice, got %d", queries)
+	}
+}
+
+// A resolver whose answers can be changed.
+type switchingResolver struct {
+	lock sync.Mutex
+	ip   net.IP
+}
+
+func (this *switchingResolver) Set(ip net.IP) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.ip = ip
+}
+
+func (this *switchingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return []net.IPAddr{{IP: this.ip}}, nil
+}
+
+func TestRedialOnFailure(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3), makeServerList(3, 2)}
+
+	// The new backend shares a port with the old one, on another local IP.
+	replacement := newMockMaster(t, batches)
+	_, port, _ := net.SplitHostPort(replacement.Addr())
+	old := newMockMasterOn(t, net.JoinHostPort("127.0.0.2", port), batches)
+
+	resolver := &switchingResolver{ip: net.IPv4(127, 0, 0, 2)}
+	SetResolver(resolver)
+	t.Cleanup(func() {
+		SetResolver(net.DefaultResolver)
+	})
+
+	// The old backend answers the first query, then goes away, by which time
+	// DNS points at the replacement.
+	old.SetRespond(func(query *mockQuery) [][]byte {
+		if query.seed != "0.0.0.0:0" {
+			return nil
+		}
+		resolver.Set(net.IPv4(127, 0, 0, 1))
+		return old.batchReply(query)
+	})
+
+	query := func(redial bool) (int, error) {
+		resolver.Set(net.IPv4(127, 0, 0, 2))
+		querier, err := NewMasterServerQuerier("master.test:" + port)
+		if err != nil {
+			return 0, err
+		}
+		defer querier.Close()
+		querier.cn.wait = 0
+		querier.cn.SetTimeout(time.Millisecond * 50)
+		querier.FilterAppIds([]AppId{App_TF2})
+		querier.SetRedialOnFailure(redial)
+
+		count := 0
+		err = querier.Query(func(batch ServerList) error {
+			count += len(batch)
+			return nil
+		})
+		return count, err
+	}
+
+	if _, err := query(false); err == nil {
+		t.Errorf("expected the query to fail without redialing")
+	}
+
+	count, err := query(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 8 {
+		t.Errorf("expected 8 servers, got %d", count)
+	}
+	if len(replacement.Queries()) == 0 {
+		t.Errorf("expected the replacement master to be queried")
+	}
+}
+
+func TestClientIdentifier(t *testing.T) {
+	querier, err := NewMasterServerQuerier("127.0.0.1:27011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+	querier.FilterAppIds([]AppId{App_TF2})
+
+	plain := querier.buildQuery(RegionAll, "0.0.0.0:0", querier.filters)
+	if !bytes.Equal(plain, BuildMasterQuery("0.0.0.0:0", querier.filters)) {
+		t.Errorf("expected no identifier by default, got %q", plain)
+	}
+
+	querier.SetClientIdentifier("blaster/1.0")
+	query := querier.buildQuery(RegionAll, "0.0.0.0:0", querier.filters)
+	if !bytes.Equal(query, append(append(plain, "blaster/1.0"...), 0)) {
+		t.Errorf("expected the identifier after the filter, got %q", query)
+	}
+}
+
+func TestCallbackBatchSize(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3), makeServerList(3, 3)}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+	querier.SetCallbackBatchSize(4)
+
+	sizes := []int{}
+	servers := ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		sizes = append(sizes, len(batch))
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, []int{4, 4, 1}) {
+		t.Errorf("expected chunks of 4, 4 and 1, got %v", sizes)
+	}
+	if len(servers) != 9 || servers[4].String() != "10.0.2.2:27015" {
+		t.Errorf("expected all 9 servers in order, got %v", servers)
+	}
+
+	// The server limit applies before chunking, and the rest is still flushed.
+	querier.SetMaxServers(5)
+	sizes = []int{}
+	err = querier.Query(func(batch ServerList) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, []int{4, 1}) {
+		t.Errorf("expected chunks of 4 and 1, got %v", sizes)
+	}
+}
+
+func TestFindServer(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3), makeServerList(3, 3)}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+	querier.ClearFilters()
+
+	if _, err := querier.FindServer(context.Background(), "nowhere"); err != ErrBadTargetAddress {
+		t.Errorf("expected ErrBadTargetAddress, got %v", err)
+	}
+
+	found, err := querier.FindServer(context.Background(), batches[1][1].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Errorf("expected to find %s", batches[1][1])
+	}
+	if queries := len(master.Queries()); queries != 2 {
+		t.Errorf("expected the search to stop after 2 queries, got %d", queries)
+	}
+
+	found, err = querier.FindServer(context.Background(), "10.9.9.9:27015")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expected not to find a server that isn't listed")
+	}
+	if queries := len(master.Queries()); queries != 5 {
+		t.Errorf("expected the whole list to be searched, got %d queries in total", queries)
+	}
+}
+
+type memoryCheckpoints struct {
+	saved []Checkpoint
+}
+
+func (this *memoryCheckpoints) SaveCheckpoint(ctx context.Context, checkpoint Checkpoint) error {
+	this.saved = append(this.saved, checkpoint)
+	return nil
+}
+
+func TestCheckpointSink(t *testing.T) {
+	batches := []ServerList{}
+	for block := 1; block <= 5; block++ {
+		batches = append(batches, makeServerList(block, 3))
+	}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+	querier.ClearFilters()
+
+	sink := &memoryCheckpoints{}
+	querier.SetCheckpointSink(sink, 2)
+	if err := querier.Query(func(batch ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last batch ends the list, so only batches 2 and 4 are checkpointed.
+	expected := []Checkpoint{
+		{Seed: batches[1][2].String(), Servers: 6, Batches: 2},
+		{Seed: batches[3][2].String(), Servers: 12, Batches: 4},
+	}
+	if !reflect.DeepEqual(sink.saved, expected) {
+		t.Fatalf("expected checkpoints %+v, got %+v", expected, sink.saved)
+	}
+
+	// Resuming from the first checkpoint picks up with the third batch.
+	querier.SetCheckpointSink(nil, 0)
+	if err := querier.SetStartAddress(sink.saved[0].Seed); err != nil {
+		t.Fatal(err)
+	}
+	servers := ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 9 || servers[0].String() != batches[2][0].String() {
+		t.Errorf("expected the last 9 servers, got %v", servers)
+	}
+}
+
+func TestCountPrefix(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 2)}
+	master := newMockMaster(t, batches)
+	// Put a count in front of each batch, off by skew.
+	counted := func(skew int) func(query *mockQuery) [][]byte {
+		return func(query *mockQuery) [][]byte {
+			var replies [][]byte
+			for _, reply := range master.batchReply(query) {
+				body := reply[len(HeaderMasterResponse):]
+				count := len(body)/6 + skew
+				if bytes.HasSuffix(body, []byte{0, 0, 0, 0, 0, 0}) {
+					count--
+				}
+				packet := append([]byte{}, HeaderMasterResponse...)
+				packet = append(packet, byte(count), byte(count>>8))
+				replies = append(replies, append(packet, body...))
+			}
+			return replies
+		}
+	}
+	master.SetRespond(counted(0))
+	querier := newTestMasterQuerier(t, master)
+	querier.SetHasCountPrefix(true)
+
+	servers := ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 5 || servers[3].String() != batches[1][0].String() {
+		t.Errorf("expected all 5 servers, got %v", servers)
+	}
+
+	master.SetRespond(counted(1))
+	if err := querier.Query(func(ServerList) error { return nil }); !errors.Is(err, ErrServerCountMismatch) {
+		t.Errorf("expected ErrServerCountMismatch, got %v", err)
+	}
+}
+
+func TestMasterPortClosed(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 3), makeServerList(2, 3)})
+	querier := newTestMasterQuerier(t, master)
+
+	// Take the master down once the first batch is in, so the OS refuses the
+	// query for the next one.
+	err := querier.Query(func(batch ServerList) error {
+		master.conn.Close()
+		return nil
+	})
+	if !errors.Is(err, ErrPortClosed) {
+		t.Fatalf("expected ErrPortClosed, got %v", err)
+	}
+	if kind := ClassifyQueryError(err); kind != FailurePortClosed {
+		t.Errorf("expected FailurePortClosed, got %v", kind)
+	}
+	if sends := querier.SocketStats().Sends; sends != 2 {
+		t.Errorf("expected no retries after the port closed, got %d sends", sends)
+	}
+}
+
+func TestHeaderSearchWindow(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 2), makeServerList(2, 2)}
+	master := newMockMaster(t, batches)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		var replies [][]byte
+		for _, reply := range master.batchReply(query) {
+			replies = append(replies, append([]byte{0x00, 0x01}, reply...))
+		}
+		return replies
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	if err := querier.Query(func(ServerList) error { return nil }); !errors.Is(err, ErrBadResponseHeader) {
+		t.Fatalf("expected ErrBadResponseHeader by default, got %v", err)
+	}
+
+	// Too small a window still misses the header.
+	querier.SetHeaderSearchWindow(1)
+	if err := querier.Query(func(ServerList) error { return nil }); !errors.Is(err, ErrBadResponseHeader) {
+		t.Fatalf("expected ErrBadResponseHeader with a 1-byte window, got %v", err)
+	}
+
+	querier.SetHeaderSearchWindow(4)
+	servers := ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 4 || servers[0].String() != batches[0][0].String() {
+		t.Errorf("expected all 4 servers, got %v", servers)
+	}
+	if err := querier.Ping(context.Background()); err != nil {
+		t.Errorf("expected Ping to accept the padded header, got %v", err)
+	}
+}
+
+func TestFilterStringFunc(t *testing.T) {
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3)}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+	querier.ClearFilters()
+	querier.SetOptimizeBatching(true)
+	querier.FilterAppIds([]AppId{App_TF2, App_L4D2})
+
+	numbers := []int{}
+	filters := []string{}
+	querier.SetFilterStringFunc(func(batch int, filter string) {
+		numbers = append(numbers, batch)
+		filters = append(filters, filter)
+	})
+	if err := querier.Query(func(batch ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(numbers, []int{0, 1}) {
+		t.Fatalf("expected batches 0 and 1, got %v", numbers)
+	}
+	built, err := parseMockQuery(BuildMasterQuery("0.0.0.0:0", querier.filters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, query := range master.Queries() {
+		if filters[i] != built.filter || filters[i] != query.filter {
+			t.Errorf("batch %d: reported %q, but built %q and sent %q", i, filters[i], built.filter, query.filter)
+		}
+	}
+	if !strings.HasPrefix(filters[0], "\\or\\2") {
+		t.Errorf("expected an \\or\\ filter, got %q", filters[0])
+	}
+}
+
+func TestFilterStringFuncParallelSeeds(t *testing.T) {
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		seed, err := parseSeedAddress(query.seed)
+		if err != nil {
+			return nil
+		}
+		if seed.IP.Equal(net.IPv4zero) {
+			return [][]byte{encodeMasterResponse(makeServerList(1, 3), true)}
+		}
+		return [][]byte{encodeMasterResponse(makeServerList(3, 3), true)}
+	})
+	querier := newTestMasterQuerier(t, master)
+	if err := querier.SetParallelSeeds([]string{"0.0.0.0:0", "10.0.3.0:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	reported := 0
+	querier.SetFilterStringFunc(func(batch int, filter string) {
+		lock.Lock()
+		defer lock.Unlock()
+		reported++
+	})
+	if err := querier.Query(func(batch ServerList) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if queries := len(master.Queries()); reported != queries {
+		t.Errorf("expected a filter string for each of %d queries, got %d", queries, reported)
+	}
+}
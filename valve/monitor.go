@@ -0,0 +1,84 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"time"
+)
+
+// What changed in the master's list since the previous poll.
+type MonitorEvent struct {
+	Added   ServerList
+	Removed ServerList
+
+	// Set if the poll failed. The list is then assumed not to have changed,
+	// and Added and Removed are empty.
+	Err error
+}
+
+// Polls the master at a fixed interval and reports servers that appear in or
+// drop out of its list.
+type Monitor struct {
+	master   MasterQuerier
+	interval time.Duration
+	servers  ServerList
+}
+
+// Create a monitor that polls the given master, which should already have its
+// filters set, once every interval.
+func NewMonitor(master MasterQuerier, interval time.Duration) *Monitor {
+	return &Monitor{
+		master:   master,
+		interval: interval,
+	}
+}
+
+// Returns the list seen by the last successful poll. This must not be called
+// while Run is running.
+func (this *Monitor) Servers() ServerList {
+	return this.servers
+}
+
+// Poll until the context is cancelled, sending an event to the channel
+// whenever the list changes or a poll fails. The first poll reports every
+// server as added. Run returns the context's error.
+func (this *Monitor) Run(ctx context.Context, events chan<- MonitorEvent) error {
+	for {
+		if event, changed := this.poll(ctx); changed {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		timer := time.NewTimer(this.interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (this *Monitor) poll(ctx context.Context) (MonitorEvent, bool) {
+	servers := ServerList{}
+	err := this.master.QueryContext(ctx, func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		// A poll cut off by cancellation isn't worth reporting.
+		return MonitorEvent{Err: err}, ctx.Err() == nil
+	}
+
+	added, removed := this.servers.Diff(servers)
+	this.servers = servers
+	event := MonitorEvent{Added: added, Removed: removed}
+	return event, len(added) > 0 || len(removed) > 0
+}
@@ -0,0 +1,73 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	first := makeServerList(1, 3)
+	second := append(ServerList{first[1], first[2]}, makeServerList(2, 1)...)
+
+	// The first poll sees one list, and every later poll sees the second.
+	var lock sync.Mutex
+	polls := 0
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		lock.Lock()
+		defer lock.Unlock()
+		polls++
+		if polls == 1 {
+			return [][]byte{encodeMasterResponse(first, true)}
+		}
+		return [][]byte{encodeMasterResponse(second, true)}
+	})
+	querier := newTestMasterQuerier(t, master)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan MonitorEvent)
+	monitor := NewMonitor(querier, time.Millisecond*10)
+	done := make(chan error)
+	go (func() {
+		done <- monitor.Run(ctx, events)
+	})()
+
+	event := <-events
+	if event.Err != nil || len(event.Added) != 3 || len(event.Removed) != 0 {
+		t.Fatalf("expected the first poll to add every server, got %+v", event)
+	}
+
+	event = <-events
+	if event.Err != nil {
+		t.Fatal(event.Err)
+	}
+	if len(event.Added) != 1 || event.Added[0].String() != second[2].String() {
+		t.Errorf("expected %v to be added, got %v", second[2], event.Added)
+	}
+	if len(event.Removed) != 1 || event.Removed[0].String() != first[0].String() {
+		t.Errorf("expected %v to be removed, got %v", first[0], event.Removed)
+	}
+
+	// Later polls see no change, so send nothing.
+	select {
+	case event := <-events:
+		t.Errorf("expected no event for an unchanged list, got %+v", event)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if len(monitor.Servers()) != 3 {
+		t.Errorf("expected the last list to be kept, got %v", monitor.Servers())
+	}
+}
@@ -0,0 +1,218 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrAddressInUse = errors.New("address is already being queried on this connection")
+
+// How many packets may wait for a route's reader before more are dropped.
+const kMuxQueueLength = 32
+
+// Shares one PacketConn between sockets that talk to different addresses. A
+// single goroutine reads the connection and hands each packet to the route
+// for its source address; packets from anyone else are dropped.
+type packetMux struct {
+	conn net.PacketConn
+
+	lock   sync.Mutex
+	routes map[string]*muxRoute
+	err    error
+}
+
+var (
+	sMuxLock sync.Mutex
+	sMuxes   = map[net.PacketConn]*packetMux{}
+)
+
+// Returns a connection that only sees packets from the given address, sharing
+// conn with any other routes opened on it. conn stays owned by the caller, and
+// closing it ends every route.
+func openMuxRoute(conn net.PacketConn, remote *net.UDPAddr) (*muxRoute, error) {
+	sMuxLock.Lock()
+	mux, ok := sMuxes[conn]
+	if !ok {
+		mux = &packetMux{
+			conn:   conn,
+			routes: map[string]*muxRoute{},
+		}
+		sMuxes[conn] = mux
+		go mux.serve()
+	}
+	sMuxLock.Unlock()
+
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	if mux.err != nil {
+		return nil, mux.err
+	}
+	key := remote.String()
+	if _, found := mux.routes[key]; found {
+		return nil, ErrAddressInUse
+	}
+
+	route := &muxRoute{
+		mux:     mux,
+		remote:  remote,
+		packets: make(chan []byte, kMuxQueueLength),
+		done:    make(chan struct{}),
+		wake:    make(chan struct{}),
+	}
+	mux.routes[key] = route
+	return route, nil
+}
+
+func (this *packetMux) serve() {
+	buffer := make([]byte, kMaxDatagramSize)
+	for {
+		n, from, err := this.conn.ReadFrom(buffer)
+		if err != nil {
+			this.stop(err)
+			return
+		}
+
+		this.lock.Lock()
+		route := this.routes[from.String()]
+		this.lock.Unlock()
+		if route == nil {
+			continue
+		}
+
+		select {
+		case route.packets <- append([]byte{}, buffer[:n]...):
+		default:
+			// Nobody is reading; drop it, as the OS would.
+		}
+	}
+}
+
+// Fail every route once the connection can't be read anymore.
+func (this *packetMux) stop(err error) {
+	sMuxLock.Lock()
+	delete(sMuxes, this.conn)
+	sMuxLock.Unlock()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.err = err
+	for _, route := range this.routes {
+		route.fail(err)
+	}
+	this.routes = map[string]*muxRoute{}
+}
+
+// One address's view of a shared connection. This implements net.PacketConn
+// for UdpSocket. Write deadlines are left alone, since they would apply to
+// every route.
+type muxRoute struct {
+	mux     *packetMux
+	remote  *net.UDPAddr
+	packets chan []byte
+
+	lock      sync.Mutex
+	deadline  time.Time
+	wake      chan struct{}
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+func (this *muxRoute) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	for {
+		this.lock.Lock()
+		deadline := this.deadline
+		wake := this.wake
+		this.lock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case packet := <-this.packets:
+			stopTimer(timer)
+			return copy(buffer, packet), this.remote, nil
+		case <-this.done:
+			stopTimer(timer)
+			this.lock.Lock()
+			defer this.lock.Unlock()
+			return 0, nil, this.err
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-wake:
+			// The deadline moved.
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (this *muxRoute) WriteTo(buffer []byte, addr net.Addr) (int, error) {
+	return this.mux.conn.WriteTo(buffer, addr)
+}
+
+func (this *muxRoute) LocalAddr() net.Addr {
+	return this.mux.conn.LocalAddr()
+}
+
+func (this *muxRoute) SetDeadline(deadline time.Time) error {
+	return this.SetReadDeadline(deadline)
+}
+
+func (this *muxRoute) SetReadDeadline(deadline time.Time) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.deadline = deadline
+	close(this.wake)
+	this.wake = make(chan struct{})
+	return nil
+}
+
+func (this *muxRoute) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
+
+// Stop routing packets to this address. The shared connection stays open.
+func (this *muxRoute) Close() error {
+	this.mux.lock.Lock()
+	if this.mux.routes[this.remote.String()] == this {
+		delete(this.mux.routes, this.remote.String())
+	}
+	this.mux.lock.Unlock()
+
+	this.fail(net.ErrClosed)
+	return nil
+}
+
+func (this *muxRoute) fail(err error) {
+	this.closeOnce.Do(func() {
+		this.lock.Lock()
+		this.err = err
+		this.lock.Unlock()
+		close(this.done)
+	})
+}
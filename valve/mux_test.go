@@ -0,0 +1,102 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerQuerierWithConn(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	names := []string{"first", "second"}
+	queriers := []*ServerQuerier{}
+	for _, name := range names {
+		info := makeTestInfo()
+		info.Name = name
+		server := newMockServer(t, respondToInfo(encodeSourceInfo(info)))
+
+		querier, err := NewServerQuerierWithConn(conn, server.conn.LocalAddr(), time.Millisecond*500)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer querier.Close()
+		queriers = append(queriers, querier)
+
+		if _, err := NewServerQuerierWithConn(conn, server.conn.LocalAddr(), time.Second); err != ErrAddressInUse {
+			t.Errorf("expected ErrAddressInUse for a second querier, got %v", err)
+		}
+	}
+
+	// Query both at once, so their replies arrive on the socket together.
+	var wg sync.WaitGroup
+	for i, querier := range queriers {
+		wg.Add(1)
+		go func(querier *ServerQuerier, expected string) {
+			defer wg.Done()
+			for round := 0; round < 5; round++ {
+				info, err := querier.QueryInfo()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if info.Name != expected {
+					t.Errorf("expected a reply from %s, got %s", expected, info.Name)
+				}
+			}
+		}(querier, names[i])
+	}
+	wg.Wait()
+
+	if err := queriers[0].Reconnect(); err != ErrSharedConnection {
+		t.Errorf("expected ErrSharedConnection, got %v", err)
+	}
+
+	// Closing the shared connection ends queries on it.
+	conn.Close()
+	if _, err := queriers[1].QueryInfo(); err == nil {
+		t.Errorf("expected an error once the connection is closed")
+	}
+}
+
+func TestMuxRouteDeadline(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	silent := newMockServer(t, func(request []byte) [][]byte {
+		return nil
+	})
+	socket, err := NewUdpSocketWithConn(conn, silent.conn.LocalAddr(), time.Millisecond*50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	if err := socket.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = socket.Recv()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout took too long: %v", elapsed)
+	}
+	if socket.Stats().Timeouts != 1 {
+		t.Errorf("expected the timeout to be counted")
+	}
+}
@@ -0,0 +1,103 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// One line of NDJSONSink output.
+type ndjsonServer struct {
+	AppId        AppId  `json:"appid"`
+	Address      string `json:"address"`
+	QueryAddress string `json:"query_address,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Name         string `json:"name,omitempty"`
+	MapName      string `json:"map,omitempty"`
+	Players      uint8  `json:"players"`
+	MaxPlayers   uint8  `json:"max_players"`
+	Bots         uint8  `json:"bots"`
+	Ping         int64  `json:"ping_ms"`
+	Vac          bool   `json:"vac"`
+	Version      string `json:"version,omitempty"`
+}
+
+// Writes each server an Orchestrator finds as one line of JSON, so results
+// can be streamed into another program without buffering the whole scan.
+// Servers that didn't answer are written with their error. Ping is in
+// milliseconds, and progress isn't saved.
+type NDJSONSink struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	gzip    *gzip.Writer
+}
+
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	return &NDJSONSink{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// Same as NewNDJSONSink, but the output is compressed with gzip. Close must
+// be called once the scan is over to write out the end of the stream.
+func NewGzipNDJSONSink(w io.Writer) *NDJSONSink {
+	compressed := gzip.NewWriter(w)
+	return &NDJSONSink{
+		encoder: json.NewEncoder(compressed),
+		gzip:    compressed,
+	}
+}
+
+// Finish the output. For a gzip sink, this flushes whatever is buffered and
+// writes the gzip footer. The underlying writer is left open.
+func (this *NDJSONSink) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.gzip == nil {
+		return nil
+	}
+	return this.gzip.Close()
+}
+
+// Implements OrchestratorSink.StoreServer.
+func (this *NDJSONSink) StoreServer(ctx context.Context, server *OrchestratedServer) error {
+	line := ndjsonServer{
+		AppId:   server.AppId,
+		Address: server.Address,
+	}
+	if server.QueryAddress != server.Address {
+		line.QueryAddress = server.QueryAddress
+	}
+	if server.Err != nil {
+		line.Error = server.Err.Error()
+	}
+	if info := server.Info; info != nil {
+		line.Name = info.Name
+		line.MapName = info.MapName
+		line.Players = info.Players
+		line.MaxPlayers = info.MaxPlayers
+		line.Bots = info.Bots
+		line.Ping = info.Ping.Milliseconds()
+		line.Vac = info.Vac != 0
+		if info.Ext != nil {
+			line.Version = info.Ext.GameVersion
+		}
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.encoder.Encode(&line)
+}
+
+// Implements OrchestratorSink.SaveProgress. This does nothing.
+func (this *NDJSONSink) SaveProgress(ctx context.Context, progress OrchestratorProgress) error {
+	return nil
+}
@@ -0,0 +1,112 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNDJSONSink(t *testing.T) {
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	deadAddr := dead.LocalAddr().(*net.UDPAddr)
+
+	live := []*net.TCPAddr{
+		newOrchestratorTestServer(t, "ndjson a", nil),
+		newOrchestratorTestServer(t, "ndjson b", nil),
+	}
+	deadServer := &net.TCPAddr{IP: deadAddr.IP.To4(), Port: deadAddr.Port}
+	master := newMockMaster(t, []ServerList{{live[0], live[1], deadServer}})
+
+	var out bytes.Buffer
+	orchestrator := NewOrchestrator(master.Addr(), []AppId{App_TF2}, NewNDJSONSink(&out))
+	orchestrator.SetMasterSetup(func(master *MasterServerQuerier) {
+		master.SetRateLimit(0)
+		master.SetTimeout(time.Second)
+	})
+	orchestrator.SetQueryTimeout(time.Millisecond * 200)
+	orchestrator.SetQueryRate(1000)
+	if err := orchestrator.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := map[string]ndjsonServer{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var line ndjsonServer
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		lines[line.Address] = line
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected a line per server, got %v", lines)
+	}
+	for i, addr := range live {
+		line := lines[addr.String()]
+		if line.AppId != App_TF2 || line.Error != "" || line.Name != []string{"ndjson a", "ndjson b"}[i] {
+			t.Errorf("unexpected line for %s: %+v", addr, line)
+		}
+		if line.MapName != "cp_dustbowl" || line.Players != 12 || line.MaxPlayers != 24 ||
+			line.Bots != 2 || !line.Vac || line.Version != "7648638" {
+			t.Errorf("unexpected info for %s: %+v", addr, line)
+		}
+	}
+	if line := lines[deadServer.String()]; line.Error == "" || line.Name != "" {
+		t.Errorf("expected the dead server to be written with its error, got %+v", line)
+	}
+}
+
+func TestGzipNDJSONSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewGzipNDJSONSink(&out)
+
+	servers := []*OrchestratedServer{
+		{AppId: App_TF2, Address: "10.0.1.1:27015", Info: makeTestInfo()},
+		{AppId: App_TF2, Address: "10.0.1.2:27015", Err: errors.New("timed out")},
+	}
+	for _, server := range servers {
+		if err := sink.StoreServer(context.Background(), server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(reader)
+	for _, server := range servers {
+		var line ndjsonServer
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Address != server.Address {
+			t.Errorf("expected %s, got %+v", server.Address, line)
+		}
+	}
+	if decoder.More() {
+		t.Errorf("expected only %d lines", len(servers))
+	}
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Errorf("expected a complete gzip stream, got %v", err)
+	}
+}
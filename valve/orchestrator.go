@@ -0,0 +1,569 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alliedmodders/blaster/batch"
+)
+
+var ErrAlreadyRunning = errors.New("orchestrator is already running")
+
+// One server found by an Orchestrator, along with its A2S_INFO reply.
+type OrchestratedServer struct {
+	AppId   AppId
+	Address string
+	// Where the server answered, if a query port offset was needed to reach
+	// it. Otherwise this is the same as Address.
+	QueryAddress string
+	Info         *ServerInfo // nil if the query failed.
+	Err          error
+	// Set if the orchestrator records timing, and the server answered.
+	Timing *QueryTiming
+	// Set if the server answered with an app id other than AppId. Such a
+	// server is spoofing its game, or was listed by mistake.
+	AppIdMismatch bool
+}
+
+// Where an Orchestrator had got to, for resuming it with SetProgress.
+type OrchestratorProgress struct {
+	// App ids that have been scanned in full.
+	Finished []AppId
+	// How far the master query had got for each app id being scanned.
+	Checkpoints map[AppId]Checkpoint
+}
+
+// Returns a copy that doesn't share the list or map.
+func (this OrchestratorProgress) clone() OrchestratorProgress {
+	checkpoints := map[AppId]Checkpoint{}
+	for appId, checkpoint := range this.Checkpoints {
+		checkpoints[appId] = checkpoint
+	}
+	return OrchestratorProgress{
+		Finished:    append([]AppId{}, this.Finished...),
+		Checkpoints: checkpoints,
+	}
+}
+
+// Receives everything an Orchestrator finds, along with its progress.
+type OrchestratorSink interface {
+	StoreServer(ctx context.Context, server *OrchestratedServer) error
+	SaveProgress(ctx context.Context, progress OrchestratorProgress) error
+}
+
+// Runs a full scan: every server listed for each app id is found on the
+// master and sent an A2S_INFO query, and the results go to a sink. Progress
+// is saved as the scan goes, so a scan that is stopped, or that crashed, can
+// pick up close to where it left off.
+//
+// App ids are scanned one at a time unless SetAppConcurrency allows more. Each
+// has its own master querier, rate limited as usual. Each master batch is
+// fully queried before the master is asked for the next one, so a saved
+// checkpoint never skips a server that wasn't stored.
+type Orchestrator struct {
+	master string
+	appIds []AppId
+	sink   OrchestratorSink
+
+	lock     sync.Mutex
+	running  bool
+	progress OrchestratorProgress
+
+	setupMaster     func(master *MasterServerQuerier)
+	checkpointEvery int
+	appConcurrency  int
+	concurrency     int
+	timeout         time.Duration
+	portOffsets     []int
+	recordTiming    bool
+	resultFilter    func(info *ServerInfo) bool
+	rejectMismatch  bool
+
+	// Server queries are sent from each local address in turn.
+	localAddrs []string
+	nextLocal  int
+
+	// Server queries are spaced out by interval, starting no earlier than
+	// next.
+	rateLock sync.Mutex
+	interval time.Duration
+	next     time.Time
+
+	statsLock sync.Mutex
+	tally     PlayerTally
+	failures  map[FailureKind]int
+}
+
+// Create an orchestrator that scans the given app ids, in order, on the given
+// master.
+func NewOrchestrator(master string, appIds []AppId, sink OrchestratorSink) *Orchestrator {
+	return &Orchestrator{
+		master:          master,
+		appIds:          append([]AppId{}, appIds...),
+		sink:            sink,
+		checkpointEvery: 1,
+		appConcurrency:  1,
+		concurrency:     20,
+		timeout:         time.Second * 3,
+		portOffsets:     []int{0},
+		failures:        map[FailureKind]int{},
+	}
+}
+
+// Run fn on each master querier before it is used, for example to change its
+// timeout or add filters.
+func (this *Orchestrator) SetMasterSetup(fn func(master *MasterServerQuerier)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.setupMaster = fn
+}
+
+// Save progress after every n master batches. The default is 1.
+func (this *Orchestrator) SetCheckpointEvery(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.checkpointEvery = n
+}
+
+// Set how many app ids are scanned at once. The default is 1. Each scan has
+// its own master querier and rate limit, so more than a few at once will
+// bother the master.
+func (this *Orchestrator) SetAppConcurrency(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.appConcurrency = n
+}
+
+// Set how many servers are queried at once, for each app id. The default is
+// 20.
+func (this *Orchestrator) SetConcurrency(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.concurrency = n
+}
+
+// Set how long to wait for each server to answer. The default is three
+// seconds.
+func (this *Orchestrator) SetQueryTimeout(timeout time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.timeout = timeout
+}
+
+// Some games answer queries on a port other than the one the master lists,
+// usually the one after it. When nothing answers on a port, the next offset
+// from the listed port is tried, in order. The default, [0], only tries the
+// listed port.
+func (this *Orchestrator) SetQueryPortOffsets(offsets []int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.portOffsets = append([]int{}, offsets...)
+}
+
+// Include a breakdown of where each successful query spent its time. This is
+// off by default.
+func (this *Orchestrator) SetRecordTiming(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.recordTiming = enabled
+}
+
+// Only store servers whose A2S_INFO reply passes the filter. Servers that
+// didn't answer are still stored, since the filter can't judge them, and
+// every server still counts towards Summary. Nil, the default, stores
+// everything.
+func (this *Orchestrator) SetResultFilter(filter func(info *ServerInfo) bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.resultFilter = filter
+}
+
+// Don't store servers that answer with an app id other than the one being
+// scanned. By default they are stored, with AppIdMismatch set. Either way
+// they count towards Summary.
+func (this *Orchestrator) SetRejectMismatchedAppIds(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.rejectMismatch = enabled
+}
+
+// Send server queries from each of the given local addresses in turn, to
+// spread them across several egress IPs (see NewBoundUdpSocket). An empty
+// list, the default, lets the OS choose.
+func (this *Orchestrator) SetLocalAddrPool(addrs []string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.localAddrs = append([]string{}, addrs...)
+	this.nextLocal = 0
+}
+
+// Returns the local address for the next server query.
+func (this *Orchestrator) nextLocalAddr() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.localAddrs) == 0 {
+		return ""
+	}
+	addr := this.localAddrs[this.nextLocal%len(this.localAddrs)]
+	this.nextLocal++
+	return addr
+}
+
+// Limit how many servers are queried per second. Zero, the default, disables
+// the limit.
+func (this *Orchestrator) SetQueryRate(perSecond int) {
+	this.rateLock.Lock()
+	defer this.rateLock.Unlock()
+
+	if perSecond <= 0 {
+		this.interval = 0
+		return
+	}
+	this.interval = time.Second / time.Duration(perSecond)
+}
+
+// Resume from progress saved by an earlier run. This must not be called while
+// the orchestrator is running.
+func (this *Orchestrator) SetProgress(progress OrchestratorProgress) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.progress = progress.clone()
+}
+
+// Returns how far the scan has got.
+func (this *Orchestrator) Progress() OrchestratorProgress {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.progress.clone()
+}
+
+// Returns totals for every server queried so far.
+func (this *Orchestrator) Summary() ScanSummary {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+
+	return this.tally.Summary()
+}
+
+// Returns how many server queries failed so far, for each kind of failure.
+func (this *Orchestrator) Failures() map[FailureKind]int {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+
+	failures := map[FailureKind]int{}
+	for kind, count := range this.failures {
+		failures[kind] = count
+	}
+	return failures
+}
+
+// Scan every app id that hasn't been finished yet. Cancelling the context
+// pauses the scan: Run returns the context's error, and calling Run again
+// carries on from the last checkpoint.
+func (this *Orchestrator) Run(ctx context.Context) error {
+	this.lock.Lock()
+	if this.running {
+		this.lock.Unlock()
+		return ErrAlreadyRunning
+	}
+	this.running = true
+	concurrency := this.appConcurrency
+	this.lock.Unlock()
+
+	defer (func() {
+		this.lock.Lock()
+		this.running = false
+		this.lock.Unlock()
+	})()
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// The first failure stops the other scans.
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var lock sync.Mutex
+	var firstErr error
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, appId := range this.appIds {
+		if this.isFinished(appId) {
+			continue
+		}
+
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go (func(appId AppId) {
+			defer wg.Done()
+			defer (func() { <-slots })()
+
+			if err := this.scanApp(ctx, appId); err != nil {
+				lock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				lock.Unlock()
+				cancel()
+			}
+		})(appId)
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		return parent.Err()
+	}
+	return firstErr
+}
+
+func (this *Orchestrator) isFinished(appId AppId) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, finished := range this.progress.Finished {
+		if finished == appId {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Orchestrator) scanApp(ctx context.Context, appId AppId) error {
+	master, err := NewMasterServerQuerier(this.master)
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+
+	this.lock.Lock()
+	if this.setupMaster != nil {
+		this.setupMaster(master)
+	}
+	resume := this.progress.Checkpoints[appId]
+	checkpointEvery := this.checkpointEvery
+	this.lock.Unlock()
+
+	master.FilterAppIds([]AppId{appId})
+	if err := master.SetStartAddress(resume.Seed); err != nil {
+		return err
+	}
+	master.SetCheckpointSink(&orchestratorCheckpoints{this, appId, resume}, checkpointEvery)
+
+	err = master.QueryContext(ctx, func(servers ServerList) error {
+		return this.queryServers(ctx, appId, servers)
+	})
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	this.progress.Finished = append(this.progress.Finished, appId)
+	delete(this.progress.Checkpoints, appId)
+	progress := this.progress.clone()
+	this.lock.Unlock()
+	return this.sink.SaveProgress(ctx, progress)
+}
+
+// Query a batch of servers, and wait for every query to finish.
+func (this *Orchestrator) queryServers(ctx context.Context, appId AppId, servers ServerList) error {
+	this.lock.Lock()
+	concurrency := this.concurrency
+	options := serverQueryOptions{
+		timeout:        this.timeout,
+		portOffsets:    this.portOffsets,
+		recordTiming:   this.recordTiming,
+		filter:         this.resultFilter,
+		rejectMismatch: this.rejectMismatch,
+	}
+	this.lock.Unlock()
+
+	if len(options.portOffsets) == 0 {
+		options.portOffsets = []int{0}
+	}
+
+	var lock sync.Mutex
+	var storeErr error
+	bp := batch.NewBatchProcessor(func(item interface{}) {
+		if err := this.queryServer(ctx, appId, item.(*net.TCPAddr), options); err != nil {
+			lock.Lock()
+			if storeErr == nil {
+				storeErr = err
+			}
+			lock.Unlock()
+		}
+	}, concurrency)
+	bp.AddBatch(servers)
+	bp.Finish()
+
+	if storeErr != nil {
+		return storeErr
+	}
+	// Some of the batch may not have been queried.
+	return ctx.Err()
+}
+
+// The settings for querying one batch, taken together so that changing them
+// mid-scan doesn't affect a batch already under way.
+type serverQueryOptions struct {
+	timeout        time.Duration
+	portOffsets    []int
+	recordTiming   bool
+	filter         func(info *ServerInfo) bool
+	rejectMismatch bool
+}
+
+func (this *Orchestrator) queryServer(ctx context.Context, appId AppId, addr *net.TCPAddr, options serverQueryOptions) error {
+	if err := this.waitTurn(ctx); err != nil {
+		return nil
+	}
+
+	server := &OrchestratedServer{
+		AppId:        appId,
+		Address:      addr.String(),
+		QueryAddress: addr.String(),
+	}
+	// If every port fails, the first one's error is reported.
+	localAddr := this.nextLocalAddr()
+	var err error
+	for _, offset := range options.portOffsets {
+		port := addr.Port + offset
+		if port <= 0 || port > 0xffff {
+			continue
+		}
+		queryAddr := (&net.TCPAddr{IP: addr.IP, Port: port}).String()
+		info, timing, queryErr := queryServerInfo(ctx, queryAddr, localAddr, options.timeout)
+		if queryErr == nil {
+			server.Info = info
+			server.QueryAddress = queryAddr
+			if options.recordTiming {
+				server.Timing = &timing
+			}
+			err = nil
+			break
+		}
+		if err == nil {
+			err = queryErr
+		}
+		if kind := ClassifyQueryError(queryErr); kind != FailureTimeout && kind != FailurePortClosed {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if server.Info == nil && err == nil {
+		err = ErrBadPort
+	}
+	if err != nil && ctx.Err() != nil {
+		// Cut off by the pause, not the server's fault.
+		return nil
+	}
+	server.Err = err
+
+	this.statsLock.Lock()
+	if err != nil {
+		this.tally.AddFailure()
+		this.failures[ClassifyQueryError(err)]++
+	} else {
+		this.tally.Add(server.Info)
+	}
+	this.statsLock.Unlock()
+
+	if server.Info != nil && server.Info.Ext != nil && server.Info.Ext.AppId != appId {
+		server.AppIdMismatch = true
+		if options.rejectMismatch {
+			return nil
+		}
+	}
+	if server.Info != nil && options.filter != nil && !options.filter(server.Info) {
+		return nil
+	}
+	return this.sink.StoreServer(ctx, server)
+}
+
+func queryServerInfo(ctx context.Context, address string, localAddr string, timeout time.Duration) (*ServerInfo, QueryTiming, error) {
+	querier, err := NewBoundServerQuerierContext(ctx, address, localAddr, timeout)
+	if err != nil {
+		return nil, QueryTiming{}, err
+	}
+	defer querier.Close()
+
+	info, err := querier.QueryInfoContext(ctx)
+	return info, querier.Timing(), err
+}
+
+// Wait until the rate limit allows another server query.
+func (this *Orchestrator) waitTurn(ctx context.Context) error {
+	this.rateLock.Lock()
+	if this.interval == 0 {
+		this.rateLock.Unlock()
+		return ctx.Err()
+	}
+	now := time.Now()
+	start := this.next
+	if start.Before(now) {
+		start = now
+	}
+	this.next = start.Add(this.interval)
+	this.rateLock.Unlock()
+
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Turns master checkpoints into orchestrator progress. Counts carry on from
+// where a resumed scan started.
+type orchestratorCheckpoints struct {
+	orchestrator *Orchestrator
+	appId        AppId
+	base         Checkpoint
+}
+
+func (this *orchestratorCheckpoints) SaveCheckpoint(ctx context.Context, checkpoint Checkpoint) error {
+	checkpoint.Servers += this.base.Servers
+	checkpoint.Batches += this.base.Batches
+
+	this.orchestrator.lock.Lock()
+	if this.orchestrator.progress.Checkpoints == nil {
+		this.orchestrator.progress.Checkpoints = map[AppId]Checkpoint{}
+	}
+	this.orchestrator.progress.Checkpoints[this.appId] = checkpoint
+	progress := this.orchestrator.progress.clone()
+	this.orchestrator.lock.Unlock()
+
+	return this.orchestrator.sink.SaveProgress(ctx, progress)
+}
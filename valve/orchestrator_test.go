@@ -0,0 +1,408 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryOrchestratorSink struct {
+	lock     sync.Mutex
+	servers  []*OrchestratedServer
+	progress []OrchestratorProgress
+
+	// Fail storing this address, to stand in for a crash.
+	failAddress string
+}
+
+var errTestSinkFailed = errors.New("sink failed")
+
+func (this *memoryOrchestratorSink) StoreServer(ctx context.Context, server *OrchestratedServer) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if server.Address == this.failAddress {
+		return errTestSinkFailed
+	}
+	this.servers = append(this.servers, server)
+	return nil
+}
+
+func (this *memoryOrchestratorSink) SaveProgress(ctx context.Context, progress OrchestratorProgress) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.progress = append(this.progress, progress)
+	return nil
+}
+
+func (this *memoryOrchestratorSink) Addresses() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	addresses := []string{}
+	for _, server := range this.servers {
+		addresses = append(addresses, server.Address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Start a game server that answers A2S_INFO with the given name, and return
+// its address in the master's format. If setup isn't nil, it can change the
+// rest of the info first.
+func newOrchestratorTestServer(t *testing.T, name string, setup func(info *ServerInfo)) *net.TCPAddr {
+	info := makeTestInfo()
+	info.Name = name
+	if setup != nil {
+		setup(info)
+	}
+	server := newMockServer(t, respondToInfo(encodeSourceInfo(info)))
+	addr := server.conn.LocalAddr().(*net.UDPAddr)
+	return &net.TCPAddr{IP: addr.IP.To4(), Port: addr.Port}
+}
+
+func TestOrchestrator(t *testing.T) {
+	// TF2 has two batches, and one server that never answers. L4D2 has one.
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	deadAddr := dead.LocalAddr().(*net.UDPAddr)
+
+	tf2 := []ServerList{
+		{newOrchestratorTestServer(t, "tf2 a", nil), newOrchestratorTestServer(t, "tf2 b", nil)},
+		{newOrchestratorTestServer(t, "tf2 c", nil), &net.TCPAddr{IP: deadAddr.IP.To4(), Port: deadAddr.Port}},
+	}
+	l4d2 := []ServerList{
+		{newOrchestratorTestServer(t, "l4d2 a", nil)},
+	}
+	lists := map[AppId]*mockMaster{
+		App_TF2:  {batches: tf2},
+		App_L4D2: {batches: l4d2},
+	}
+
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		for appId, list := range lists {
+			if strings.Contains(query.filter, fmt.Sprintf("\\appid\\%d", appId)) {
+				return list.batchReply(query)
+			}
+		}
+		return nil
+	})
+
+	newOrchestrator := func(sink OrchestratorSink) *Orchestrator {
+		orchestrator := NewOrchestrator(master.Addr(), []AppId{App_TF2, App_L4D2}, sink)
+		orchestrator.SetMasterSetup(func(master *MasterServerQuerier) {
+			master.SetRateLimit(0)
+			master.SetTimeout(time.Second)
+		})
+		orchestrator.SetQueryTimeout(time.Millisecond * 200)
+		orchestrator.SetQueryRate(1000)
+		return orchestrator
+	}
+
+	// The sink fails on the first server of TF2's second batch, as if the
+	// scan had crashed there.
+	sink := &memoryOrchestratorSink{failAddress: tf2[1][0].String()}
+	orchestrator := newOrchestrator(sink)
+	if err := orchestrator.Run(context.Background()); err != errTestSinkFailed {
+		t.Fatalf("expected the sink's error, got %v", err)
+	}
+	progress := orchestrator.Progress()
+	if progress.Checkpoints[App_TF2].Seed != tf2[0][1].String() || len(progress.Finished) != 0 {
+		t.Fatalf("expected a checkpoint after TF2's first batch, got %+v", progress)
+	}
+
+	// A new orchestrator picks up from the saved progress.
+	resumed := &memoryOrchestratorSink{}
+	orchestrator = newOrchestrator(resumed)
+	orchestrator.SetProgress(progress)
+	if err := orchestrator.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{tf2[1][0].String(), tf2[1][1].String(), l4d2[0][0].String()}
+	sort.Strings(expected)
+	if addresses := resumed.Addresses(); strings.Join(addresses, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected only the rest of the scan, %v, got %v", expected, addresses)
+	}
+	for _, server := range resumed.servers {
+		switch server.Address {
+		case tf2[1][1].String():
+			if server.Err == nil || server.Info != nil {
+				t.Errorf("expected the dead server to fail, got %+v", server)
+			}
+		default:
+			if server.Err != nil || server.Info == nil {
+				t.Errorf("expected an A2S_INFO reply, got %+v", server)
+			}
+		}
+	}
+
+	final := orchestrator.Progress()
+	if len(final.Finished) != 2 || final.Finished[0] != App_TF2 || final.Finished[1] != App_L4D2 {
+		t.Errorf("expected both apps to be finished, got %+v", final)
+	}
+	if last := resumed.progress[len(resumed.progress)-1]; len(last.Finished) != 2 {
+		t.Errorf("expected the final progress to be saved, got %+v", last)
+	}
+
+	summary := orchestrator.Summary()
+	if summary.Found != 3 || summary.Responded != 2 {
+		t.Errorf("expected 2 of 3 servers to respond, got %+v", summary)
+	}
+	if failures := orchestrator.Failures(); failures[FailureTimeout] != 1 {
+		t.Errorf("expected one timeout, got %v", failures)
+	}
+
+	// Running again does nothing, since everything is finished.
+	if err := orchestrator.Run(context.Background()); err != nil || len(resumed.Addresses()) != 3 {
+		t.Errorf("expected a finished scan not to run again, got %v", err)
+	}
+}
+
+func TestOrchestratorAppConcurrency(t *testing.T) {
+	appIds := []AppId{App_TF2, App_L4D2, App_CSS, App_HL2DM}
+	lists := map[AppId]*mockMaster{}
+	for _, appId := range appIds {
+		batches := []ServerList{}
+		for i := 0; i < 3; i++ {
+			batches = append(batches, ServerList{newOrchestratorTestServer(t, "server", nil)})
+		}
+		lists[appId] = &mockMaster{batches: batches}
+	}
+
+	// A scan is running from its first query until the master ends its list.
+	var lock sync.Mutex
+	running, peak := 0, 0
+	master := newMockMaster(t, nil)
+	master.SetRespond(func(query *mockQuery) [][]byte {
+		time.Sleep(time.Millisecond * 5)
+		for appId, list := range lists {
+			if !strings.Contains(query.filter, fmt.Sprintf("\\appid\\%d", appId)) {
+				continue
+			}
+			lock.Lock()
+			if query.seed == "0.0.0.0:0" {
+				if running++; running > peak {
+					peak = running
+				}
+			} else if query.seed == list.batches[1][0].String() {
+				running--
+			}
+			lock.Unlock()
+			return list.batchReply(query)
+		}
+		return nil
+	})
+
+	sink := &memoryOrchestratorSink{}
+	orchestrator := NewOrchestrator(master.Addr(), appIds, sink)
+	orchestrator.SetMasterSetup(func(master *MasterServerQuerier) {
+		master.SetRateLimit(0)
+		master.SetTimeout(time.Second)
+	})
+	orchestrator.SetAppConcurrency(2)
+	if err := orchestrator.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if peak != 2 {
+		t.Errorf("expected 2 app ids to be scanned at once, saw %d", peak)
+	}
+	if found := len(sink.Addresses()); found != 12 {
+		t.Errorf("expected 12 servers, got %d", found)
+	}
+	if finished := orchestrator.Progress().Finished; len(finished) != 4 {
+		t.Errorf("expected every app id to be finished, got %v", finished)
+	}
+}
+
+func TestOrchestratorQueryPortOffsets(t *testing.T) {
+	// The listed port is bound but silent, and the server answers on the
+	// port after it.
+	var silent net.PacketConn
+	var server *mockServer
+	for server == nil {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		next, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", port+1))
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		silent = conn
+		server = &mockServer{conn: next, respond: respondToInfo(encodeSourceInfo(makeTestInfo()))}
+	}
+	defer silent.Close()
+	defer server.conn.Close()
+	go server.serve()
+
+	listed := silent.LocalAddr().(*net.UDPAddr)
+	listedAddr := &net.TCPAddr{IP: listed.IP.To4(), Port: listed.Port}
+	master := newMockMaster(t, []ServerList{{listedAddr}})
+
+	sink := &memoryOrchestratorSink{}
+	orchestrator := NewOrchestrator(master.Addr(), []AppId{App_TF2}, sink)
+	orchestrator.SetMasterSetup(func(master *MasterServerQuerier) {
+		master.SetRateLimit(0)
+		master.SetTimeout(time.Second)
+	})
+	orchestrator.SetQueryTimeout(time.Millisecond * 200)
+	orchestrator.SetQueryPortOffsets([]int{0, 1})
+	if err := orchestrator.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.servers) != 1 {
+		t.Fatalf("expected one server, got %d", len(sink.servers))
+	}
+	found := sink.servers[0]
+	if found.Err != nil || found.Info == nil {
+		t.Fatalf("expected the offset port to answer, got %v", found.Err)
+	}
+	if found.Address != listedAddr.String() {
+		t.Errorf("expected the listed address to be kept, got %s", found.Address)
+	}
+	if found.QueryAddress != server.Addr() {
+		t.Errorf("expected the query address to be %s, got %s", server.Addr(), found.QueryAddress)
+	}
+	if len(server.Requests()) != 1 {
+		t.Errorf("expected one query on the offset port, got %d", len(server.Requests()))
+	}
+}
+
+func TestOrchestratorResultFilter(t *testing.T) {
+	dustbowl := newOrchestratorTestServer(t, "dustbowl", func(info *ServerInfo) { info.MapName = "cp_dustbowl" })
+	badlands := newOrchestratorTestServer(t, "badlands", func(info *ServerInfo) { info.MapName = "cp_badlands" })
+	twofort := newOrchestratorTestServer(t, "2fort", func(info *ServerInfo) { info.MapName = "ctf_2fort" })
+	master := newMockMaster(t, []ServerList{{dustbowl, badlands, twofort}})
+
+	sink := &memoryOrchestratorSink{}
+	orchestrator := NewOrchestrator(master.Addr(), []AppId{App_TF2}, sink)
+	orchestrator.SetMasterSetup(func(master *MasterServerQuerier) {
+		master.SetRateLimit(0)
+		master.SetTimeout(time.Second)
+	})
+	orchestrator.SetResultFilter(func(info *ServerInfo) bool {
+		return strings.HasPrefix(info.MapName, "cp_")
+	})
+	if err := orchestrator.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{dustbowl.String(), badlands.String()}
+	sort.Strings(expected)
+	if addresses := sink.Addresses(); strings.Join(addresses, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected only the cp_ servers, %v, got %v", expected, addresses)
+	}
+	if summary := orchestrator.Summary(); summary.Responded != 3 {
+		t.Errorf("expected filtered servers to still be counted, got %+v", summary)
+	}
+}
+
+func TestOrchestratorAppIdMismatch(t *testing.T) {
+	honest := newOrchestratorTestServer(t, "tf2", nil)
+	info := makeTestInfo()
+	info.Ext.AppId = App_CSGO
+	server := newMockServer(t, respondToInfo(encodeSourceInfo(info)))
+	spoofer := server.conn.LocalAddr().(*net.UDPAddr)
+	spooferAddr := &net.TCPAddr{IP: spoofer.IP.To4(), Port: spoofer.Port}
+	master := newMockMaster(t, []ServerList{{honest, spooferAddr}})
+
+	scan := func(reject bool) *memoryOrchestratorSink {
+		sink := &memoryOrchestratorSink{}
+		orchestrator := NewOrchestrator(master.Addr(), []AppId{App_TF2}, sink)
+		orchestrator.SetMasterSetup(func(master *MasterServerQuerier) {
+			master.SetRateLimit(0)
+			master.SetTimeout(time.Second)
+		})
+		orchestrator.SetRejectMismatchedAppIds(reject)
+		if err := orchestrator.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return sink
+	}
+
+	// By default, the spoofer is stored but flagged.
+	sink := scan(false)
+	if len(sink.servers) != 2 {
+		t.Fatalf("expected both servers, got %v", sink.Addresses())
+	}
+	for _, server := range sink.servers {
+		if mismatch := server.Address == spooferAddr.String(); server.AppIdMismatch != mismatch {
+			t.Errorf("expected AppIdMismatch to be %v for %s", mismatch, server.Address)
+		}
+	}
+
+	// Strictly, it's dropped.
+	sink = scan(true)
+	if addresses := sink.Addresses(); len(addresses) != 1 || addresses[0] != honest.String() {
+		t.Errorf("expected only the honest server, got %v", addresses)
+	}
+}
+
+func TestOrchestratorLocalAddrPool(t *testing.T) {
+	// All of 127.0.0.0/8 is local on Linux, but not everywhere else.
+	if conn, err := net.ListenPacket("udp", "127.0.0.2:0"); err != nil {
+		t.Skipf("can't bind to 127.0.0.2: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	info := encodeSourceInfo(makeTestInfo())
+	servers := ServerList{}
+	mocks := []*mockServer{}
+	for i := 0; i < 4; i++ {
+		server := newMockServer(t, respondToInfo(info))
+		addr := server.conn.LocalAddr().(*net.UDPAddr)
+		servers = append(servers, &net.TCPAddr{IP: addr.IP.To4(), Port: addr.Port})
+		mocks = append(mocks, server)
+	}
+	master := newMockMaster(t, []ServerList{servers})
+
+	sink := &memoryOrchestratorSink{}
+	orchestrator := NewOrchestrator(master.Addr(), []AppId{App_TF2}, sink)
+	orchestrator.SetMasterSetup(func(master *MasterServerQuerier) {
+		master.SetRateLimit(0)
+		master.SetTimeout(time.Second)
+	})
+	orchestrator.SetLocalAddrPool([]string{"127.0.0.1", "127.0.0.2"})
+	if err := orchestrator.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := map[string]int{}
+	for _, server := range mocks {
+		for _, source := range server.Sources() {
+			sources[source.(*net.UDPAddr).IP.String()]++
+		}
+	}
+	if sources["127.0.0.1"] != 2 || sources["127.0.0.2"] != 2 {
+		t.Errorf("expected queries to alternate between both addresses, got %v", sources)
+	}
+	for _, server := range sink.servers {
+		if server.Err != nil {
+			t.Errorf("expected %s to answer, got %v", server.Address, server.Err)
+		}
+	}
+}
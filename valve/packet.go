@@ -7,16 +7,54 @@ package valve
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const kMaxPacketSize = 1400
 
+// The largest UDP payload over IPv4.
+const kMaxDatagramSize = 65507
+
 var ErrOutOfBounds = errors.New("read out of bounds")
+var ErrEmbeddedNull = errors.New("string contains a null byte")
+var ErrResponseTruncated = errors.New("response was larger than the receive buffer")
+var ErrPortClosed = errors.New("nothing is listening on the remote port")
+
+// A parse error along with the packet that caused it, for bug reports. These
+// are only returned when packet dumps are enabled.
+type PacketError struct {
+	Err    error
+	Packet []byte
+}
+
+func (this *PacketError) Error() string {
+	return fmt.Sprintf("%v\n%s", this.Err, hex.Dump(this.Packet))
+}
+
+func (this *PacketError) Unwrap() error {
+	return this.Err
+}
+
+// Attach a dump of the packet to an error, if enabled.
+func withPacketDump(enabled bool, err error, packet []byte) error {
+	if err == nil || !enabled {
+		return err
+	}
+	return &PacketError{
+		Err:    err,
+		Packet: append([]byte{}, packet...),
+	}
+}
 
 type PacketBuilder struct {
 	bytes.Buffer
@@ -27,6 +65,16 @@ func (this *PacketBuilder) WriteCString(str string) {
 	this.WriteByte(0)
 }
 
+// Same as WriteCString, but refuses strings with embedded null bytes, since the
+// receiver would silently truncate them. Nothing is written on error.
+func (this *PacketBuilder) WriteCStringStrict(str string) error {
+	if strings.IndexByte(str, 0) != -1 {
+		return ErrEmbeddedNull
+	}
+	this.WriteCString(str)
+	return nil
+}
+
 func (this *PacketBuilder) WriteBytes(bytes []byte) {
 	this.Write(bytes)
 }
@@ -34,12 +82,24 @@ func (this *PacketBuilder) WriteBytes(bytes []byte) {
 type PacketReader struct {
 	buffer []byte
 	pos    int
+	order  binary.ByteOrder
 }
 
+// Create a reader for little-endian packets, which is everything Valve sends.
 func NewPacketReader(packet []byte) *PacketReader {
+	return NewPacketReaderOrder(packet, binary.LittleEndian)
+}
+
+// Same as NewPacketReader, but numbers are read in the given byte order. Ports
+// are always read in network order, as the master sends them.
+func NewPacketReaderOrder(packet []byte, order binary.ByteOrder) *PacketReader {
+	if order == nil {
+		order = binary.LittleEndian
+	}
 	return &PacketReader{
 		buffer: packet,
 		pos:    0,
+		order:  order,
 	}
 }
 
@@ -73,9 +133,11 @@ func (this *PacketReader) ReadIPv4() (net.IP, error) {
 		return nil, err
 	}
 
-	ip := net.IP(this.buffer[this.pos : this.pos+net.IPv4len])
+	// Copy so the address doesn't alias the packet, and keep it in 4-byte form.
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, this.buffer[this.pos:this.pos+net.IPv4len])
 	this.pos += net.IPv4len
-	return ip, nil
+	return ip.To4(), nil
 }
 
 func (this *PacketReader) ReadPort() (uint16, error) {
@@ -95,13 +157,13 @@ func (this *PacketReader) ReadUint8() uint8 {
 }
 
 func (this *PacketReader) ReadUint16() uint16 {
-	u16 := binary.LittleEndian.Uint16(this.buffer[this.pos:])
+	u16 := this.order.Uint16(this.buffer[this.pos:])
 	this.pos += 2
 	return u16
 }
 
 func (this *PacketReader) ReadUint32() uint32 {
-	u32 := binary.LittleEndian.Uint32(this.buffer[this.pos:])
+	u32 := this.order.Uint32(this.buffer[this.pos:])
 	this.pos += 4
 	return u32
 }
@@ -110,8 +172,12 @@ func (this *PacketReader) ReadInt32() int32 {
 	return int32(this.ReadUint32())
 }
 
+func (this *PacketReader) ReadFloat32() float32 {
+	return math.Float32frombits(this.ReadUint32())
+}
+
 func (this *PacketReader) ReadUint64() uint64 {
-	u64 := binary.LittleEndian.Uint64(this.buffer[this.pos:])
+	u64 := this.order.Uint64(this.buffer[this.pos:])
 	this.pos += 8
 	return u64
 }
@@ -146,16 +212,81 @@ func (this *PacketReader) More() bool {
 	return this.pos < len(this.buffer)
 }
 
+// Counters for traffic on a UdpSocket.
+type SocketStats struct {
+	BytesSent     int64
+	BytesReceived int64
+	Sends         int64
+	Recvs         int64
+	Timeouts      int64
+}
+
+func (this SocketStats) add(other SocketStats) SocketStats {
+	return SocketStats{
+		BytesSent:     this.BytesSent + other.BytesSent,
+		BytesReceived: this.BytesReceived + other.BytesReceived,
+		Sends:         this.Sends + other.Sends,
+		Recvs:         this.Recvs + other.Recvs,
+		Timeouts:      this.Timeouts + other.Timeouts,
+	}
+}
+
 type UdpSocket struct {
 	timeout time.Duration
-	cn      net.Conn
-	buffer  [kMaxPacketSize]byte
+	cn      net.PacketConn
+	remote  *net.UDPAddr
+	buffer  []byte
 	wait    time.Duration
 	next    time.Time
+	clock   clock
+
+	// Unconnected sockets see replies from anyone, so may check the source.
+	unconnected  bool
+	verifySource bool
+	ignorePort   bool
+	// Where the last packet an unconnected socket received came from.
+	source *net.UDPAddr
+
+	protocol SocketProtocol
+
+	statsLock sync.Mutex
+	stats     SocketStats
+
+	// Set for sockets that share a connection with others.
+	shared bool
+	// Set for sockets that count against SetMaxOpenSockets.
+	limited   bool
+	closeOnce sync.Once
 }
 
 func NewUdpSocket(address string, timeout time.Duration) (*UdpSocket, error) {
-	cn, err := net.Dial("udp", address)
+	return NewUdpSocketFamily(address, timeout, PreferIPv4)
+}
+
+// Create a socket, choosing between address families as given if the host
+// name has both.
+func NewUdpSocketFamily(address string, timeout time.Duration, family AddressFamily) (*UdpSocket, error) {
+	return newUdpSocket(address, "", timeout, family)
+}
+
+// Create a socket that sends from a local address, so that traffic leaves
+// through a particular interface. A bare IP is given any free port.
+func NewBoundUdpSocket(address string, localAddr string, timeout time.Duration) (*UdpSocket, error) {
+	return newUdpSocket(address, localAddr, timeout, PreferIPv4)
+}
+
+func newUdpSocket(address string, localAddr string, timeout time.Duration, family AddressFamily) (*UdpSocket, error) {
+	addr, err := ResolveUDPAddrFamily(address, family)
+	if err != nil {
+		return nil, err
+	}
+
+	laddr, err := resolveLocalAddr(localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	cn, err := net.DialUDP("udp", laddr, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -163,18 +294,129 @@ func NewUdpSocket(address string, timeout time.Duration) (*UdpSocket, error) {
 	return &UdpSocket{
 		timeout: timeout,
 		cn:      cn,
+		remote:  addr,
+		buffer:  make([]byte, kMaxPacketSize+1),
+		clock:   realClock{},
+	}, nil
+}
+
+// Resolve an address to bind to, or nil if it's empty. A bare IP is given any
+// free port.
+func resolveLocalAddr(localAddr string) (*net.UDPAddr, error) {
+	if localAddr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(localAddr); err != nil {
+		localAddr = net.JoinHostPort(localAddr, "0")
+	}
+	return net.ResolveUDPAddr("udp", localAddr)
+}
+
+// Create a socket that isn't connected to the remote address. The OS will not
+// filter replies by source, so by default the socket drops any reply that
+// isn't from the exact address it sends to.
+func NewUnconnectedUdpSocket(address string, timeout time.Duration) (*UdpSocket, error) {
+	return newUnconnectedUdpSocket(address, "", timeout)
+}
+
+func newUnconnectedUdpSocket(address string, localAddr string, timeout time.Duration) (*UdpSocket, error) {
+	addr, err := ResolveUDPAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := resolveLocalAddr(localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	cn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UdpSocket{
+		timeout:      timeout,
+		cn:           cn,
+		remote:       addr,
+		buffer:       make([]byte, kMaxPacketSize+1),
+		clock:        realClock{},
+		unconnected:  true,
+		verifySource: true,
+	}, nil
+}
+
+// Create a socket that talks to remote over a connection the caller already
+// has, such as one UDP socket shared by many queriers. Replies are routed to
+// each socket by their source address, so only one socket per remote address
+// may use conn at a time. Closing the socket leaves conn open; closing conn
+// ends every socket using it.
+func NewUdpSocketWithConn(conn net.PacketConn, remote net.Addr, timeout time.Duration) (*UdpSocket, error) {
+	addr, ok := remote.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if addr, err = ResolveUDPAddr(remote.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	route, err := openMuxRoute(conn, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UdpSocket{
+		timeout:      timeout,
+		cn:           route,
+		remote:       addr,
+		buffer:       make([]byte, kMaxPacketSize+1),
+		clock:        realClock{},
+		unconnected:  true,
+		verifySource: true,
+		shared:       true,
 	}, nil
 }
 
+// Sets whether an unconnected socket drops replies that don't come from the
+// address it sends to. Connected sockets always do, since the OS filters them.
+func (this *UdpSocket) SetVerifySource(verify bool) {
+	this.verifySource = verify
+}
+
+// Sets whether an unconnected socket that verifies sources accepts replies
+// from any port on the remote IP, for servers that answer from a port other
+// than the one they were queried on.
+func (this *UdpSocket) SetIgnoreSourcePort(ignore bool) {
+	this.ignorePort = ignore
+}
+
+// Set the largest packet that can be received, 1400 bytes by default. Larger
+// packets fail with ErrResponseTruncated.
+func (this *UdpSocket) SetMaxPacketSize(size int) {
+	// One spare byte tells a packet that exactly fits from one that was cut
+	// off.
+	if size+1 != len(this.buffer) {
+		this.buffer = make([]byte, size+1)
+	}
+}
+
+func (this *UdpSocket) MaxPacketSize() int {
+	return len(this.buffer) - 1
+}
+
 func (this *UdpSocket) SetTimeout(timeout time.Duration) {
 	this.timeout = timeout
 }
 
 func (this *UdpSocket) RemoteAddr() net.Addr {
-	return this.cn.RemoteAddr()
+	return this.remote
 }
 
+// Limit how many packets are sent per minute. Zero disables the limit.
 func (this *UdpSocket) SetRateLimit(ratePerMinute int) {
+	if ratePerMinute <= 0 {
+		this.wait = 0
+		return
+	}
 	this.wait = (time.Minute / time.Duration(ratePerMinute)) + time.Second
 }
 
@@ -187,19 +429,25 @@ func (this *UdpSocket) enforceRateLimit() {
 		return
 	}
 
-	wait := this.next.Sub(time.Now())
+	wait := this.next.Sub(this.clock.Now())
 	if wait > 0 {
-		time.Sleep(wait)
+		this.clock.Sleep(wait)
 	}
 }
 
 func (this *UdpSocket) setNextQueryTime() {
 	if this.wait != 0 {
-		this.next = time.Now().Add(this.wait)
+		this.next = this.clock.Now().Add(this.wait)
 	}
 }
 
 func (this *UdpSocket) Send(bytes []byte) error {
+	return this.sendTo(bytes, this.remote)
+}
+
+// Send to an address other than the remote one. This only works on an
+// unconnected socket.
+func (this *UdpSocket) sendTo(bytes []byte, addr *net.UDPAddr) error {
 	this.enforceRateLimit()
 	defer this.setNextQueryTime()
 
@@ -209,28 +457,152 @@ func (this *UdpSocket) Send(bytes []byte) error {
 	}
 
 	// UDP is all or nothing.
-	_, err := this.cn.Write(bytes)
+	var n int
+	var err error
+	if this.unconnected {
+		n, err = this.cn.WriteTo(bytes, addr)
+	} else {
+		n, err = this.cn.(net.Conn).Write(bytes)
+	}
+
+	this.statsLock.Lock()
+	this.stats.Sends++
+	this.stats.BytesSent += int64(n)
+	this.statsLock.Unlock()
+	return portClosedError(err)
+}
+
+// The OS turns an ICMP port unreachable into "connection refused" on the next
+// send or receive of a connected socket. Retrying won't help, so report it as
+// ErrPortClosed instead.
+func portClosedError(err error) error {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrPortClosed
+	}
 	return err
 }
 
+// Returns a snapshot of the socket's traffic counters.
+func (this *UdpSocket) Stats() SocketStats {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+	return this.stats
+}
+
 func (this *UdpSocket) Recv() ([]byte, error) {
+	return this.RecvContext(context.Background())
+}
+
+// Receive a packet, giving up early if the context is cancelled or its
+// deadline passes before the socket timeout does. The timeout starts over with
+// each call, so it applies to each fragment of a split reply rather than to the
+// whole reply.
+//
+// A packet larger than MaxPacketSize is cut off. The part that fit is
+// returned along with ErrResponseTruncated.
+func (this *UdpSocket) RecvContext(ctx context.Context) ([]byte, error) {
 	defer this.setNextQueryTime()
 
 	// Set timeout.
+	deadline := time.Time{}
 	if this.timeout > 0 {
-		this.cn.SetReadDeadline(this.extendedDeadline())
+		deadline = this.extendedDeadline()
+	}
+	ctxDeadline, hasCtxDeadline := ctx.Deadline()
+	if hasCtxDeadline && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	this.cn.SetReadDeadline(deadline)
+
+	// Wake up the read if the context is cancelled while we're blocked.
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		defer (func() {
+			close(stop)
+			<-exited
+		})()
+		go (func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				this.cn.SetReadDeadline(time.Now())
+			case <-stop:
+			}
+		})()
+	}
+
+	n, err := this.read()
+	if err != nil && ctx.Err() == context.Canceled {
+		return nil, ctx.Err()
+	}
+
+	// Reaching the context's deadline still counts as a timeout.
+	this.countRecv(n, err)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// The read deadline can pass just before the context's timer fires.
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && hasCtxDeadline && !time.Now().Before(ctxDeadline) {
+		return nil, context.DeadlineExceeded
 	}
 
-	n, err := this.cn.Read(this.buffer[0:kMaxPacketSize])
 	if err != nil {
-		return nil, err
+		return nil, portClosedError(err)
+	}
+
+	// The OS drops whatever didn't fit. Return what did, so that callers
+	// who can cope with that may look at it.
+	if n > this.MaxPacketSize() {
+		n = this.MaxPacketSize()
+		err = ErrResponseTruncated
 	}
 
 	buffer := make([]byte, n)
 	copy(buffer, this.buffer[:n])
-	return buffer, nil
+	return buffer, err
+}
+
+func (this *UdpSocket) read() (int, error) {
+	if !this.unconnected {
+		return this.cn.(net.Conn).Read(this.buffer)
+	}
+
+	for {
+		n, addr, err := this.cn.ReadFrom(this.buffer)
+		if err != nil {
+			return n, err
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if this.verifySource && (!ok || !from.IP.Equal(this.remote.IP) || (from.Port != this.remote.Port && !this.ignorePort)) {
+			// Not from the server we're talking to; keep waiting.
+			continue
+		}
+		this.source = from
+		return n, nil
+	}
+}
+
+func (this *UdpSocket) countRecv(n int, err error) {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			this.stats.Timeouts++
+		}
+		return
+	}
+	this.stats.Recvs++
+	this.stats.BytesReceived += int64(n)
 }
 
 func (this *UdpSocket) Close() {
-	this.cn.Close()
+	this.closeOnce.Do(func() {
+		this.cn.Close()
+		if this.limited {
+			sSocketLimit.release()
+		}
+	})
 }
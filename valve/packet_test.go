@@ -0,0 +1,336 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadIPv4(t *testing.T) {
+	packet := []byte{192, 168, 1, 20, 0, 0, 0, 0}
+	reader := NewPacketReader(packet)
+
+	ip, err := reader.ReadIPv4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ip) != net.IPv4len {
+		t.Errorf("expected a 4-byte address, got %d bytes", len(ip))
+	}
+	if ip.String() != "192.168.1.20" {
+		t.Errorf("expected 192.168.1.20, got %s", ip.String())
+	}
+
+	// The address must not change if the packet buffer is reused.
+	packet[0] = 10
+	if ip.String() != "192.168.1.20" {
+		t.Errorf("address aliases the packet buffer: %s", ip.String())
+	}
+
+	null, err := reader.ReadIPv4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !null.Equal(kNullIP) {
+		t.Errorf("expected the null address, got %s", null.String())
+	}
+}
+
+func TestReadPort(t *testing.T) {
+	// 27015 is 0x6987, sent in network order even by a little-endian reader.
+	reader := NewPacketReader([]byte{0x69, 0x87, 0x00})
+	port, err := reader.ReadPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 27015 {
+		t.Errorf("expected 27015, got %d", port)
+	}
+
+	// One byte isn't a port.
+	if _, err := reader.ReadPort(); err != ErrOutOfBounds {
+		t.Errorf("expected ErrOutOfBounds, got %v", err)
+	}
+
+	// A master batch decodes to the same port.
+	packet := append(append([]byte{}, HeaderMasterResponse...), 10, 0, 1, 1, 0x69, 0x87)
+	servers, _, err := ParseMasterResponse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].String() != "10.0.1.1:27015" {
+		t.Errorf("expected 10.0.1.1:27015, got %v", servers)
+	}
+}
+
+func TestPacketReaderByteOrder(t *testing.T) {
+	packet := []byte{0x01, 0x02, 0x01, 0x02, 0x03, 0x04}
+
+	little := NewPacketReader(packet)
+	if u16, u32 := little.ReadUint16(), little.ReadUint32(); u16 != 0x0201 || u32 != 0x04030201 {
+		t.Errorf("expected little-endian 0x0201 and 0x04030201, got %#x and %#x", u16, u32)
+	}
+
+	big := NewPacketReaderOrder(packet, binary.BigEndian)
+	if u16, u32 := big.ReadUint16(), big.ReadUint32(); u16 != 0x0102 || u32 != 0x01020304 {
+		t.Errorf("expected big-endian 0x0102 and 0x01020304, got %#x and %#x", u16, u32)
+	}
+
+	// No order means little-endian.
+	if u16 := NewPacketReaderOrder(packet, nil).ReadUint16(); u16 != 0x0201 {
+		t.Errorf("expected little-endian by default, got %#x", u16)
+	}
+}
+
+func TestWriteCStringStrict(t *testing.T) {
+	packet := PacketBuilder{}
+	if err := packet.WriteCStringStrict("bad\x00input"); err != ErrEmbeddedNull {
+		t.Errorf("expected ErrEmbeddedNull, got %v", err)
+	}
+	if packet.Len() != 0 {
+		t.Errorf("expected nothing to be written, got %v", packet.Bytes())
+	}
+
+	if err := packet.WriteCStringStrict("good"); err != nil {
+		t.Fatal(err)
+	}
+	if string(packet.Bytes()) != "good\x00" {
+		t.Errorf("unexpected packet: %v", packet.Bytes())
+	}
+
+	if _, err := ParseFilterString("\\map\\bad\x00input"); err != ErrEmbeddedNull {
+		t.Errorf("expected filters with null bytes to be rejected, got %v", err)
+	}
+}
+
+func TestSocketStats(t *testing.T) {
+	server := newMockServer(t, func(request []byte) [][]byte {
+		if string(request) == "silent" {
+			return nil
+		}
+		return [][]byte{append(request, request...)}
+	})
+
+	socket, err := NewUdpSocket(server.Addr(), time.Millisecond*100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	for _, message := range []string{"one", "three"} {
+		if err := socket.Send([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := socket.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := socket.Send([]byte("silent")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := socket.Recv(); err == nil {
+		t.Fatal("expected a timeout")
+	}
+
+	expected := SocketStats{
+		BytesSent:     14,
+		BytesReceived: 16,
+		Sends:         3,
+		Recvs:         2,
+		Timeouts:      1,
+	}
+	if stats := socket.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	// Running out of time on the context counts as a timeout too.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := socket.RecvContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if stats := socket.Stats(); stats.Timeouts != 2 {
+		t.Errorf("expected 2 timeouts, got %d", stats.Timeouts)
+	}
+}
+
+func TestUnconnectedSocketVerifiesSource(t *testing.T) {
+	// Replies come from a different socket than the one queried.
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go (func() {
+		buffer := make([]byte, kMaxPacketSize)
+		for {
+			n, addr, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			other.WriteTo(buffer[:n], addr)
+		}
+	})()
+
+	socket, err := NewUnconnectedUdpSocket(server.LocalAddr().String(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	if err := socket.Send([]byte("spoof")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := socket.Recv(); err == nil {
+		t.Errorf("expected a reply from the wrong source to be dropped")
+	}
+
+	socket.SetVerifySource(false)
+	if err := socket.Send([]byte("spoof")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := socket.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "spoof" {
+		t.Errorf("unexpected reply: %q", data)
+	}
+}
+
+func TestRecvDetectsTruncation(t *testing.T) {
+	server := newMockServer(t, func(request []byte) [][]byte {
+		return [][]byte{bytes.Repeat([]byte{'x'}, len(request))}
+	})
+
+	socket, err := NewUdpSocket(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	socket.SetMaxPacketSize(16)
+
+	// A reply that exactly fits is fine.
+	if err := socket.Send(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := socket.Recv(); err != nil || len(data) != 16 {
+		t.Fatalf("expected 16 bytes, got %d (%v)", len(data), err)
+	}
+
+	if err := socket.Send(make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := socket.Recv()
+	if err != ErrResponseTruncated {
+		t.Fatalf("expected ErrResponseTruncated, got %v", err)
+	}
+	if len(data) != 16 {
+		t.Errorf("expected the 16 bytes that fit, got %d", len(data))
+	}
+
+	// Queries fail the same way, rather than parsing a short reply.
+	info := makeTestInfo()
+	info.Name = strings.Repeat("long name ", 20)
+	server = newMockServer(t, respondToInfo(encodeSourceInfo(info)))
+	querier := newTestServerQuerier(t, server)
+	querier.socket.SetMaxPacketSize(64)
+	if _, err := querier.QueryInfo(); err != ErrResponseTruncated {
+		t.Fatalf("expected ErrResponseTruncated, got %v", err)
+	}
+	if querier.socket.MaxPacketSize() != kMaxDatagramSize {
+		t.Errorf("expected the buffer to grow, got %d bytes", querier.socket.MaxPacketSize())
+	}
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Errorf("expected the retry to succeed, got %v", err)
+	}
+}
+
+// A resolver that returns an IPv6 address, then an IPv4 one.
+type dualStackResolver struct{}
+
+func (dualStackResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.IPv4(192, 0, 2, 1)},
+	}, nil
+}
+
+func TestAddressFamilyPreference(t *testing.T) {
+	SetResolver(dualStackResolver{})
+	t.Cleanup(func() {
+		SetResolver(net.DefaultResolver)
+	})
+
+	cases := map[AddressFamily]string{
+		PreferIPv4:        "192.0.2.1",
+		PreferIPv6:        "2001:db8::1",
+		AddressFamilyAuto: "2001:db8::1",
+	}
+	for family, expected := range cases {
+		addr, err := ResolveUDPAddrFamily("dual.test:27015", family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.IP.String() != expected || addr.Port != 27015 {
+			t.Errorf("family %d: expected %s, got %s", family, expected, addr)
+		}
+	}
+
+	socket, err := NewUdpSocketFamily("dual.test:27015", time.Second, PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	if ip := socket.RemoteAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("expected the IPv4 address to be dialed, got %s", ip)
+	}
+}
+
+func TestValidateHostPort(t *testing.T) {
+	cases := []struct {
+		address  string
+		expected error
+	}{
+		{"1.2.3.4:27015", nil},
+		{"hl2master.steampowered.com:27011", nil},
+		{"[::1]:27015", nil},
+		{"1.2.3.4", ErrMissingPort},
+		{"1.2.3.4:", ErrMissingPort},
+		{":27015", ErrMissingHost},
+		{"1.2.3.4:http", ErrBadPort},
+		{"1.2.3.4:65536", ErrBadPort},
+		{"1.2.3.4:0", ErrBadPort},
+	}
+	for _, test := range cases {
+		err := ValidateHostPort(test.address)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.address, test.expected, err)
+		}
+	}
+
+	if _, err := NewServerQuerier("1.2.3.4", time.Second); !errors.Is(err, ErrMissingPort) {
+		t.Errorf("expected ErrMissingPort from NewServerQuerier, got %v", err)
+	}
+	if _, err := NewMasterServerQuerier("1.2.3.4:99999"); !errors.Is(err, ErrBadPort) {
+		t.Errorf("expected ErrBadPort from NewMasterServerQuerier, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// Source RCON packet types.
+const SERVERDATA_AUTH int32 = 3
+const SERVERDATA_AUTH_RESPONSE int32 = 2
+const SERVERDATA_RESPONSE_VALUE int32 = 0
+
+const kDefaultRconTimeout = time.Second * 5
+
+// The smallest and largest legal RCON frames, not counting the size field.
+const kMinRconFrame = 10
+const kMaxRconFrame = 4096
+
+// Check whether a TCP address speaks the Source RCON protocol. This sends a
+// SERVERDATA_AUTH request with an empty password and waits for a well-formed
+// reply frame; it never authenticates. Note that servers count this as a
+// failed login, and may ban addresses that check too often.
+//
+// Returns false with no error if the port is open but doesn't speak RCON.
+func CheckRCON(ctx context.Context, addr string) (bool, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, kDefaultRconTimeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	cn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false, err
+	}
+	defer cn.Close()
+
+	deadline, _ := ctx.Deadline()
+	cn.SetDeadline(deadline)
+
+	if _, err := cn.Write(buildRconPacket(1, SERVERDATA_AUTH, "")); err != nil {
+		return false, err
+	}
+
+	var size int32
+	if err := binary.Read(cn, binary.LittleEndian, &size); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	if size < kMinRconFrame || size > kMaxRconFrame {
+		return false, nil
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(cn, frame); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// The frame is an id, a type, a null-terminated body, and an empty string.
+	packetType := int32(binary.LittleEndian.Uint32(frame[4:8]))
+	if packetType != SERVERDATA_AUTH_RESPONSE && packetType != SERVERDATA_RESPONSE_VALUE {
+		return false, nil
+	}
+	if frame[len(frame)-2] != 0 || frame[len(frame)-1] != 0 {
+		return false, nil
+	}
+	return true, nil
+}
+
+func buildRconPacket(id int32, packetType int32, body string) []byte {
+	packet := PacketBuilder{}
+	binary.Write(&packet, binary.LittleEndian, int32(len(body)+kMinRconFrame))
+	binary.Write(&packet, binary.LittleEndian, id)
+	binary.Write(&packet, binary.LittleEndian, packetType)
+	packet.WriteCString(body)
+	packet.WriteByte(0)
+	return packet.Bytes()
+}
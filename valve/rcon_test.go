@@ -0,0 +1,71 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+// Accept one connection, read the auth request, and send back reply.
+func newMockRconServer(t *testing.T, reply []byte) (string, chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	requests := make(chan []byte, 1)
+	go (func() {
+		cn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer cn.Close()
+
+		request := make([]byte, 14)
+		if _, err := io.ReadFull(cn, request); err != nil {
+			return
+		}
+		requests <- request
+		cn.Write(reply)
+	})()
+	return listener.Addr().String(), requests
+}
+
+func TestCheckRCON(t *testing.T) {
+	// A failed auth response: id -1, type 2, empty body.
+	reply := buildRconPacket(-1, SERVERDATA_AUTH_RESPONSE, "")
+	addr, requests := newMockRconServer(t, reply)
+
+	ok, err := CheckRCON(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("expected the mock to speak RCON")
+	}
+
+	expected := []byte{10, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0, 0, 0}
+	if request := <-requests; !bytes.Equal(request, expected) {
+		t.Errorf("unexpected auth request: %v", request)
+	}
+
+	// Something that isn't RCON.
+	addr, _ = newMockRconServer(t, []byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+	ok, err = CheckRCON(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Errorf("expected a non-RCON reply to be rejected")
+	}
+}
@@ -0,0 +1,318 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Region codes for master server queries.
+const (
+	RegionUSEast       byte = 0x00
+	RegionUSWest       byte = 0x01
+	RegionSouthAmerica byte = 0x02
+	RegionEurope       byte = 0x03
+	RegionAsia         byte = 0x04
+	RegionAustralia    byte = 0x05
+	RegionMiddleEast   byte = 0x06
+	RegionAfrica       byte = 0x07
+	RegionAll          byte = 0xff
+)
+
+// Every individual region, in the order QueryAllRegions visits them.
+var Regions = []byte{
+	RegionUSEast,
+	RegionUSWest,
+	RegionSouthAmerica,
+	RegionEurope,
+	RegionAsia,
+	RegionAustralia,
+	RegionMiddleEast,
+	RegionAfrica,
+}
+
+// The errors from a best-effort QueryAllRegions, by region.
+type RegionErrors map[byte]error
+
+func (this RegionErrors) Error() string {
+	parts := []string{}
+	for _, region := range Regions {
+		if err, ok := this[region]; ok {
+			parts = append(parts, fmt.Sprintf("region %d: %v", region, err))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// If enabled, QueryAllRegions keeps going when a region fails, and returns the
+// failures together as RegionErrors once the other regions are done.
+func (this *MasterServerQuerier) SetBestEffortRegions(enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.bestEffort = enabled
+}
+
+// Query the master once per region and merge the results, so the callback
+// never sees the same server twice. Regions listed in hosts are queried on
+// that master instead (for example, a closer mirror); the rest use this
+// querier's master.
+//
+// Regions on the same master are queried one after another, since each master
+// is rate limited, but different masters are queried in parallel. Callbacks
+// are never run concurrently. Unless best-effort mode is enabled, the first
+// failure stops the whole query. The byte budget covers every master queried.
+func (this *MasterServerQuerier) QueryAllRegions(ctx context.Context, hosts map[byte]string, callback MasterQueryCallback) error {
+	this.lock.Lock()
+	bestEffort := this.bestEffort
+	dedup := this.dedup
+	maxBytes := this.maxBytes
+	self := this.hostAndPort
+	this.progress = Checkpoint{}
+	chunked, flush := chunkServers(callback, this.callbackBatch)
+	callback = this.limitBatches(this.limitServers(chunked))
+	this.lock.Unlock()
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Group the regions by master, keeping their order.
+	groups := map[string][]byte{}
+	masters := []string{}
+	for _, region := range Regions {
+		host := hosts[region]
+		if host == self {
+			host = ""
+		}
+		if _, ok := groups[host]; !ok {
+			masters = append(masters, host)
+		}
+		groups[host] = append(groups[host], region)
+	}
+
+	var lock sync.Mutex
+	var callbackErr, firstErr error
+	errs := RegionErrors{}
+	seen := map[string]bool{}
+	var received int64
+	merge := func(batch ServerList, bytes int64) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if callbackErr != nil {
+			return callbackErr
+		}
+		received += bytes
+
+		fresh := ServerList{}
+		for _, addr := range batch {
+			key := dedup.key(addr)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			fresh = append(fresh, addr)
+		}
+		err := callback(fresh)
+		if err == nil && maxBytes > 0 && received > maxBytes {
+			err = ErrByteBudgetExceeded
+		}
+		if err != nil {
+			callbackErr = err
+			cancel()
+			return err
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range masters {
+		wg.Add(1)
+		go func(host string, regions []byte) {
+			defer wg.Done()
+
+			for _, region := range regions {
+				if ctx.Err() != nil {
+					return
+				}
+
+				err := this.queryOneRegion(ctx, region, host, merge)
+				if err == nil {
+					continue
+				}
+
+				lock.Lock()
+				errs[region] = err
+				if firstErr == nil {
+					firstErr = err
+				}
+				lock.Unlock()
+
+				if !bestEffort {
+					cancel()
+					return
+				}
+			}
+		}(host, groups[host])
+	}
+	wg.Wait()
+
+	if err := flush(); err != nil {
+		return err
+	}
+	if callbackErr == errServerLimit {
+		return nil
+	}
+	if callbackErr != nil {
+		return callbackErr
+	}
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if !bestEffort {
+		return firstErr
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Sweep every region once, then query again any region that sent at least
+// nearLimit servers. The master caps how many servers one query returns, so
+// such a region was probably cut short. Each follow-up query starts after the
+// highest address the region has sent so far, and they continue until the
+// region comes back short or sends nothing new. The callback never sees the
+// same server twice. This only uses this querier's master.
+func (this *MasterServerQuerier) QueryRegionsWithRequery(ctx context.Context, nearLimit int, callback MasterQueryCallback) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	startAddress := this.startAddress
+	defer (func() {
+		this.startAddress = startAddress
+	})()
+
+	this.progress = Checkpoint{}
+	chunked, flush := chunkServers(callback, this.callbackBatch)
+	callback = this.limitBatches(this.limitBytes(this.limitServers(chunked)))
+
+	seen := map[string]bool{}
+	sweep := func(region byte, seed string) (int, *net.TCPAddr, error) {
+		count := 0
+		var highest *net.TCPAddr
+
+		this.startAddress = seed
+		err := this.queryRegion(ctx, region, func(batch ServerList) error {
+			fresh := ServerList{}
+			for _, addr := range batch {
+				count++
+				if highest == nil || compareAddrs(addr, highest) > 0 {
+					highest = addr
+				}
+				key := this.dedup.key(addr)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				fresh = append(fresh, addr)
+			}
+			return callback(fresh)
+		})
+		return count, highest, err
+	}
+
+	err := (func() error {
+		counts := map[byte]int{}
+		highest := map[byte]*net.TCPAddr{}
+		for _, region := range Regions {
+			count, last, err := sweep(region, startAddress)
+			if err != nil {
+				return err
+			}
+			counts[region], highest[region] = count, last
+		}
+
+		for _, region := range Regions {
+			for counts[region] >= nearLimit && highest[region] != nil {
+				count, last, err := sweep(region, highest[region].String())
+				if err != nil {
+					return err
+				}
+				if last == nil || compareAddrs(last, highest[region]) <= 0 {
+					break
+				}
+				counts[region], highest[region] = count, last
+			}
+		}
+		return nil
+	})()
+
+	if flushErr := flush(); flushErr != nil {
+		return flushErr
+	}
+	if err == errServerLimit {
+		return nil
+	}
+	return err
+}
+
+func (this *MasterServerQuerier) queryOneRegion(ctx context.Context, region byte, host string, callback func(batch ServerList, bytes int64) error) error {
+	this.lock.Lock()
+	querier := this
+	if host != "" {
+		other, err := this.clone(host)
+		this.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		defer other.Close()
+
+		querier = other
+		querier.lock.Lock()
+	}
+	defer querier.lock.Unlock()
+
+	// Pass on how many bytes arrived with each batch, so the caller can keep
+	// one budget across masters.
+	counter := querier.newReceivedCounter()
+	return querier.queryRegion(ctx, region, func(batch ServerList) error {
+		return callback(batch, counter.next())
+	})
+}
+
+// Create a separate querier for the given master, with our settings. This
+// must be called with the lock held.
+func (this *MasterServerQuerier) clone(host string) (*MasterServerQuerier, error) {
+	other, err := NewMasterServerQuerierProtocol(host, this.cn.protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	other.filters = this.filters
+	other.andFilters = this.andFilters
+	other.dumpPackets = this.dumpPackets
+	other.optimizeBatching = this.optimizeBatching
+	other.noTerminator = this.noTerminator
+	other.redial = this.redial
+	other.seedFromHighest = this.seedFromHighest
+	other.dedup = this.dedup
+	other.startAddress = this.startAddress
+	other.responseHeader = this.responseHeader
+	other.headerWindow = this.headerWindow
+	other.countPrefix = this.countPrefix
+	other.clientId = this.clientId
+	other.filterString = this.filterString
+	other.cn.timeout = this.cn.timeout
+	other.cn.wait = this.cn.wait
+	other.setClock(this.clock)
+	return other, nil
+}
@@ -0,0 +1,195 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long resolved host names are cached.
+const kDefaultDnsTtl = time.Minute
+
+// How long a single host name lookup may take.
+const kDefaultDnsTimeout = time.Second * 10
+
+var ErrNoAddresses = errors.New("host has no addresses")
+var ErrMissingHost = errors.New("address has no host")
+var ErrMissingPort = errors.New("address has no port")
+var ErrBadPort = errors.New("port must be a number from 1 to 65535")
+
+// Which address to use when a host name has both IPv4 and IPv6 addresses.
+type AddressFamily int
+
+const (
+	// Use an IPv4 address if there is one. This is the default.
+	PreferIPv4 AddressFamily = iota
+	// Use an IPv6 address if there is one.
+	PreferIPv6
+	// Use the first address the resolver returned.
+	AddressFamilyAuto
+)
+
+// Looks up the IP addresses of a host name. *net.Resolver implements this.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// A small cache in front of a Resolver, so that repeatedly creating sockets for
+// the same host (for example, the master server) doesn't hit DNS each time.
+type dnsCache struct {
+	lock     sync.Mutex
+	resolver Resolver
+	ttl      time.Duration
+	timeout  time.Duration
+	entries  map[string]*dnsCacheEntry
+
+	// Bumped when the resolver is replaced, so that a lookup which was already
+	// in flight doesn't store a result from the old resolver.
+	generation int
+}
+
+var sDnsCache = newDnsCache(net.DefaultResolver, kDefaultDnsTtl)
+
+func newDnsCache(resolver Resolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		resolver: resolver,
+		ttl:      ttl,
+		timeout:  kDefaultDnsTimeout,
+		entries:  map[string]*dnsCacheEntry{},
+	}
+}
+
+// Replace the resolver used for host names, and flush any cached results.
+func SetResolver(resolver Resolver) {
+	sDnsCache.lock.Lock()
+	defer sDnsCache.lock.Unlock()
+
+	sDnsCache.resolver = resolver
+	sDnsCache.entries = map[string]*dnsCacheEntry{}
+	sDnsCache.generation++
+}
+
+func (this *dnsCache) lookup(host string) ([]net.IPAddr, error) {
+	this.lock.Lock()
+	if entry, ok := this.entries[host]; ok && time.Now().Before(entry.expires) {
+		this.lock.Unlock()
+		return entry.addrs, nil
+	}
+	resolver := this.resolver
+	generation := this.generation
+	this.lock.Unlock()
+
+	// The lookup itself happens without the lock held, so one slow host
+	// doesn't hold up every other socket being created.
+	ctx, cancel := context.WithTimeout(context.Background(), this.timeout)
+	defer cancel()
+
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoAddresses
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.generation == generation {
+		this.entries[host] = &dnsCacheEntry{
+			addrs:   addrs,
+			expires: time.Now().Add(this.ttl),
+		}
+	}
+	return addrs, nil
+}
+
+// Drop any cached addresses for a host, so the next lookup asks the resolver.
+func (this *dnsCache) forget(host string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.entries, host)
+}
+
+// Check that a "host:port" string has a host and a numeric port in range,
+// without looking anything up. The queriers check this when they are created,
+// so a bad address fails early and clearly.
+func ValidateHostPort(hostAndPort string) error {
+	host, portString, err := net.SplitHostPort(hostAndPort)
+	if err != nil {
+		if !strings.Contains(hostAndPort, ":") {
+			return fmt.Errorf("%w: %q", ErrMissingPort, hostAndPort)
+		}
+		return fmt.Errorf("%q: %w", hostAndPort, err)
+	}
+	if host == "" {
+		return fmt.Errorf("%w: %q", ErrMissingHost, hostAndPort)
+	}
+	if portString == "" {
+		return fmt.Errorf("%w: %q", ErrMissingPort, hostAndPort)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("%w: %q", ErrBadPort, hostAndPort)
+	}
+	return nil
+}
+
+// Resolve a "host:port" string to a UDP address. Host names are looked up
+// through a short-lived cache, and IPv4 addresses are preferred.
+func ResolveUDPAddr(hostAndPort string) (*net.UDPAddr, error) {
+	return ResolveUDPAddrFamily(hostAndPort, PreferIPv4)
+}
+
+// Same as ResolveUDPAddr, but choosing between address families as given.
+func ResolveUDPAddrFamily(hostAndPort string, family AddressFamily) (*net.UDPAddr, error) {
+	host, portString, err := net.SplitHostPort(hostAndPort)
+	if err != nil {
+		return nil, err
+	}
+
+	// Literal addresses don't need a lookup.
+	if host == "" || net.ParseIP(host) != nil || strings.Contains(host, "%") {
+		return net.ResolveUDPAddr("udp", hostAndPort)
+	}
+
+	port, err := net.LookupPort("udp", portString)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := sDnsCache.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := addrs[0]
+	for _, candidate := range addrs {
+		isIPv4 := candidate.IP.To4() != nil
+		if (family == PreferIPv4 && isIPv4) || (family == PreferIPv6 && !isIPv4) {
+			addr = candidate
+			break
+		}
+	}
+	return &net.UDPAddr{
+		IP:   addr.IP,
+		Port: port,
+		Zone: addr.Zone,
+	}, nil
+}
@@ -0,0 +1,31 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"errors"
+	"net"
+)
+
+var ErrUnqueryableAddress = errors.New("address is a Steam relay placeholder and cannot be queried")
+
+// Servers that are only reachable through the Steam Datagram Relay are listed
+// by the master with a "fake IP" from the link-local range, which nothing
+// outside of Steam can reach.
+var kSdrFakeIPRange = &net.IPNet{
+	IP:   net.IPv4(169, 254, 0, 0).To4(),
+	Mask: net.CIDRMask(16, 32),
+}
+
+func isSdrPlaceholder(ip net.IP) bool {
+	return kSdrFakeIPRange.Contains(ip)
+}
+
+// Returns whether an address from the master is an SDR placeholder. Querying
+// one would only time out.
+func IsUnqueryable(addr *net.TCPAddr) bool {
+	return isSdrPlaceholder(addr.IP)
+}
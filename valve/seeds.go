@@ -0,0 +1,124 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Split Query and QueryContext into ranges that are paged through in parallel,
+// one starting at each seed and ending at the next. The master orders servers
+// by address, so seeds spread across the address space share the work on a
+// very large list. Include "0.0.0.0:0" to cover the start of the list. Each
+// range uses its own socket, and so its own rate limit. An empty list turns
+// this off.
+func (this *MasterServerQuerier) SetParallelSeeds(seeds []string) error {
+	addrs := []*net.TCPAddr{}
+	for _, seed := range seeds {
+		addr, err := parseSeedAddress(seed)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return compareAddrs(addrs[i], addrs[j]) < 0
+	})
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.parallelSeeds = addrs
+	return nil
+}
+
+// Order IPv4 addresses the way the master does: by IP, then by port.
+func compareAddrs(a *net.TCPAddr, b *net.TCPAddr) int {
+	if result := bytes.Compare(a.IP.To4(), b.IP.To4()); result != 0 {
+		return result
+	}
+	return a.Port - b.Port
+}
+
+// This must be called with the lock held.
+func (this *MasterServerQuerier) queryParallelSeeds(ctx context.Context, callback MasterQueryCallback) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queriers := []*MasterServerQuerier{}
+	defer (func() {
+		for _, other := range queriers {
+			other.Close()
+		}
+	})()
+	for i, seed := range this.parallelSeeds {
+		other, err := this.clone(this.hostAndPort)
+		if err != nil {
+			return err
+		}
+		other.startAddress = seed.String()
+		if i+1 < len(this.parallelSeeds) {
+			other.stopAddress = this.parallelSeeds[i+1]
+		}
+		queriers = append(queriers, other)
+	}
+
+	// Ranges don't overlap, but retried batches can repeat servers, so the
+	// merged list is still deduplicated.
+	var lock sync.Mutex
+	var firstErr error
+	seen := map[string]bool{}
+	merged := func(batch ServerList) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if firstErr != nil {
+			return firstErr
+		}
+
+		unique := ServerList{}
+		for _, addr := range batch {
+			key := this.dedup.key(addr)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			unique = append(unique, addr)
+		}
+		if len(unique) == 0 {
+			return nil
+		}
+		return callback(unique)
+	}
+
+	var wg sync.WaitGroup
+	for _, other := range queriers {
+		wg.Add(1)
+		go (func(other *MasterServerQuerier) {
+			defer wg.Done()
+
+			other.lock.Lock()
+			err := other.queryRegion(ctx, RegionAll, merged)
+			other.lock.Unlock()
+
+			if err != nil {
+				lock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				lock.Unlock()
+				cancel()
+			}
+		})(other)
+	}
+	wg.Wait()
+
+	return firstErr
+}
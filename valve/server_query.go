@@ -8,16 +8,20 @@ package valve
 import (
 	"bytes"
 	"compress/bzip2"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"net"
+	"strings"
 	"time"
 )
 
 var ErrBadPacketHeader = errors.New("bad packet header")
 var ErrMistakenReply = errors.New("mistaken reply")
 var ErrUnknownInfoVersion = errors.New("unknown A2S_INFO version")
+var ErrUnsupportedGoldSrcInfo = errors.New("unsupported GoldSrc A2S_INFO variant")
 var ErrImmediateRulesReply = errors.New("immediate rules reply")
 var ErrBadChallengeResponse = errors.New("bad challenge response")
 var ErrUnknownGameEngine = errors.New("must query A2S_INFO first")
@@ -25,55 +29,298 @@ var ErrDuplicatePacket = errors.New("received duplicate numbered packets")
 var ErrBadPacketNumber = errors.New("packet number is out of sequence")
 var ErrConfusedChallengeReply = errors.New("challenge reply is for the wrong query")
 var ErrBadRulesReply = errors.New("bad rules reply")
+var ErrBadPlayersReply = errors.New("bad players reply")
 var ErrWrongBz2Size = errors.New("bad bz2 decompression size")
 var ErrWrongBz2Checksum = errors.New("bad bz2 checksum")
+var ErrPartialResponse = errors.New("only part of the response was received")
+var ErrTruncatedPacket = errors.New("split packet was larger than the receive buffer")
+var ErrSharedConnection = errors.New("can't reconnect a querier on a shared connection")
+
+// The standard payload of an A2S_INFO request.
+const kInfoPayload = "Source Engine Query"
 
 // Always import fmt for debugging.
 var _ = fmt.Println
 
-// A ServerQuerier is used to issue A2S queries against an HL1/HL2 server.
+// A ServerQuerier is used to issue A2S queries against an HL1/HL2 server. Its
+// socket stays open between queries, so one querier can be used to poll a
+// server repeatedly.
 type ServerQuerier struct {
-	socket  *UdpSocket
-	timeout time.Duration
-	info    *ServerInfo
+	hostAndPort string
+	localAddr   string
+	anyPort     bool
+	socket      *UdpSocket
+	timeout     time.Duration
+	info        *ServerInfo
+	infoPayload string
+	partial     bool
+	botsByCount bool
+	dumpPackets bool
+
+	// The last challenge the server sent, reused for later queries.
+	challenge      []byte
+	challengeCache *ChallengeCache
+
+	// The player count from the last A2S_PLAYER reply.
+	declaredPlayers int
+
+	timing QueryTiming
+
+	edfHandler EDFHandler
+}
+
+// Where the time went in a querier's last A2S_INFO query, for telling a slow
+// handshake from a slow reply.
+type QueryTiming struct {
+	// Resolving the address and opening the socket, when the querier was
+	// created or last reconnected. Zero for queriers on a shared connection.
+	Dial time.Duration
+	// The round trip that fetched a challenge, or zero if none was needed.
+	Challenge time.Duration
+	// The round trip for the reply itself. This is the same as the ping.
+	Response time.Duration
 }
 
-// Create a new server querying object.
+// Parses the data for an unrecognized bit in an A2S_INFO reply's extra data
+// flags. The reader is positioned after every field the parser knows about.
+type EDFHandler func(bit byte, reader *PacketReader) error
+
+// Create a new server querying object. Steam relay placeholder addresses are
+// rejected with ErrUnqueryableAddress, without sending anything.
 func NewServerQuerier(hostAndPort string, timeout time.Duration) (*ServerQuerier, error) {
-	socket, err := NewUdpSocket(hostAndPort, timeout)
+	return NewBoundServerQuerier(hostAndPort, "", timeout)
+}
+
+// Same as NewServerQuerier, but queries are sent from the given local address
+// (see NewBoundUdpSocket). An empty address lets the OS choose.
+func NewBoundServerQuerier(hostAndPort string, localAddr string, timeout time.Duration) (*ServerQuerier, error) {
+	return NewBoundServerQuerierContext(context.Background(), hostAndPort, localAddr, timeout)
+}
+
+// Same as NewBoundServerQuerier, but waiting for a socket under
+// SetMaxOpenSockets stops when the context is done, with its error.
+func NewBoundServerQuerierContext(ctx context.Context, hostAndPort string, localAddr string, timeout time.Duration) (*ServerQuerier, error) {
+	start := time.Now()
+	if err := ValidateHostPort(hostAndPort); err != nil {
+		return nil, err
+	}
+	addr, err := ResolveUDPAddr(hostAndPort)
+	if err != nil {
+		return nil, err
+	}
+	if isSdrPlaceholder(addr.IP) {
+		return nil, ErrUnqueryableAddress
+	}
+
+	socket, err := openServerSocket(ctx, hostAndPort, localAddr, timeout, false)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerQuerier{
+		hostAndPort: hostAndPort,
+		localAddr:   localAddr,
+		socket:      socket,
+		timeout:     timeout,
+		infoPayload: kInfoPayload,
+		timing:      QueryTiming{Dial: time.Since(start)},
+	}, nil
+}
+
+// Create a querier that sends and receives over an existing connection, which
+// may be shared with other queriers for other servers (see
+// NewUdpSocketWithConn). Reconnect is not supported, since the connection
+// isn't ours to replace.
+func NewServerQuerierWithConn(conn net.PacketConn, remote net.Addr, timeout time.Duration) (*ServerQuerier, error) {
+	socket, err := NewUdpSocketWithConn(conn, remote, timeout)
 	if err != nil {
 		return nil, err
 	}
+	if isSdrPlaceholder(socket.remote.IP) {
+		socket.Close()
+		return nil, ErrUnqueryableAddress
+	}
 	return &ServerQuerier{
-		socket:  socket,
-		timeout: timeout,
+		hostAndPort: socket.remote.String(),
+		socket:      socket,
+		timeout:     timeout,
+		infoPayload: kInfoPayload,
 	}, nil
 }
 
+// Override the payload string sent with A2S_INFO requests. This is only
+// needed for engines that don't accept the standard "Source Engine Query".
+func (this *ServerQuerier) SetInfoPayload(payload string) {
+	this.infoPayload = payload
+}
+
+// Allow queries to return what they received when part of a split response
+// is lost. Such results are returned along with ErrPartialResponse.
+func (this *ServerQuerier) SetAllowPartial(allow bool) {
+	this.partial = allow
+}
+
+// If enabled, QueryInfoAndPlayers marks the last players in the list as bots,
+// as many as A2S_INFO says there are. Servers usually list bots after humans,
+// but nothing requires it, so this is only a guess, and it is off by default.
+func (this *ServerQuerier) SetGuessBotsFromCount(enabled bool) {
+	this.botsByCount = enabled
+}
+
+// Returns how long the last A2S_INFO query spent on each step.
+func (this *ServerQuerier) Timing() QueryTiming {
+	return this.timing
+}
+
+// Share challenges through a cache, such as one filled by
+// ChallengeCache.Prewarm. A2S_INFO is sent with the challenge the cache has
+// for this server, skipping the handshake, until it expires. New challenges
+// the server sends are stored back.
+func (this *ServerQuerier) SetChallengeCache(cache *ChallengeCache) {
+	this.challengeCache = cache
+	if challenge := cache.Get(this.socket.remote.String()); challenge != nil {
+		this.challenge = challenge
+	}
+}
+
+// Remember the challenge a server sent.
+func (this *ServerQuerier) setChallenge(data []byte) {
+	this.challenge = []byte{
+		data[5], data[6], data[7], data[8],
+	}
+	if this.challengeCache != nil {
+		this.challengeCache.Put(this.socket.remote.String(), this.challenge)
+	}
+}
+
+// Set a handler for extra data flag bits the parser doesn't know about. It is
+// called once per unknown bit, lowest first, after the known fields. By
+// default, unknown bits are ignored.
+func (this *ServerQuerier) SetUnknownEDFHandler(handler EDFHandler) {
+	this.edfHandler = handler
+}
+
+// If enabled, parse errors come back as a PacketError with a hex dump of the
+// packet. This is off by default, since the dump includes the whole reply.
+func (this *ServerQuerier) SetDumpPackets(enabled bool) {
+	this.dumpPackets = enabled
+}
+
+// Run a parser over a reply, catching panics so the packet can be attached to
+// the error.
+func (this *ServerQuerier) parseReply(packet []byte, parser func() error) error {
+	return withPacketDump(this.dumpPackets, Try(parser), packet)
+}
+
+// Set the largest split packet fragment to expect, 1400 bytes by default.
+// Source servers say how large their fragments are, and the receive buffer
+// grows to fit, but GoldSrc servers don't, so this is their only limit.
+func (this *ServerQuerier) SetFragmentSize(size int) {
+	this.socket.SetMaxPacketSize(size)
+}
+
+// Returns the traffic counters of the socket used to query.
+func (this *ServerQuerier) SocketStats() SocketStats {
+	return this.socket.Stats()
+}
+
+// Replace the socket with a new one, for example after a network error. The
+// address is resolved again, and socket stats start over. The old socket is
+// closed first, so reconnecting never holds two sockets open; if this fails,
+// queries fail until a later Reconnect succeeds.
+func (this *ServerQuerier) Reconnect() error {
+	if this.socket.shared {
+		return ErrSharedConnection
+	}
+
+	size := this.socket.MaxPacketSize()
+	this.socket.Close()
+
+	start := time.Now()
+	socket, err := openServerSocket(context.Background(), this.hostAndPort, this.localAddr, this.timeout, this.anyPort)
+	if err != nil {
+		return err
+	}
+	socket.SetIgnoreSourcePort(this.anyPort)
+	socket.SetMaxPacketSize(size)
+
+	this.socket = socket
+	this.challenge = nil
+	this.timing.Dial = time.Since(start)
+	return nil
+}
+
+// Open a socket for querying a server, counted against SetMaxOpenSockets.
+// Unconnected sockets accept replies from any port.
+func openServerSocket(ctx context.Context, hostAndPort string, localAddr string, timeout time.Duration, unconnected bool) (*UdpSocket, error) {
+	if err := sSocketLimit.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	var socket *UdpSocket
+	var err error
+	if unconnected {
+		socket, err = newUnconnectedUdpSocket(hostAndPort, localAddr, timeout)
+	} else {
+		socket, err = NewBoundUdpSocket(hostAndPort, localAddr, timeout)
+	}
+	if err != nil {
+		sSocketLimit.release()
+		return nil, err
+	}
+	socket.limited = true
+	return socket, nil
+}
+
+// Accept replies from any port on the server's IP, rather than only the port
+// that was queried. The OS drops such replies on a connected socket, so this
+// reconnects with an unconnected one (or back again).
+func (this *ServerQuerier) SetAcceptAnyReplyPort(enabled bool) error {
+	if this.anyPort == enabled {
+		return nil
+	}
+	if this.socket.shared {
+		return ErrSharedConnection
+	}
+	this.anyPort = enabled
+	return this.Reconnect()
+}
+
 // Close the socket used to query.
 func (this *ServerQuerier) Close() {
 	this.socket.Close()
 }
 
-// Query a server's info via A2S_INFO.
+// Query a server's info via A2S_INFO. The reply format (Source or GoldSrc) is
+// detected from its header, so either engine can be queried. The obsolete
+// GoldSrc 0x6C reply is recognized but not parsed, since its layout isn't
+// documented: if the server doesn't follow it with a normal reply, this fails
+// with ErrUnsupportedGoldSrcInfo.
 func (this *ServerQuerier) QueryInfo() (*ServerInfo, error) {
+	return this.QueryInfoContext(context.Background())
+}
+
+// Same as QueryInfo, but cancelling the context or reaching its deadline cuts
+// off any receive in progress, which then fails with the context's error. The
+// socket timeout still applies to each packet.
+func (this *ServerQuerier) QueryInfoContext(ctx context.Context) (*ServerInfo, error) {
 	this.info = &ServerInfo{
 		Address: this.socket.RemoteAddr().String(),
 	}
 
 	err := Try(func() error {
-		return this.a2s_info(this.info)
+		return this.a2s_info(ctx, this.info)
 	})
-	if err != nil && err != ErrMistakenReply {
+	mistaken := errors.Is(err, ErrMistakenReply) || errors.Is(err, ErrUnsupportedGoldSrcInfo)
+	if err != nil && !mistaken {
 		return nil, err
 	}
 
 	// Mysteriously, Half-Life 1 servers will often reply to an A2S_INFO with
 	// two extra packets: A2S_PLAYERS and then a newer A2S_INFO. We peek for
 	// up to three extra packets with a very small timeout.
-	if err == ErrMistakenReply || this.info.InfoVersion == S2A_INFO_GOLDSRC {
+	if mistaken || this.info.InfoVersion == S2A_INFO_GOLDSRC {
 		err := Try(func() error {
-			return this.check_bad_a2s_info(this.info)
+			return this.check_bad_a2s_info(ctx, this.info)
 		})
 		if err == nil {
 			return this.info, nil
@@ -86,16 +333,16 @@ func (this *ServerQuerier) QueryInfo() (*ServerInfo, error) {
 	return this.info, nil
 }
 
-func (this *ServerQuerier) check_bad_a2s_info(info *ServerInfo) error {
+func (this *ServerQuerier) check_bad_a2s_info(ctx context.Context, info *ServerInfo) error {
 	this.socket.SetTimeout(time.Millisecond * 250)
 	defer this.socket.SetTimeout(this.timeout)
 
-	data1, err := this.socket.Recv()
+	data1, err := this.recv(ctx)
 	if err != nil {
 		return err
 	}
 
-	data2, err := this.socket.Recv()
+	data2, err := this.recv(ctx)
 	if err != nil {
 		return err
 	}
@@ -107,43 +354,80 @@ func (this *ServerQuerier) check_bad_a2s_info(info *ServerInfo) error {
 	return this.parse_a2s_info_reply(this.info, data2)
 }
 
-func (this *ServerQuerier) a2s_info(info *ServerInfo) error {
-	var packet PacketBuilder
+func (this *ServerQuerier) buildInfoQuery() *PacketBuilder {
+	packet := &PacketBuilder{}
 	packet.WriteBytes([]byte{0xff, 0xff, 0xff, 0xff, A2S_INFO})
-	packet.WriteCString("Source Engine Query")
+	packet.WriteCString(this.infoPayload)
+	return packet
+}
+
+func (this *ServerQuerier) a2s_info(ctx context.Context, info *ServerInfo) error {
+	packet := this.buildInfoQuery()
+	if this.challengeCache != nil {
+		// A cached challenge usually gets the reply right away. If it expired,
+		// or the server changed it early, the server sends a new one as usual.
+		if challenge := this.challengeCache.Get(this.socket.remote.String()); challenge != nil {
+			packet.WriteBytes(challenge)
+		}
+	}
+	this.timing.Challenge = 0
+	this.timing.Response = 0
+
+	sent := time.Now()
 	if err := this.socket.Send(packet.Bytes()); err != nil {
 		return err
 	}
 
-	data, err := this.socket.Recv()
+	data, err := this.recv(ctx)
 	if err != nil {
 		return err
 	}
 
 	switch data[4] {
 	case S2C_CHALLENGE:
+		this.timing.Challenge = time.Since(sent)
 		// The newer protocol requires A2S_INFO requests to contain a challenge,
 		// servers that expected a challenge will have sent us a S2C_CHALLENGE response instead.
 		// Re-send the query with the challenge we received.
-		packet.WriteBytes([]byte{
-			data[5], data[6], data[7], data[8],
-		})
+		this.setChallenge(data)
+		packet = this.buildInfoQuery()
+		packet.WriteBytes(this.challenge)
+		sent = time.Now()
 		if err := this.socket.Send(packet.Bytes()); err != nil {
 			return err
 		}
 
-		data, err = this.socket.Recv()
+		data, err = this.recv(ctx)
 		if err != nil {
 			return err
 		}
 	}
 
-	return this.parse_a2s_info_reply(info, data)
+	info.Ping = time.Since(sent)
+	this.timing.Response = info.Ping
+
+	return this.parseReply(data, func() error {
+		return this.parse_a2s_info_reply(info, data)
+	})
+}
+
+// Check whether data starts with another reply: the simple packet marker
+// followed by a known response type. This is only meaningful where a field
+// could begin, since binary fields and names can contain the same bytes.
+func startsWithReply(data []byte) bool {
+	if len(data) <= 4 || int32(binary.LittleEndian.Uint32(data)) != PacketHeaderSimple {
+		return false
+	}
+	switch data[4] {
+	case S2A_INFO_SOURCE, S2A_INFO_GOLDSRC, S2A_PLAYER, S2A_RULES, S2C_CHALLENGE:
+		return true
+	}
+	return false
 }
 
 func (this *ServerQuerier) parse_a2s_info_reply(info *ServerInfo, data []byte) error {
 	reader := NewPacketReader(data)
-	if reader.ReadInt32() != -1 {
+	if reader.ReadInt32() != PacketHeaderSimple {
 		return ErrBadPacketHeader
 	}
 
@@ -156,11 +440,20 @@ func (this *ServerQuerier) parse_a2s_info_reply(info *ServerInfo, data []byte) e
 		return ErrMistakenReply
 	case S2A_INFO_SOURCE:
 		this.parseNewInfo(reader, info)
+		info.KnownAppName, _ = AppName(info.Ext.AppId)
 	case S2A_INFO_GOLDSRC:
 		this.parseOldInfo(reader, info)
+	case S2A_INFO_GOLDSRC_OLD:
+		// The layout of this reply isn't documented. The server usually
+		// follows it with a normal GoldSrc reply, which QueryInfo looks for.
+		return ErrUnsupportedGoldSrcInfo
 	default:
 		return ErrUnknownInfoVersion
 	}
+
+	if reader.More() {
+		info.Trailing = append([]byte{}, data[reader.Pos():]...)
+	}
 	return nil
 }
 
@@ -173,11 +466,31 @@ func (this *ServerQuerier) parseNewInfo(reader *PacketReader, info *ServerInfo)
 
 	// This gets extended later, potentially.
 	appId := AppId(reader.ReadUint16())
+	info.Ext = &ExtendedInfo{
+		AppId: appId,
+	}
 
 	info.Players = reader.ReadUint8()
 	info.MaxPlayers = reader.ReadUint8()
+
+	// A few non-standard servers cut the reply off somewhere after MaxPlayers.
+	// Keep what we have, leaving the rest as zero/unknown.
+	truncated := func() bool {
+		if reader.More() {
+			return false
+		}
+		info.Truncated = true
+		return true
+	}
+
+	if truncated() {
+		return
+	}
 	info.Bots = reader.ReadUint8()
 
+	if truncated() {
+		return
+	}
 	serverType := reader.ReadUint8()
 	switch serverType {
 	case uint8('l'):
@@ -188,19 +501,21 @@ func (this *ServerQuerier) parseNewInfo(reader *PacketReader, info *ServerInfo)
 		info.Type = ServerType_Unknown
 	}
 
-	serverOS := reader.ReadUint8()
-	switch serverOS {
-	case uint8('l'):
-		info.OS = ServerOS_Linux
-	case uint8('w'):
-		info.OS = ServerOS_Windows
-	case uint8('m'):
-		info.OS = ServerOS_Mac
-	default:
-		info.OS = ServerOS_Unknown
+	if truncated() {
+		return
 	}
+	info.RawOS = reader.ReadUint8()
+	info.OS = osFromByte(info.RawOS)
 
-	info.Visibility = reader.ReadUint8()
+	if truncated() {
+		return
+	}
+	info.RawVisibility = reader.ReadUint8()
+	info.Visibility = visibilityFromByte(info.RawVisibility)
+
+	if truncated() {
+		return
+	}
 	info.Vac = reader.ReadUint8()
 
 	// Read TheShip information.
@@ -211,8 +526,12 @@ func (this *ServerQuerier) parseNewInfo(reader *PacketReader, info *ServerInfo)
 		info.TheShip.Duration = reader.ReadUint8()
 	}
 
-	info.Ext = &ExtendedInfo{
-		AppId: appId,
+	// Old servers (such as early protocol 7 builds) end the reply here,
+	// without a game version or extra data flags. If another reply follows
+	// (for example, from a replayed packet), leave it as trailing data rather
+	// than reading it as the game version.
+	if !reader.More() || startsWithReply(reader.buffer[reader.pos:]) {
+		return
 	}
 
 	// Start reading extended information.
@@ -242,9 +561,20 @@ func (this *ServerQuerier) parseNewInfo(reader *PacketReader, info *ServerInfo)
 		// bits 0-23: true app id (original could be truncated)
 		// bits 24-31: type
 		// bits 32-63: mod id
-		info.Ext.AppId = AppId(gameId & uint64(0xffffffff))
+		info.Ext.AppId = AppId(gameId & uint64(0xffffff))
 		info.Ext.GameId = gameId
 	}
+
+	if this.edfHandler != nil {
+		for _, bit := range []byte{0x02, 0x04, 0x08} {
+			if (edf & bit) == 0 {
+				continue
+			}
+			if err := this.edfHandler(bit, reader); err != nil {
+				panic(err)
+			}
+		}
+	}
 }
 
 func (this *ServerQuerier) parseOldInfo(reader *PacketReader, info *ServerInfo) {
@@ -267,17 +597,11 @@ func (this *ServerQuerier) parseOldInfo(reader *PacketReader, info *ServerInfo)
 		info.Type = ServerType_Unknown
 	}
 
-	serverOS := reader.ReadUint8()
-	switch serverOS {
-	case uint8('l'):
-		info.OS = ServerOS_Linux
-	case uint8('w'):
-		info.OS = ServerOS_Windows
-	default:
-		info.OS = ServerOS_Unknown
-	}
+	info.RawOS = reader.ReadUint8()
+	info.OS = osFromByte(info.RawOS)
 
-	info.Visibility = reader.ReadUint8()
+	info.RawVisibility = reader.ReadUint8()
+	info.Visibility = visibilityFromByte(info.RawVisibility)
 
 	isMod := reader.ReadUint8()
 	if isMod == 1 {
@@ -291,31 +615,275 @@ func (this *ServerQuerier) parseOldInfo(reader *PacketReader, info *ServerInfo)
 		info.Mod.Dll = reader.ReadUint8()
 	}
 
+	// Unlike the Source reply, VAC comes after the mod fields rather than
+	// right after visibility.
 	info.Vac = reader.ReadUint8()
 	info.Bots = reader.ReadUint8()
 }
 
+// Query a server's info and player list together. The challenge from the
+// A2S_INFO handshake is reused for A2S_PLAYER, saving a round trip. If only one
+// of the queries succeeds, its result is returned along with a wrapped error
+// from the other.
+func (this *ServerQuerier) QueryInfoAndPlayers() (*ServerInfo, []Player, error) {
+	return this.QueryInfoAndPlayersContext(context.Background())
+}
+
+// Same as QueryInfoAndPlayers, but both queries stop when the context is done.
+func (this *ServerQuerier) QueryInfoAndPlayersContext(ctx context.Context) (*ServerInfo, []Player, error) {
+	info, infoErr := this.QueryInfoContext(ctx)
+	players, playersErr := this.QueryPlayersContext(ctx)
+
+	if infoErr != nil && playersErr != nil {
+		return nil, nil, infoErr
+	}
+	if infoErr != nil {
+		return nil, players, fmt.Errorf("info query failed: %w", infoErr)
+	}
+	if playersErr != nil {
+		return info, nil, fmt.Errorf("player query failed: %w", playersErr)
+	}
+	if this.botsByCount && int(info.Bots) <= len(players) {
+		for i := len(players) - int(info.Bots); i < len(players); i++ {
+			players[i].IsBot = true
+		}
+	}
+	return info, players, nil
+}
+
+// Send an A2S_PLAYER query to the server. Split replies can only be decoded
+// after A2S_INFO has been queried.
+//
+// Some servers hide their players, declaring a count but sending no entries.
+// This is not an error: the list is empty, and DeclaredPlayers returns the
+// count the server claimed.
+func (this *ServerQuerier) QueryPlayers() ([]Player, error) {
+	return this.QueryPlayersContext(context.Background())
+}
+
+// Same as QueryPlayers, but the query stops when the context is done.
+func (this *ServerQuerier) QueryPlayersContext(ctx context.Context) ([]Player, error) {
+	var players []Player
+	var err error
+
+	// Note: must assign |err| in case there's a panic.
+	err = Try(func() error {
+		players, err = this.queryPlayers(ctx)
+		return err
+	})
+
+	return players, err
+}
+
+func (this *ServerQuerier) queryPlayers(ctx context.Context) ([]Player, error) {
+	players, err := this.queryPlayersOnce(ctx)
+	if err == ErrTruncatedPacket || err == ErrResponseTruncated {
+		// The receive buffer has grown to fit, so ask again.
+		players, err = this.queryPlayersOnce(ctx)
+	}
+	return players, err
+}
+
+func (this *ServerQuerier) queryPlayersOnce(ctx context.Context) ([]Player, error) {
+	data, err := this.a2s_player(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var players []Player
+	switch int32(binary.LittleEndian.Uint32(data)) {
+	case PacketHeaderSimple:
+		err = this.parseReply(data, func() (err error) {
+			players, err = this.processPlayers(data, false)
+			return
+		})
+		return players, err
+	case PacketHeaderSplit:
+		full, compressed, partial, err := this.waitForMultiPacketReply(ctx, data)
+		if err != nil {
+			return nil, err
+		}
+		err = this.parseReply(full, func() (err error) {
+			players, err = this.processPlayers(full, compressed)
+			return
+		})
+		if err == nil && partial {
+			err = ErrPartialResponse
+		}
+		return players, err
+	default:
+		return nil, ErrBadPacketHeader
+	}
+}
+
+func (this *ServerQuerier) a2s_player(ctx context.Context) ([]byte, error) {
+	challenge := this.challenge
+	if challenge == nil {
+		challenge = []byte{0xff, 0xff, 0xff, 0xff}
+	}
+
+	// If we have a challenge from an earlier query, this usually gets the
+	// reply right away. Otherwise (or if it went stale), the server sends a
+	// new one and we try once more. Servers predating challenges reply to
+	// the first request, which is taken as is.
+	for attempt := 0; attempt < 2; attempt++ {
+		request := append([]byte{0xff, 0xff, 0xff, 0xff, A2S_PLAYER}, challenge...)
+		if err := this.socket.Send(request); err != nil {
+			return nil, err
+		}
+
+		data, err := this.recv(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 5 || int32(binary.LittleEndian.Uint32(data)) != PacketHeaderSimple {
+			return data, nil
+		}
+		if data[4] != S2C_CHALLENGE {
+			return data, nil
+		}
+		if len(data) < 9 {
+			return nil, ErrBadChallengeResponse
+		}
+		this.setChallenge(data)
+		challenge = this.challenge
+	}
+	return nil, ErrBadChallengeResponse
+}
+
+func (this *ServerQuerier) processPlayers(data []byte, compressed bool) ([]Player, error) {
+	if compressed {
+		decompressed, err := decompressPayload(data)
+		if err != nil {
+			return nil, err
+		}
+		data = decompressed
+	}
+
+	players, count, err := parsePlayers(data)
+	this.declaredPlayers = count
+
+	// The Ship lists more about each player after the usual fields.
+	if err == ErrPartialResponse && len(players) == count && this.info != nil && this.info.TheShip != nil {
+		err = nil
+	}
+
+	if this.info != nil && this.info.GameEngine() == GOLDSRC {
+		for i := range players {
+			players[i].IsBot = looksLikeGoldSrcBot(&players[i])
+		}
+	}
+	return players, err
+}
+
+// Name tags that bot plugins for GoldSrc mods commonly add.
+var kGoldSrcBotTags = []string{"[POD]", "[BOT]", "(BOT)", "[ZBOT]", "[SB]", "BOT "}
+
+// GoldSrc player lists don't say which players are bots, so guess: a name
+// with a well-known bot tag, or a nonzero score after exactly zero seconds
+// connected, which no real client manages. This misses bots with ordinary
+// names, and can be fooled by a human who picks a bot-like one.
+func looksLikeGoldSrcBot(player *Player) bool {
+	name := strings.ToUpper(player.Name)
+	for _, tag := range kGoldSrcBotTags {
+		if strings.HasPrefix(name, tag) || strings.HasSuffix(name, tag) {
+			return true
+		}
+	}
+	return player.Duration == 0 && player.Score != 0
+}
+
+// Decode an S2A_PLAYER reply, such as one captured earlier, starting from its
+// 0xffffffff header. Split replies must already be put back together.
+func ParsePlayers(payload []byte) ([]Player, error) {
+	var players []Player
+	err := Try(func() (err error) {
+		players, _, err = parsePlayers(payload)
+		return
+	})
+	return players, err
+}
+
+// Returns the players and the count the reply declared. Only players that fit
+// in the reply are read, up to the declared count. If the two disagree, the
+// players that were read come back with ErrPartialResponse. A count with no
+// players at all is a hidden player list, and isn't an error. This panics if
+// the header is cut short.
+func parsePlayers(data []byte) ([]Player, int, error) {
+	reader := NewPacketReader(data)
+	if reader.ReadInt32() != PacketHeaderSimple {
+		return nil, 0, ErrBadPacketHeader
+	}
+	if reader.ReadUint8() != S2A_PLAYER {
+		return nil, 0, ErrBadPlayersReply
+	}
+
+	count := int(reader.ReadUint8())
+
+	players := make([]Player, 0, count)
+	for len(players) < count && reader.More() {
+		player := Player{}
+		player.Index = reader.ReadUint8()
+		name, ok := reader.TryReadString()
+		if !ok || reader.canRead(8) != nil {
+			return players, count, ErrPartialResponse
+		}
+		player.Name = name
+		player.Score = reader.ReadInt32()
+		player.Duration = reader.ReadFloat32()
+		players = append(players, player)
+	}
+
+	if len(players) == 0 && !reader.More() {
+		return players, count, nil
+	}
+	if len(players) != count || reader.More() {
+		return players, count, ErrPartialResponse
+	}
+	return players, count, nil
+}
+
+// Returns the player count declared by the last A2S_PLAYER reply, which can
+// be more than the number of players actually listed.
+func (this *ServerQuerier) DeclaredPlayers() int {
+	return this.declaredPlayers
+}
+
 // Send an A2S_RULES query to the server. This returns a mapping of cvar names
 // to values.
-func (this *ServerQuerier) QueryRules() (map[string]string, error) {
-	var rules map[string]string
+func (this *ServerQuerier) QueryRules() (Rules, error) {
+	return this.QueryRulesContext(context.Background())
+}
+
+// Same as QueryRules, but the query stops when the context is done.
+func (this *ServerQuerier) QueryRulesContext(ctx context.Context) (Rules, error) {
+	var rules Rules
 	var err error
 
 	// Note: must assign |err| in case there's a panic.
 	err = Try(func() error {
-		rules, err = this.queryRules()
+		rules, err = this.queryRules(ctx)
 		return err
 	})
 
 	return rules, err
 }
 
-func (this *ServerQuerier) queryRules() (map[string]string, error) {
+func (this *ServerQuerier) queryRules(ctx context.Context) (Rules, error) {
+	rules, err := this.queryRulesOnce(ctx)
+	if err == ErrTruncatedPacket || err == ErrResponseTruncated {
+		// The receive buffer has grown to fit, so ask again.
+		rules, err = this.queryRulesOnce(ctx)
+	}
+	return rules, err
+}
+
+func (this *ServerQuerier) queryRulesOnce(ctx context.Context) (Rules, error) {
 	// Try to get a successful challenge.
 	rechallenges := 0
-	data, err := this.a2s_rules()
+	data, err := this.a2s_rules(ctx)
 	for err == ErrConfusedChallengeReply && rechallenges < 3 {
-		data, err = this.a2s_rules()
+		data, err = this.a2s_rules(ctx)
 		rechallenges++
 	}
 
@@ -324,21 +892,33 @@ func (this *ServerQuerier) queryRules() (map[string]string, error) {
 		return nil, err
 	}
 
+	var rules Rules
 	switch int32(binary.LittleEndian.Uint32(data)) {
-	case -1:
-		return this.processRules(data, false)
-	case -2:
-		full, compressed, err := this.waitForMultiPacketReply(data)
+	case PacketHeaderSimple:
+		err = this.parseReply(data, func() (err error) {
+			rules, err = this.processRules(data, false)
+			return
+		})
+		return rules, err
+	case PacketHeaderSplit:
+		full, compressed, partial, err := this.waitForMultiPacketReply(ctx, data)
 		if err != nil {
 			return nil, err
 		}
-		return this.processRules(full, compressed)
+		err = this.parseReply(full, func() (err error) {
+			rules, err = this.processRules(full, compressed)
+			return
+		})
+		if err == nil && partial {
+			err = ErrPartialResponse
+		}
+		return rules, err
 	default:
 		return nil, ErrBadPacketHeader
 	}
 }
 
-func (this *ServerQuerier) a2s_rules() ([]byte, error) {
+func (this *ServerQuerier) a2s_rules(ctx context.Context) ([]byte, error) {
 	data := []byte{
 		0xff, 0xff, 0xff, 0xff,
 		A2S_RULES,
@@ -348,18 +928,18 @@ func (this *ServerQuerier) a2s_rules() ([]byte, error) {
 		return nil, err
 	}
 
-	data, err := this.socket.Recv()
+	data, err := this.recv(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	switch int32(binary.LittleEndian.Uint32(data[0:4])) {
-	case -2:
+	case PacketHeaderSplit:
 		// AgeOfChivalry (appid 17510 had an instance of immediately reporting
 		// a rules reply in response to a challenge. Maybe in a rare case the
 		// server comes up with a -1 challenge?
 		return data, nil
-	case -1:
+	case PacketHeaderSimple:
 		// Ok, continue.
 	default:
 		panic(ErrBadPacketHeader)
@@ -389,7 +969,23 @@ func (this *ServerQuerier) a2s_rules() ([]byte, error) {
 	if err := this.socket.Send(reply); err != nil {
 		return nil, err
 	}
-	return this.socket.Recv()
+	return this.recv(ctx)
+}
+
+// Receive a packet. A fragment of a split reply that was cut off is kept,
+// since its header says how big the fragments are, and the reply is asked for
+// again once they've all arrived. Any other packet that was cut off can't be
+// used, so the buffer grows to fit any datagram before failing.
+func (this *ServerQuerier) recv(ctx context.Context) ([]byte, error) {
+	data, err := this.socket.RecvContext(ctx)
+	if err != ErrResponseTruncated {
+		return data, err
+	}
+	if len(data) >= 4 && int32(binary.LittleEndian.Uint32(data)) == PacketHeaderSplit {
+		return data, nil
+	}
+	this.socket.SetMaxPacketSize(kMaxDatagramSize)
+	return nil, ErrResponseTruncated
 }
 
 type MultiPacketHeader struct {
@@ -411,12 +1007,15 @@ type MultiPacketHeader struct {
 	// Compression information.
 	Compressed bool
 
+	// Whether the packet filled the receive buffer and may have been cut off.
+	Truncated bool
+
 	Payload []byte
 }
 
 func (this *ServerQuerier) decodeMultiPacketHeader(data []byte) *MultiPacketHeader {
 	reader := NewPacketReader(data)
-	if reader.ReadInt32() != -2 {
+	if reader.ReadInt32() != PacketHeaderSplit {
 		panic(ErrBadPacketHeader)
 	}
 	if this.info == nil {
@@ -438,6 +1037,14 @@ func (this *ServerQuerier) decodeMultiPacketHeader(data []byte) *MultiPacketHead
 		header.PacketNumber = reader.ReadUint8()
 		if !this.info.IsPreOrangeBox() {
 			header.PacketSize = reader.ReadUint16()
+
+			// The switch size is the most the server sends per fragment. If
+			// that doesn't fit in the receive buffer, this fragment may have
+			// been cut off, but later ones won't be.
+			if need := reader.Pos() + int(header.PacketSize); need > this.socket.MaxPacketSize() {
+				header.Truncated = len(data) >= this.socket.MaxPacketSize()
+				this.socket.SetMaxPacketSize(need)
+			}
 		}
 
 	default:
@@ -449,77 +1056,144 @@ func (this *ServerQuerier) decodeMultiPacketHeader(data []byte) *MultiPacketHead
 	return header
 }
 
-func (this *ServerQuerier) waitForMultiPacketReply(data []byte) ([]byte, bool, error) {
+// Collect the remaining packets of a split response and reassemble it. If
+// partial responses are allowed and some packets never arrive, the payload
+// contains the packets received in order up to the first missing one.
+//
+// Stragglers from an earlier, retried request may arrive on the same socket.
+// Packets are grouped by their sequence id, and the first complete group wins,
+// so stale packets are ignored rather than mixed into the reply.
+func (this *ServerQuerier) waitForMultiPacketReply(ctx context.Context, data []byte) ([]byte, bool, bool, error) {
 	header := this.decodeMultiPacketHeader(data)
-	packets := make([]*MultiPacketHeader, header.TotalPackets)
-	received := 0
-	fullSize := 0
+	groups := map[uint32][]*MultiPacketHeader{}
+	received := map[uint32]int{}
+	order := []uint32{}
+
+	var packets []*MultiPacketHeader
+	partial := false
 
 	for {
-		if int(header.PacketNumber) >= len(packets) {
+		group, ok := groups[header.Id]
+		if !ok {
+			group = make([]*MultiPacketHeader, header.TotalPackets)
+			groups[header.Id] = group
+			order = append(order, header.Id)
+		}
+
+		if int(header.PacketNumber) >= len(group) {
 			panic(ErrBadPacketNumber)
 		}
-		if packets[header.PacketNumber] != nil {
+		if group[header.PacketNumber] != nil {
 			panic(ErrDuplicatePacket)
 		}
 
-		packets[header.PacketNumber] = header
-		fullSize += len(header.Payload)
-		received++
+		group[header.PacketNumber] = header
+		received[header.Id]++
 
-		if received == len(packets) {
+		if received[header.Id] == len(group) {
+			packets = group
 			break
 		}
 
-		data, err := this.socket.Recv()
+		next, err := this.recvSplitPacket(ctx)
 		if err != nil {
-			return nil, false, err
+			// Use whichever group got furthest, if it can be used at all.
+			packets = longestPacketPrefix(groups, order)
+			if !this.partial || packets == nil || packets[0].Compressed {
+				return nil, false, false, err
+			}
+			partial = true
+			break
 		}
+		header = next
+	}
 
-		header = this.decodeMultiPacketHeader(data)
+	fullSize := 0
+	for _, header := range packets {
+		if header == nil {
+			break
+		}
+		if header.Truncated {
+			return nil, false, false, ErrTruncatedPacket
+		}
+		fullSize += len(header.Payload)
 	}
 
 	payload := make([]byte, fullSize)
 	cursor := 0
 	for _, header := range packets {
+		if header == nil {
+			break
+		}
 		copy(payload[cursor:cursor+len(header.Payload)], header.Payload)
 		cursor += len(header.Payload)
 	}
 
-	return payload, packets[0].Compressed, nil
+	return payload, packets[0].Compressed, partial, nil
 }
 
-func (this *ServerQuerier) processRules(data []byte, compressed bool) (map[string]string, error) {
-	reader := NewPacketReader(data)
-
-	if compressed {
-		decompressedSize := reader.ReadUint32()
-		checksum := reader.ReadUint32()
+// Receive the next packet of a split reply. Anything that isn't part of a split
+// reply is a stray, and is dropped.
+func (this *ServerQuerier) recvSplitPacket(ctx context.Context) (*MultiPacketHeader, error) {
+	for {
+		data, err := this.recv(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) >= 4 && int32(binary.LittleEndian.Uint32(data)) == PacketHeaderSplit {
+			return this.decodeMultiPacketHeader(data), nil
+		}
+	}
+}
 
-		// Sanity check so we don't allocate and zero 3GB of memory by accident.
-		if decompressedSize > uint32(1024*1024) {
-			return nil, ErrWrongBz2Size
+// Find the packet group with the most packets received in order from the
+// first one. Returns nil if no group has its first packet.
+func longestPacketPrefix(groups map[uint32][]*MultiPacketHeader, order []uint32) []*MultiPacketHeader {
+	var best []*MultiPacketHeader
+	bestCount := 0
+	for _, id := range order {
+		group := groups[id]
+		count := 0
+		for count < len(group) && group[count] != nil {
+			count++
+		}
+		if count > bestCount {
+			best, bestCount = group, count
 		}
+	}
+	return best
+}
 
-		decompressed := make([]byte, decompressedSize)
-		bz2Reader := bzip2.NewReader(bytes.NewReader(data[reader.Pos():]))
-		n, err := bz2Reader.Read(decompressed)
+func (this *ServerQuerier) processRules(data []byte, compressed bool) (Rules, error) {
+	if compressed {
+		decompressed, err := decompressPayload(data)
 		if err != nil {
 			return nil, err
 		}
-		if n != int(decompressedSize) {
-			return nil, ErrWrongBz2Size
-		}
-		if crc32.ChecksumIEEE(decompressed) != checksum {
-			return nil, ErrWrongBz2Checksum
-		}
 
 		// Switch to the decompressed stream.
 		data = decompressed
-		reader = NewPacketReader(data)
 	}
 
-	if reader.ReadInt32() != -1 {
+	return parseRules(data), nil
+}
+
+// Decode an S2A_RULES reply, such as one captured earlier, starting from its
+// 0xffffffff header. Split replies must already be put back together.
+func ParseRules(payload []byte) (Rules, error) {
+	var rules Rules
+	err := Try(func() error {
+		rules = parseRules(payload)
+		return nil
+	})
+	return rules, err
+}
+
+// This panics if the header is wrong.
+func parseRules(data []byte) Rules {
+	reader := NewPacketReader(data)
+
+	if reader.ReadInt32() != PacketHeaderSimple {
 		panic(ErrBadPacketHeader)
 	}
 	if reader.ReadUint8() != S2A_RULES {
@@ -528,7 +1202,7 @@ func (this *ServerQuerier) processRules(data []byte, compressed bool) (map[strin
 
 	count := int(reader.ReadUint16())
 
-	rules := map[string]string{}
+	rules := Rules{}
 	for i := 0; i < count; i++ {
 		key, ok := reader.TryReadString()
 		if !ok {
@@ -541,5 +1215,32 @@ func (this *ServerQuerier) processRules(data []byte, compressed bool) (map[strin
 		rules[key] = val
 	}
 
-	return rules, nil
+	return rules
+}
+
+// Decompress a bz2-compressed split reply, which starts with the decompressed
+// size and its checksum.
+func decompressPayload(data []byte) ([]byte, error) {
+	reader := NewPacketReader(data)
+	decompressedSize := reader.ReadUint32()
+	checksum := reader.ReadUint32()
+
+	// Sanity check so we don't allocate and zero 3GB of memory by accident.
+	if decompressedSize > uint32(1024*1024) {
+		return nil, ErrWrongBz2Size
+	}
+
+	decompressed := make([]byte, decompressedSize)
+	bz2Reader := bzip2.NewReader(bytes.NewReader(data[reader.Pos():]))
+	n, err := bz2Reader.Read(decompressed)
+	if err != nil {
+		return nil, err
+	}
+	if n != int(decompressedSize) {
+		return nil, ErrWrongBz2Size
+	}
+	if crc32.ChecksumIEEE(decompressed) != checksum {
+		return nil, ErrWrongBz2Checksum
+	}
+	return decompressed, nil
 }
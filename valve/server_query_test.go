@@ -0,0 +1,1583 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake game server on localhost, which answers each request through a
+// handler. Returning nil sends nothing.
+type mockServer struct {
+	conn    net.PacketConn
+	respond func(request []byte) [][]byte
+
+	lock     sync.Mutex
+	requests [][]byte
+	sources  []net.Addr
+	delay    time.Duration
+}
+
+func newMockServer(t *testing.T, respond func(request []byte) [][]byte) *mockServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &mockServer{
+		conn:    conn,
+		respond: respond,
+	}
+	go server.serve()
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return server
+}
+
+func (this *mockServer) Addr() string {
+	return this.conn.LocalAddr().String()
+}
+
+// Wait this long before sending each reply.
+func (this *mockServer) SetReplyDelay(delay time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.delay = delay
+}
+
+func (this *mockServer) Requests() [][]byte {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([][]byte{}, this.requests...)
+}
+
+// The address each request came from.
+func (this *mockServer) Sources() []net.Addr {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]net.Addr{}, this.sources...)
+}
+
+func (this *mockServer) serve() {
+	buffer := make([]byte, kMaxPacketSize)
+	for {
+		n, addr, err := this.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		request := append([]byte{}, buffer[:n]...)
+		this.lock.Lock()
+		this.requests = append(this.requests, request)
+		this.sources = append(this.sources, addr)
+		delay := this.delay
+		this.lock.Unlock()
+
+		for _, reply := range this.respond(request) {
+			time.Sleep(delay)
+			this.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// Create a querier for a mock server that already knows it's talking to a
+// Source game, so split packets can be decoded.
+func newTestServerQuerier(t *testing.T, server *mockServer) *ServerQuerier {
+	querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(querier.Close)
+
+	querier.info = &ServerInfo{
+		InfoVersion: S2A_INFO_SOURCE,
+		Ext: &ExtendedInfo{
+			AppId: App_TF2,
+		},
+	}
+	return querier
+}
+
+var kTestChallenge = []byte{0x0a, 0x0b, 0x0c, 0x0d}
+
+// Build a challenge reply.
+func encodeChallenge() []byte {
+	return append([]byte{0xff, 0xff, 0xff, 0xff, S2C_CHALLENGE}, kTestChallenge...)
+}
+
+// Build an S2A_RULES payload from key, value pairs.
+func encodeRules(pairs ...string) []byte {
+	packet := PacketBuilder{}
+	packet.WriteBytes([]byte{0xff, 0xff, 0xff, 0xff, S2A_RULES})
+	binary.Write(&packet, binary.LittleEndian, uint16(len(pairs)/2))
+	for _, str := range pairs {
+		packet.WriteCString(str)
+	}
+	return packet.Bytes()
+}
+
+// Split a payload into Source multi-packet fragments.
+func encodeSplitPackets(id uint32, payload []byte, count int) [][]byte {
+	packets := [][]byte{}
+	size := (len(payload) + count - 1) / count
+	for i := 0; i < count; i++ {
+		start, end := i*size, (i+1)*size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		packet := PacketBuilder{}
+		binary.Write(&packet, binary.LittleEndian, int32(-2))
+		binary.Write(&packet, binary.LittleEndian, id)
+		packet.WriteByte(byte(count))
+		packet.WriteByte(byte(i))
+		binary.Write(&packet, binary.LittleEndian, uint16(size))
+		packet.WriteBytes(payload[start:end])
+		packets = append(packets, packet.Bytes())
+	}
+	return packets
+}
+
+// Answer A2S_RULES requests with a challenge, and then with the given replies.
+func respondToRules(replies [][]byte) func(request []byte) [][]byte {
+	return func(request []byte) [][]byte {
+		if len(request) < 9 || request[4] != A2S_RULES {
+			return nil
+		}
+		if bytes.Equal(request[5:9], []byte{0xff, 0xff, 0xff, 0xff}) {
+			return [][]byte{encodeChallenge()}
+		}
+		return replies
+	}
+}
+
+func TestSetInfoPayload(t *testing.T) {
+	querier := &ServerQuerier{
+		infoPayload: kInfoPayload,
+	}
+
+	expected := append([]byte{0xff, 0xff, 0xff, 0xff, A2S_INFO}, []byte("Source Engine Query\x00")...)
+	if packet := querier.buildInfoQuery().Bytes(); !bytes.Equal(packet, expected) {
+		t.Errorf("unexpected default A2S_INFO packet: %v", packet)
+	}
+
+	querier.SetInfoPayload("Custom Engine Query")
+	expected = append([]byte{0xff, 0xff, 0xff, 0xff, A2S_INFO}, []byte("Custom Engine Query\x00")...)
+	if packet := querier.buildInfoQuery().Bytes(); !bytes.Equal(packet, expected) {
+		t.Errorf("unexpected custom A2S_INFO packet: %v", packet)
+	}
+}
+
+func TestQueryRulesPartial(t *testing.T) {
+	payload := encodeRules("a", "1", "b", "2", "c", "3", "d", "4")
+	packets := encodeSplitPackets(1, payload, 3)
+
+	// Drop the last of three packets.
+	server := newMockServer(t, respondToRules(packets[:2]))
+
+	querier := newTestServerQuerier(t, server)
+	if _, err := querier.QueryRules(); err == nil {
+		t.Errorf("expected an error without partial responses allowed")
+	}
+
+	querier.SetAllowPartial(true)
+	rules, err := querier.QueryRules()
+	if err != ErrPartialResponse {
+		t.Fatalf("expected ErrPartialResponse, got %v", err)
+	}
+	if rules["a"] != "1" || rules["b"] != "2" {
+		t.Errorf("expected rules from the received packets, got %v", rules)
+	}
+	if _, ok := rules["d"]; ok {
+		t.Errorf("did not expect rules from the missing packet, got %v", rules)
+	}
+
+	// A complete reply is not partial.
+	server = newMockServer(t, respondToRules(packets))
+	querier = newTestServerQuerier(t, server)
+	querier.SetAllowPartial(true)
+	rules, err = querier.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Errorf("expected 4 rules, got %v", rules)
+	}
+}
+
+func TestQueryRulesIgnoresStaleFragments(t *testing.T) {
+	stale := encodeSplitPackets(7, encodeRules("old", "stale", "older", "staler"), 2)
+	fresh := encodeSplitPackets(8, encodeRules("a", "1", "b", "2", "c", "3"), 3)
+
+	// A straggler from an earlier request arrives first, with an unrelated
+	// single-packet reply mixed in.
+	replies := [][]byte{stale[1], fresh[0], encodeChallenge(), fresh[1], fresh[2]}
+	server := newMockServer(t, respondToRules(replies))
+
+	querier := newTestServerQuerier(t, server)
+	rules, err := querier.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules["a"] != "1" || rules["c"] != "3" {
+		t.Errorf("expected rules from the fresh reply, got %v", rules)
+	}
+	if _, ok := rules["old"]; ok {
+		t.Errorf("stale fragment was mixed into the reply: %v", rules)
+	}
+}
+
+// Encode an S2A_INFO_SOURCE reply. Extra data fields are written for whichever
+// parts of info.Ext and info.SpecTv are set.
+func encodeSourceInfo(info *ServerInfo) []byte {
+	packet := PacketBuilder{}
+	packet.WriteBytes([]byte{0xff, 0xff, 0xff, 0xff, S2A_INFO_SOURCE})
+	packet.WriteByte(info.Protocol)
+	packet.WriteCString(info.Name)
+	packet.WriteCString(info.MapName)
+	packet.WriteCString(info.Folder)
+	packet.WriteCString(info.Game)
+	binary.Write(&packet, binary.LittleEndian, uint16(info.Ext.AppId))
+	packet.WriteByte(info.Players)
+	packet.WriteByte(info.MaxPlayers)
+	packet.WriteByte(info.Bots)
+	switch info.Type {
+	case ServerType_Listen:
+		packet.WriteByte('l')
+	default:
+		packet.WriteByte('d')
+	}
+	switch {
+	case info.RawOS != 0:
+		packet.WriteByte(info.RawOS)
+	case info.OS == ServerOS_Linux:
+		packet.WriteByte('l')
+	case info.OS == ServerOS_Mac:
+		packet.WriteByte('m')
+	default:
+		packet.WriteByte('w')
+	}
+	packet.WriteByte(info.RawVisibility)
+	packet.WriteByte(info.Vac)
+	if info.TheShip != nil {
+		packet.WriteByte(info.TheShip.Mode)
+		packet.WriteByte(info.TheShip.Witnesses)
+		packet.WriteByte(info.TheShip.Duration)
+	}
+	packet.WriteCString(info.Ext.GameVersion)
+
+	edf := byte(0)
+	if info.Ext.Port != 0 {
+		edf |= 0x80
+	}
+	if info.Ext.SteamId != 0 {
+		edf |= 0x10
+	}
+	if info.SpecTv != nil {
+		edf |= 0x40
+	}
+	if info.Ext.GameModeDescription != "" {
+		edf |= 0x20
+	}
+	if info.Ext.GameId != 0 {
+		edf |= 0x01
+	}
+	if edf == 0 {
+		return packet.Bytes()
+	}
+
+	packet.WriteByte(edf)
+	if edf&0x80 != 0 {
+		binary.Write(&packet, binary.LittleEndian, info.Ext.Port)
+	}
+	if edf&0x10 != 0 {
+		binary.Write(&packet, binary.LittleEndian, info.Ext.SteamId)
+	}
+	if edf&0x40 != 0 {
+		binary.Write(&packet, binary.LittleEndian, info.SpecTv.Port)
+		packet.WriteCString(info.SpecTv.Name)
+	}
+	if edf&0x20 != 0 {
+		packet.WriteCString(info.Ext.GameModeDescription)
+	}
+	if edf&0x01 != 0 {
+		binary.Write(&packet, binary.LittleEndian, info.Ext.GameId)
+	}
+	return packet.Bytes()
+}
+
+// A typical TF2 server.
+func makeTestInfo() *ServerInfo {
+	return &ServerInfo{
+		Protocol:   17,
+		Name:       "Test Server",
+		MapName:    "cp_dustbowl",
+		Folder:     "tf",
+		Game:       "Team Fortress",
+		Players:    12,
+		MaxPlayers: 24,
+		Bots:       2,
+		Type:       ServerType_Dedicated,
+		OS:         ServerOS_Linux,
+		Visibility: ServerVisibility_Public,
+		Vac:        1,
+		Ext: &ExtendedInfo{
+			AppId:       App_TF2,
+			GameVersion: "7648638",
+			Port:        27015,
+		},
+	}
+}
+
+func TestKnownAppName(t *testing.T) {
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(makeTestInfo())); err != nil {
+		t.Fatal(err)
+	}
+	if info.KnownAppName != "Team Fortress 2" {
+		t.Errorf("expected a known app name, got %q", info.KnownAppName)
+	}
+
+	if name, ok := AppName(App_CSGO); !ok || name != "Counter-Strike: Global Offensive" {
+		t.Errorf("unexpected name for CS:GO: %q", name)
+	}
+	if _, ok := AppName(AppId(123456789)); ok {
+		t.Errorf("expected an unknown AppId to have no name")
+	}
+}
+
+// Encode an S2A_INFO_GOLDSRC reply, without mod information.
+func encodeGoldSrcInfo(info *ServerInfo) []byte {
+	packet := PacketBuilder{}
+	packet.WriteBytes([]byte{0xff, 0xff, 0xff, 0xff, S2A_INFO_GOLDSRC})
+	packet.WriteCString(info.Address)
+	packet.WriteCString(info.Name)
+	packet.WriteCString(info.MapName)
+	packet.WriteCString(info.Folder)
+	packet.WriteCString(info.Game)
+	packet.WriteByte(info.Players)
+	packet.WriteByte(info.MaxPlayers)
+	packet.WriteByte(info.Protocol)
+	packet.WriteByte('d')
+	packet.WriteByte('l')
+	packet.WriteByte(info.RawVisibility)
+	packet.WriteByte(0)
+	packet.WriteByte(info.Vac)
+	packet.WriteByte(info.Bots)
+	return packet.Bytes()
+}
+
+// Answer A2S_INFO requests with the given replies.
+func respondToInfo(replies ...[]byte) func(request []byte) [][]byte {
+	return func(request []byte) [][]byte {
+		if len(request) < 5 || request[4] != A2S_INFO {
+			return nil
+		}
+		return replies
+	}
+}
+
+func TestQueryInfoGoldSrcReply(t *testing.T) {
+	reply := encodeGoldSrcInfo(&ServerInfo{
+		Address:    "192.168.1.20:27015",
+		Name:       "Old Server",
+		MapName:    "de_dust2",
+		Folder:     "cstrike",
+		Game:       "Counter-Strike",
+		Players:    5,
+		MaxPlayers: 32,
+		Protocol:   47,
+		Vac:        1,
+		Bots:       1,
+	})
+	server := newMockServer(t, respondToInfo(reply))
+
+	querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	info, err := querier.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.InfoVersion != S2A_INFO_GOLDSRC || info.GameEngine() != GOLDSRC {
+		t.Errorf("expected a GoldSrc reply, got version %x", info.InfoVersion)
+	}
+	if info.Name != "Old Server" || info.MapName != "de_dust2" || info.Players != 5 || info.Bots != 1 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestGoldSrcInfoVisibilityAndVac(t *testing.T) {
+	// The obsolete GoldSrc reply keeps visibility and VAC apart, with the mod
+	// fields between them.
+	packet := PacketBuilder{}
+	packet.WriteBytes([]byte{0xff, 0xff, 0xff, 0xff, S2A_INFO_GOLDSRC})
+	for _, field := range []string{"192.168.1.20:27015", "Old Server", "de_dust2", "cstrike", "Counter-Strike"} {
+		packet.WriteCString(field)
+	}
+	packet.WriteBytes([]byte{5, 32, 47, 'd', 'l'})
+	packet.WriteByte(1) // Private.
+	packet.WriteByte(1) // A mod follows.
+	packet.WriteCString("http://example.com")
+	packet.WriteCString("http://example.com/dl")
+	packet.WriteByte(0)
+	binary.Write(&packet, binary.LittleEndian, uint32(1))
+	binary.Write(&packet, binary.LittleEndian, uint32(1024))
+	packet.WriteBytes([]byte{0, 1})
+	packet.WriteByte(1) // VAC secured.
+	packet.WriteByte(2) // Bots.
+
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, packet.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if info.Visibility != ServerVisibility_Private || info.Vac != 1 {
+		t.Errorf("expected a private, VAC secured server, got visibility %v and VAC %d", info.Visibility, info.Vac)
+	}
+	if info.Mod == nil || info.Mod.Size != 1024 || info.Bots != 2 {
+		t.Errorf("unexpected mod info: %+v, %d bots", info.Mod, info.Bots)
+	}
+}
+
+func TestParseInfoWithoutGameVersion(t *testing.T) {
+	expected := makeTestInfo()
+	expected.Protocol = 7
+	expected.Ext = &ExtendedInfo{
+		AppId: App_CSS,
+	}
+
+	// Cut the reply off after the VAC byte.
+	reply := encodeSourceInfo(expected)
+	reply = reply[:len(reply)-1]
+
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, reply); err != nil {
+		t.Fatal(err)
+	}
+	if info.Protocol != 7 || info.Name != expected.Name || info.Vac != 1 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if info.Ext == nil || info.Ext.AppId != App_CSS || info.Ext.GameVersion != "" {
+		t.Errorf("unexpected extended info: %+v", info.Ext)
+	}
+}
+
+func TestParseTruncatedInfo(t *testing.T) {
+	expected := makeTestInfo()
+	reply := encodeSourceInfo(expected)
+
+	// Find the end of MaxPlayers: the header, protocol, four strings, the
+	// AppId and two player counts.
+	end := 6
+	for _, str := range []string{expected.Name, expected.MapName, expected.Folder, expected.Game} {
+		end += len(str) + 1
+	}
+	end += 4
+
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, reply[:end]); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Truncated {
+		t.Errorf("expected the reply to be flagged as truncated")
+	}
+	if info.Players != 12 || info.MaxPlayers != 24 || info.Bots != 0 {
+		t.Errorf("unexpected player counts: %d/%d (%d bots)", info.Players, info.MaxPlayers, info.Bots)
+	}
+	if info.Type != ServerType_Unknown || info.Ext.AppId != App_TF2 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+
+	// Cutting off inside the strings is still an error.
+	err := Try(func() error {
+		return (&ServerQuerier{}).parse_a2s_info_reply(&ServerInfo{}, reply[:10])
+	})
+	if err == nil {
+		t.Errorf("expected garbage to fail")
+	}
+
+	// A complete reply isn't truncated.
+	info = &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, reply); err != nil {
+		t.Fatal(err)
+	}
+	if info.Truncated || info.Bots != 2 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+// Build an S2A_PLAYER payload.
+func encodePlayers(players []Player) []byte {
+	packet := PacketBuilder{}
+	packet.WriteBytes([]byte{0xff, 0xff, 0xff, 0xff, S2A_PLAYER})
+	packet.WriteByte(byte(len(players)))
+	for _, player := range players {
+		packet.WriteByte(player.Index)
+		packet.WriteCString(player.Name)
+		binary.Write(&packet, binary.LittleEndian, player.Score)
+		binary.Write(&packet, binary.LittleEndian, player.Duration)
+	}
+	return packet.Bytes()
+}
+
+// Answer A2S_INFO and A2S_PLAYER requests, both of which need the challenge.
+// A nil info reply means A2S_INFO is ignored.
+func respondToInfoAndPlayers(info []byte, players []byte) func(request []byte) [][]byte {
+	return func(request []byte) [][]byte {
+		if len(request) < 5 {
+			return nil
+		}
+		switch request[4] {
+		case A2S_INFO:
+			if info == nil {
+				return nil
+			}
+			if !bytes.HasSuffix(request, kTestChallenge) {
+				return [][]byte{encodeChallenge()}
+			}
+			return [][]byte{info}
+		case A2S_PLAYER:
+			if !bytes.Equal(request[5:], kTestChallenge) {
+				return [][]byte{encodeChallenge()}
+			}
+			return [][]byte{players}
+		}
+		return nil
+	}
+}
+
+func TestQueryInfoAndPlayers(t *testing.T) {
+	expected := []Player{
+		{Index: 0, Name: "alice", Score: 12, Duration: 300.5},
+		{Index: 1, Name: "bob", Score: -3, Duration: 42},
+	}
+	server := newMockServer(t, respondToInfoAndPlayers(encodeSourceInfo(makeTestInfo()), encodePlayers(expected)))
+
+	querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	info, players, err := querier.QueryInfoAndPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != makeTestInfo().Name {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if !reflect.DeepEqual(players, expected) {
+		t.Errorf("expected players %+v, got %+v", expected, players)
+	}
+
+	// The challenge from A2S_INFO is reused, so A2S_PLAYER needs one request.
+	if requests := server.Requests(); len(requests) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(requests))
+	}
+}
+
+func TestQueryInfoAndPlayersWithoutInfo(t *testing.T) {
+	expected := []Player{
+		{Index: 0, Name: "alice", Score: 12, Duration: 300.5},
+	}
+	server := newMockServer(t, respondToInfoAndPlayers(nil, encodePlayers(expected)))
+
+	querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	info, players, err := querier.QueryInfoAndPlayers()
+	if err == nil {
+		t.Fatal("expected an error for the missing info reply")
+	}
+	if info != nil {
+		t.Errorf("expected no info, got %+v", info)
+	}
+	if !reflect.DeepEqual(players, expected) {
+		t.Errorf("expected players %+v, got %+v", expected, players)
+	}
+}
+
+func TestGuessBotsFromCount(t *testing.T) {
+	info := makeTestInfo()
+	info.Players = 5
+	info.Bots = 2
+	players := []Player{}
+	for i, name := range []string{"alice", "bob", "carol", "Bot01", "Bot02"} {
+		players = append(players, Player{Index: uint8(i), Name: name, Duration: 60})
+	}
+	server := newMockServer(t, respondToInfoAndPlayers(encodeSourceInfo(info), encodePlayers(players)))
+	querier := newTestServerQuerier(t, server)
+
+	_, result, err := querier.QueryInfoAndPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, player := range result {
+		if player.IsBot {
+			t.Errorf("expected no bots to be guessed by default, got %+v", player)
+		}
+	}
+
+	querier.SetGuessBotsFromCount(true)
+	_, result, err = querier.QueryInfoAndPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, player := range result {
+		if expected := i >= 3; player.IsBot != expected {
+			t.Errorf("expected %s to have IsBot %v", player.Name, expected)
+		}
+	}
+}
+
+func TestDumpPacketsOnInfoError(t *testing.T) {
+	reply := encodeSourceInfo(makeTestInfo())
+
+	// Cut the reply off inside the server name.
+	reply = reply[:10]
+	server := newMockServer(t, respondToInfo(reply))
+
+	querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	if _, err := querier.QueryInfo(); err == nil {
+		t.Fatal("expected an error")
+	} else if _, ok := err.(*PacketError); ok {
+		t.Errorf("expected no dump by default, got %v", err)
+	}
+
+	querier.SetDumpPackets(true)
+	_, err = querier.QueryInfo()
+	packetErr, ok := err.(*PacketError)
+	if !ok {
+		t.Fatalf("expected a PacketError, got %v", err)
+	}
+	if !bytes.Equal(packetErr.Packet, reply) {
+		t.Errorf("expected the dump to hold the reply, got %x", packetErr.Packet)
+	}
+	if !strings.Contains(err.Error(), "ff ff ff ff 49") {
+		t.Errorf("expected a hex dump in the message, got %q", err.Error())
+	}
+}
+
+func TestUnqueryableAddress(t *testing.T) {
+	placeholder := &net.TCPAddr{IP: net.IPv4(169, 254, 12, 34), Port: 27015}
+	if !IsUnqueryable(placeholder) {
+		t.Errorf("expected %s to be unqueryable", placeholder)
+	}
+	if IsUnqueryable(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 27015}) {
+		t.Errorf("expected a normal address to be queryable")
+	}
+
+	// No socket is created, so nothing goes out on the network.
+	querier, err := NewServerQuerier(placeholder.String(), time.Millisecond*200)
+	if err != ErrUnqueryableAddress || querier != nil {
+		t.Errorf("expected ErrUnqueryableAddress, got %v", err)
+	}
+}
+
+func TestSplitPacketsLargerThanDefault(t *testing.T) {
+	pairs := []string{}
+	for i := 0; i < 40; i++ {
+		pairs = append(pairs, fmt.Sprintf("rule%d", i), strings.Repeat("x", 100))
+	}
+	payload := encodeRules(pairs...)
+
+	// Each fragment is over 1700 bytes, with a matching switch size.
+	packets := encodeSplitPackets(1, payload, 3)
+	if len(packets[0]) <= kMaxPacketSize {
+		t.Fatalf("expected fragments larger than %d bytes", kMaxPacketSize)
+	}
+
+	server := newMockServer(t, respondToRules(packets))
+	querier := newTestServerQuerier(t, server)
+	rules, err := querier.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 40 || rules["rule39"] != strings.Repeat("x", 100) {
+		t.Errorf("expected 40 reassembled rules, got %d", len(rules))
+	}
+
+	// The first reply was cut off, then asked for again with a larger buffer.
+	if requests := server.Requests(); len(requests) != 4 {
+		t.Errorf("expected the rules to be queried twice, got %d requests", len(requests))
+	}
+
+	// GoldSrc fragments don't carry a size, so the limit must be configured.
+	goldSrc := [][]byte{}
+	for i, fragment := range packets {
+		packet := PacketBuilder{}
+		binary.Write(&packet, binary.LittleEndian, PacketHeaderSplit)
+		binary.Write(&packet, binary.LittleEndian, uint32(2))
+		packet.WriteByte(byte(i<<4 | len(packets)))
+		packet.WriteBytes(fragment[12:])
+		goldSrc = append(goldSrc, packet.Bytes())
+	}
+	server = newMockServer(t, respondToRules(goldSrc))
+	querier = newTestServerQuerier(t, server)
+	querier.info = &ServerInfo{InfoVersion: S2A_INFO_GOLDSRC}
+	querier.SetFragmentSize(2048)
+	rules, err = querier.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 40 {
+		t.Errorf("expected 40 reassembled GoldSrc rules, got %d", len(rules))
+	}
+}
+
+func TestSplitPacketTimeoutIsPerFragment(t *testing.T) {
+	payload := encodeRules("a", "1", "b", "2", "c", "3")
+	server := newMockServer(t, respondToRules(encodeSplitPackets(1, payload, 3)))
+
+	// Each reply fits in the 200ms timeout, but all three together don't.
+	server.SetReplyDelay(time.Millisecond * 120)
+
+	querier := newTestServerQuerier(t, server)
+	rules, err := querier.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Errorf("expected 3 rules, got %v", rules)
+	}
+}
+
+func TestNegativePlayerScore(t *testing.T) {
+	reply := encodePlayers([]Player{
+		{Index: 0, Name: "suicidal", Score: -5, Duration: 10},
+	})
+
+	players, err := (&ServerQuerier{}).processPlayers(reply, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(players) != 1 || players[0].Score != -5 {
+		t.Errorf("expected a score of -5, got %+v", players)
+	}
+}
+
+func TestInfoFolderAndGame(t *testing.T) {
+	for _, reply := range [][]byte{encodeSourceInfo(makeTestInfo()), encodeGoldSrcInfo(makeTestInfo())} {
+		info := &ServerInfo{}
+		if err := (&ServerQuerier{}).parse_a2s_info_reply(info, reply); err != nil {
+			t.Fatal(err)
+		}
+		if info.Folder != "tf" || info.Game != "Team Fortress" {
+			t.Errorf("expected folder \"tf\" and game \"Team Fortress\", got %q and %q", info.Folder, info.Game)
+		}
+	}
+}
+
+func TestQueryInfoReusesSocket(t *testing.T) {
+	server := newMockServer(t, respondToInfo(encodeSourceInfo(makeTestInfo())))
+
+	querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	socket := querier.socket
+	for i := 0; i < 3; i++ {
+		if _, err := querier.QueryInfo(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if querier.socket != socket || querier.SocketStats().Sends != 3 {
+		t.Errorf("expected all three queries on one socket, got %+v", querier.SocketStats())
+	}
+
+	if err := querier.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if querier.socket == socket {
+		t.Errorf("expected a new socket")
+	}
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseLegacyProtocolInfo(t *testing.T) {
+	// A pre-Orange Box Counter-Strike: Source reply, as protocol 7.
+	expected := makeTestInfo()
+	expected.Protocol = 7
+	expected.Name = "Legacy Server"
+	expected.MapName = "de_dust2"
+	expected.Folder = "cstrike"
+	expected.Game = "Counter-Strike: Source"
+	expected.Ext.AppId = App_CSS
+
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(expected)); err != nil {
+		t.Fatal(err)
+	}
+	if info.Protocol != 7 || info.Name != expected.Name || info.MapName != expected.MapName {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if info.Folder != expected.Folder || info.Game != expected.Game || info.Ext.AppId != App_CSS {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if !info.IsPreOrangeBox() {
+		t.Errorf("expected a pre-Orange Box server")
+	}
+}
+
+func TestParseConcatenatedReplies(t *testing.T) {
+	expected := makeTestInfo()
+	expected.Protocol = 7
+	expected.Ext = &ExtendedInfo{
+		AppId: App_CSS,
+	}
+
+	// An info reply without a game version, followed by a player reply.
+	reply := encodeSourceInfo(expected)
+	reply = reply[:len(reply)-1]
+	players := encodePlayers([]Player{{Name: "alice", Score: 3, Duration: 60}})
+	data := append(append([]byte{}, reply...), players...)
+
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, data); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != expected.Name || info.Vac != 1 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if info.Ext.GameVersion != "" {
+		t.Errorf("expected the player reply to be ignored, got version %q", info.Ext.GameVersion)
+	}
+	if !bytes.Equal(info.Trailing, players) {
+		t.Errorf("expected the player reply as trailing data, got %q", info.Trailing)
+	}
+}
+
+func TestParseInfoWithMarkerInFields(t *testing.T) {
+	// A name and a SteamID that contain the packet marker followed by a
+	// response type must not cut the reply short.
+	expected := makeTestInfo()
+	expected.Name = "\xff\xff\xff\xffI"
+	expected.Protocol = 17
+	expected.Ext = &ExtendedInfo{
+		AppId:       App_TF2,
+		GameVersion: "1.0",
+		SteamId:     0x49ffffffff,
+	}
+
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(expected)); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != expected.Name || info.Ext.GameVersion != "1.0" || info.Ext.SteamId != expected.Ext.SteamId {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if info.Trailing != nil {
+		t.Errorf("expected no trailing data, got %q", info.Trailing)
+	}
+}
+
+func TestQueryInfoOldGoldSrcReply(t *testing.T) {
+	old := []byte{0xff, 0xff, 0xff, 0xff, S2A_INFO_GOLDSRC_OLD, 'x', 0}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(&ServerInfo{}, old); err != ErrUnsupportedGoldSrcInfo {
+		t.Fatalf("expected ErrUnsupportedGoldSrcInfo, got %v", err)
+	}
+
+	// Alone, the reply fails with the targeted error.
+	server := newMockServer(t, respondToInfo(old))
+	querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+	if _, err := querier.QueryInfo(); err != ErrUnsupportedGoldSrcInfo {
+		t.Fatalf("expected ErrUnsupportedGoldSrcInfo, got %v", err)
+	}
+
+	// Followed by the usual extra packets, the newer reply is used.
+	reply := encodeGoldSrcInfo(&ServerInfo{
+		Address:    "192.168.1.20:27015",
+		Name:       "Old Server",
+		MapName:    "de_dust2",
+		Folder:     "cstrike",
+		Game:       "Counter-Strike",
+		Players:    5,
+		MaxPlayers: 32,
+		Protocol:   47,
+	})
+	server = newMockServer(t, respondToInfo(old, encodePlayers(nil), reply))
+	querier, err = NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	info, err := querier.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.InfoVersion != S2A_INFO_GOLDSRC || info.Name != "Old Server" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestQueryPlayersHiddenList(t *testing.T) {
+	// Declares four players, but lists none.
+	reply := []byte{0xff, 0xff, 0xff, 0xff, S2A_PLAYER, 4}
+	server := newMockServer(t, respondToInfoAndPlayers(nil, reply))
+	querier := newTestServerQuerier(t, server)
+
+	players, err := querier.QueryPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if players == nil || len(players) != 0 {
+		t.Errorf("expected an empty player list, got %+v", players)
+	}
+	if querier.DeclaredPlayers() != 4 {
+		t.Errorf("expected 4 declared players, got %d", querier.DeclaredPlayers())
+	}
+}
+
+func TestQueryPlayersWithoutChallenge(t *testing.T) {
+	// Old servers answer A2S_PLAYER straight away, without a challenge.
+	expected := []Player{
+		{Index: 0, Name: "alice", Score: 12, Duration: 300.5},
+	}
+	server := newMockServer(t, func(request []byte) [][]byte {
+		if len(request) < 5 || request[4] != A2S_PLAYER {
+			return nil
+		}
+		return [][]byte{encodePlayers(expected)}
+	})
+	querier := newTestServerQuerier(t, server)
+
+	players, err := querier.QueryPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(players, expected) {
+		t.Errorf("expected players %+v, got %+v", expected, players)
+	}
+	if requests := server.Requests(); len(requests) != 1 {
+		t.Errorf("expected a single request, got %d", len(requests))
+	}
+}
+
+func TestUnknownEDFHandler(t *testing.T) {
+	// Set an unknown bit in the flags, and add its field after the port.
+	reply := encodeSourceInfo(makeTestInfo())
+	reply[len(reply)-3] |= 0x02
+	reply = append(reply, 0x78, 0x56, 0x34, 0x12)
+
+	var bits []byte
+	var value uint32
+	querier := &ServerQuerier{}
+	querier.SetUnknownEDFHandler(func(bit byte, reader *PacketReader) error {
+		bits = append(bits, bit)
+		value = reader.ReadUint32()
+		return nil
+	})
+
+	info := &ServerInfo{}
+	if err := querier.parse_a2s_info_reply(info, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bits, []byte{0x02}) || value != 0x12345678 {
+		t.Errorf("unexpected handler calls: bits %v, value %x", bits, value)
+	}
+	if info.Ext.Port != 27015 {
+		t.Errorf("expected known fields to still parse, got port %d", info.Ext.Port)
+	}
+
+	failure := errors.New("bad field")
+	querier.SetUnknownEDFHandler(func(bit byte, reader *PacketReader) error {
+		return failure
+	})
+	err := Try(func() error {
+		return querier.parse_a2s_info_reply(&ServerInfo{}, reply)
+	})
+	if err != failure {
+		t.Errorf("expected the handler's error, got %v", err)
+	}
+}
+
+func TestSortByPing(t *testing.T) {
+	delays := []time.Duration{time.Millisecond * 60, 0, time.Millisecond * 30}
+
+	var infos []*ServerInfo
+	for i, delay := range delays {
+		expected := makeTestInfo()
+		expected.Name = fmt.Sprintf("server %d", i)
+		server := newMockServer(t, respondToInfo(encodeSourceInfo(expected)))
+		server.SetReplyDelay(delay)
+
+		querier := newTestServerQuerier(t, server)
+		info, err := querier.QueryInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Ping < delay {
+			t.Errorf("expected a ping of at least %s, got %s", delay, info.Ping)
+		}
+		infos = append(infos, info)
+	}
+
+	SortByPing(infos)
+	for i, name := range []string{"server 1", "server 2", "server 0"} {
+		if infos[i].Name != name {
+			t.Errorf("position %d: expected %s, got %s", i, name, infos[i].Name)
+		}
+	}
+}
+
+func TestQueryInfoChallengeInSamePacket(t *testing.T) {
+	// Since 2020, servers only answer A2S_INFO when the challenge comes right
+	// after the payload string, in the same packet.
+	query := append([]byte{0xff, 0xff, 0xff, 0xff, A2S_INFO}, []byte("Source Engine Query\x00")...)
+	withChallenge := append(append([]byte{}, query...), kTestChallenge...)
+
+	expected := makeTestInfo()
+	expected.Ext.AppId = App_CSGO
+	server := newMockServer(t, func(request []byte) [][]byte {
+		switch {
+		case bytes.Equal(request, query):
+			return [][]byte{encodeChallenge()}
+		case bytes.Equal(request, withChallenge):
+			return [][]byte{encodeSourceInfo(expected)}
+		}
+		return nil
+	})
+	querier := newTestServerQuerier(t, server)
+
+	info, err := querier.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != expected.Name || info.Ext.AppId != App_CSGO {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if requests := server.Requests(); len(requests) != 2 || !bytes.Equal(requests[1], withChallenge) {
+		t.Errorf("unexpected requests: %q", requests)
+	}
+}
+
+func TestServerQuerierContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	start := time.Now()
+	for i := range errs {
+		server := newMockServer(t, respondToInfo(encodeSourceInfo(makeTestInfo())))
+		server.SetReplyDelay(time.Second)
+
+		querier, err := NewServerQuerier(server.Addr(), time.Second*2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer querier.Close()
+
+		wg.Add(1)
+		go (func(i int) {
+			defer wg.Done()
+			_, errs[i] = querier.QueryInfoContext(ctx)
+		})(i)
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("expected queries to stop at the deadline, took %s", elapsed)
+	}
+	for i, err := range errs {
+		if err != context.DeadlineExceeded {
+			t.Errorf("query %d: expected context.DeadlineExceeded, got %v", i, err)
+		}
+	}
+
+	// A cancelled context stops player and rule queries too.
+	server := newMockServer(t, respondToInfo(encodeSourceInfo(makeTestInfo())))
+	querier, err := NewServerQuerier(server.Addr(), time.Second*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := querier.QueryPlayersContext(cancelled); err != context.Canceled {
+		t.Errorf("expected QueryPlayersContext to fail with context.Canceled, got %v", err)
+	}
+	if _, err := querier.QueryRulesContext(cancelled); err != context.Canceled {
+		t.Errorf("expected QueryRulesContext to fail with context.Canceled, got %v", err)
+	}
+}
+
+func TestQueryRulesPreservesControlCharacters(t *testing.T) {
+	motd := "Welcome!\n\tRules:\r\n\t1. Be nice\x07"
+	server := newMockServer(t, respondToRules([][]byte{encodeRules("sv_motd", motd, "sv_tags", "a,b")}))
+	querier := newTestServerQuerier(t, server)
+
+	rules, err := querier.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules["sv_motd"] != motd || rules["sv_tags"] != "a,b" {
+		t.Errorf("unexpected rules: %q", rules)
+	}
+}
+
+// Split a payload into GoldSrc multi-packet fragments, which pack the packet
+// number and count into one byte and carry no size.
+func encodeGoldSrcSplitPackets(id uint32, payload []byte, count int) [][]byte {
+	packets := [][]byte{}
+	size := (len(payload) + count - 1) / count
+	for i := 0; i < count; i++ {
+		start, end := i*size, (i+1)*size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		packet := PacketBuilder{}
+		binary.Write(&packet, binary.LittleEndian, PacketHeaderSplit)
+		binary.Write(&packet, binary.LittleEndian, id)
+		packet.WriteByte(byte(i<<4 | count))
+		packet.WriteBytes(payload[start:end])
+		packets = append(packets, packet.Bytes())
+	}
+	return packets
+}
+
+func TestGoldSrcPlayersAndRules(t *testing.T) {
+	info := encodeGoldSrcInfo(&ServerInfo{
+		Address:    "192.168.1.20:27015",
+		Name:       "HL1 Server",
+		MapName:    "de_dust2",
+		Folder:     "cstrike",
+		Game:       "Counter-Strike",
+		Players:    2,
+		MaxPlayers: 32,
+		Protocol:   48,
+	})
+	players := encodePlayers([]Player{
+		{Index: 0, Name: "alice", Score: 12, Duration: 300},
+		{Index: 1, Name: "bob", Score: 3, Duration: 45.5},
+	})
+	rules := encodeGoldSrcSplitPackets(7, encodeRules("mp_timelimit", "20", "sv_contact", "admin@example.com"), 2)
+
+	server := newMockServer(t, func(request []byte) [][]byte {
+		if len(request) < 5 {
+			return nil
+		}
+		switch request[4] {
+		case A2S_INFO:
+			return [][]byte{info}
+		case A2S_PLAYER:
+			if !bytes.Equal(request[5:], kTestChallenge) {
+				return [][]byte{encodeChallenge()}
+			}
+			return [][]byte{players}
+		case A2S_RULES:
+			return respondToRules(rules)(request)
+		}
+		return nil
+	})
+	querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if querier.info.GameEngine() != GOLDSRC {
+		t.Fatalf("expected a GoldSrc server")
+	}
+
+	list, err := querier.QueryPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "alice" || list[1].Duration != 45.5 {
+		t.Errorf("unexpected players: %+v", list)
+	}
+
+	values, err := querier.QueryRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["mp_timelimit"] != "20" || values["sv_contact"] != "admin@example.com" {
+		t.Errorf("unexpected rules: %q", values)
+	}
+}
+
+func TestInfoVisibility(t *testing.T) {
+	cases := map[uint8]ServerVisibility{
+		0: ServerVisibility_Public,
+		1: ServerVisibility_Private,
+		2: ServerVisibility_Unknown,
+	}
+	for raw, expected := range cases {
+		sent := makeTestInfo()
+		sent.RawVisibility = raw
+
+		info := &ServerInfo{}
+		if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(sent)); err != nil {
+			t.Fatal(err)
+		}
+		if info.Visibility != expected || info.RawVisibility != raw {
+			t.Errorf("visibility %d: expected %v, got %v (raw %d)", raw, expected, info.Visibility, info.RawVisibility)
+		}
+	}
+}
+
+func TestInfoEnvironment(t *testing.T) {
+	cases := map[uint8]ServerOS{
+		'l': ServerOS_Linux,
+		'w': ServerOS_Windows,
+		'm': ServerOS_Mac,
+		'o': ServerOS_Mac,
+		'x': ServerOS_Unknown,
+	}
+	for raw, expected := range cases {
+		sent := makeTestInfo()
+		sent.RawOS = raw
+
+		info := &ServerInfo{}
+		if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(sent)); err != nil {
+			t.Fatalf("environment %q: %v", raw, err)
+		}
+		if info.OS != expected || info.RawOS != raw {
+			t.Errorf("environment %q: expected %v, got %v (raw %q)", raw, expected, info.OS, info.RawOS)
+		}
+	}
+}
+
+func TestBoundServerQuerier(t *testing.T) {
+	info := makeTestInfo()
+	server := newMockServer(t, respondToInfo(encodeSourceInfo(info)))
+
+	// All of 127.0.0.0/8 is local on Linux, but not everywhere else.
+	querier, err := NewBoundServerQuerier(server.Addr(), "127.0.0.2", time.Millisecond*200)
+	if err != nil {
+		t.Skipf("can't bind to 127.0.0.2: %v", err)
+	}
+	defer querier.Close()
+
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := querier.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := querier.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+	sources := server.Sources()
+	if len(sources) == 0 {
+		t.Fatal("expected the server to see a request")
+	}
+	for _, source := range sources {
+		if ip := source.(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+			t.Errorf("expected requests from 127.0.0.2, got %v", ip)
+		}
+	}
+}
+
+func TestParsePlayers(t *testing.T) {
+	// Two players: "Bob" with 7 frags for 60 seconds, and "x" with -1 for 1.5.
+	payload := []byte{
+		0xff, 0xff, 0xff, 0xff, 0x44, 0x02,
+		0x00, 'B', 'o', 'b', 0x00, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x70, 0x42,
+		0x01, 'x', 0x00, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0xc0, 0x3f,
+	}
+	players, err := ParsePlayers(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Player{
+		{Index: 0, Name: "Bob", Score: 7, Duration: 60},
+		{Index: 1, Name: "x", Score: -1, Duration: 1.5},
+	}
+	if !reflect.DeepEqual(players, expected) {
+		t.Errorf("expected %+v, got %+v", expected, players)
+	}
+
+	if _, err := ParsePlayers(payload[:12]); err == nil {
+		t.Errorf("expected an error for a cut off reply")
+	}
+	if _, err := ParsePlayers(encodeRules()); err != ErrBadPlayersReply {
+		t.Errorf("expected ErrBadPlayersReply, got %v", err)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	payload := []byte{
+		0xff, 0xff, 0xff, 0xff, 0x45, 0x02, 0x00,
+		'm', 'p', '_', 't', 'i', 'm', 'e', 'l', 'i', 'm', 'i', 't', 0x00, '3', '0', 0x00,
+		's', 'v', '_', 't', 'a', 'g', 's', 0x00, 0x00,
+	}
+	rules, err := ParseRules(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rules, Rules{"mp_timelimit": "30", "sv_tags": ""}) {
+		t.Errorf("unexpected rules: %v", rules)
+	}
+
+	if _, err := ParseRules(encodePlayers(nil)); err != ErrBadRulesReply {
+		t.Errorf("expected ErrBadRulesReply, got %v", err)
+	}
+}
+
+func TestGoldSrcBotHeuristic(t *testing.T) {
+	players := encodePlayers([]Player{
+		{Index: 0, Name: "alice", Score: 12, Duration: 300},
+		{Index: 1, Name: "[POD]Grunt", Score: 4, Duration: 300},
+		{Index: 2, Name: "Gordon [BOT]", Score: 0, Duration: 120},
+		{Index: 3, Name: "Frank", Score: 7, Duration: 0},
+		{Index: 4, Name: "connecting", Score: 0, Duration: 0},
+		{Index: 5, Name: "Robot", Score: 1, Duration: 10},
+	})
+	expected := []bool{false, true, true, true, false, false}
+
+	for _, version := range []uint8{S2A_INFO_GOLDSRC, S2A_INFO_SOURCE} {
+		querier := &ServerQuerier{info: &ServerInfo{InfoVersion: version}}
+		if version == S2A_INFO_SOURCE {
+			querier.info.Ext = &ExtendedInfo{AppId: App_TF2}
+		}
+		list, err := querier.processPlayers(players, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, player := range list {
+			isBot := expected[i] && version == S2A_INFO_GOLDSRC
+			if player.IsBot != isBot {
+				t.Errorf("info version %x, %q: expected IsBot to be %v", version, player.Name, isBot)
+			}
+		}
+	}
+}
+
+func TestAcceptAnyReplyPort(t *testing.T) {
+	// Queries arrive on one port, and replies go out from another.
+	in, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	respond := respondToInfo(encodeSourceInfo(makeTestInfo()))
+	go (func() {
+		buffer := make([]byte, kMaxPacketSize)
+		for {
+			n, addr, err := in.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			for _, reply := range respond(buffer[:n]) {
+				out.WriteTo(reply, addr)
+			}
+		}
+	})()
+
+	querier, err := NewServerQuerier(in.LocalAddr().String(), time.Millisecond*100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	if _, err := querier.QueryInfo(); err == nil {
+		t.Fatalf("expected a connected socket to miss the reply")
+	}
+
+	if err := querier.SetAcceptAnyReplyPort(true); err != nil {
+		t.Fatal(err)
+	}
+	info, err := querier.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != makeTestInfo().Name {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestInfoTrailingBytes(t *testing.T) {
+	trailing := []byte{0x01, 0x02, 0x00, 0x7f}
+
+	source := makeTestInfo()
+	source.Type = ServerType_HLTV
+	for _, reply := range [][]byte{encodeSourceInfo(source), encodeGoldSrcInfo(makeTestInfo())} {
+		info := &ServerInfo{}
+		if err := (&ServerQuerier{}).parse_a2s_info_reply(info, reply); err != nil {
+			t.Fatal(err)
+		}
+		if info.Trailing != nil {
+			t.Errorf("expected no trailing bytes, got %x", info.Trailing)
+		}
+
+		info = &ServerInfo{}
+		padded := append(append([]byte{}, reply...), trailing...)
+		if err := (&ServerQuerier{}).parse_a2s_info_reply(info, padded); err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != makeTestInfo().Name || !bytes.Equal(info.Trailing, trailing) {
+			t.Errorf("expected trailing bytes %x, got %x in %+v", trailing, info.Trailing, info)
+		}
+	}
+}
+
+func TestInfoAppIdFromGameId(t *testing.T) {
+	const kAppId = App_Insurgency
+
+	source := makeTestInfo()
+	source.Ext.AppId = kAppId
+	// Set the type and mod id bits too, which aren't part of the app id.
+	source.Ext.GameId = uint64(0x12345678)<<32 | uint64(0x01)<<24 | uint64(kAppId)
+
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(source)); err != nil {
+		t.Fatal(err)
+	}
+	if info.Ext.AppId != kAppId {
+		t.Errorf("expected app id %d, got %d", kAppId, info.Ext.AppId)
+	}
+	if info.Ext.GameId != source.Ext.GameId {
+		t.Errorf("expected game id %x, got %x", source.Ext.GameId, info.Ext.GameId)
+	}
+
+	// Without a game id, the 16-bit field is all there is.
+	source.Ext.GameId = 0
+	info = &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(source)); err != nil {
+		t.Fatal(err)
+	}
+	if info.Ext.AppId != kAppId&0xffff {
+		t.Errorf("expected truncated app id %d, got %d", kAppId&0xffff, info.Ext.AppId)
+	}
+}
+
+func TestInfoSpecTv(t *testing.T) {
+	source := makeTestInfo()
+	source.SpecTv = &SpecTvInfo{Port: 27020, Name: "Test Server SourceTV"}
+	source.Ext.GameModeDescription = "payload"
+
+	info := &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(source)); err != nil {
+		t.Fatal(err)
+	}
+	if info.SpecTv == nil || *info.SpecTv != *source.SpecTv {
+		t.Errorf("expected SourceTV %+v, got %+v", source.SpecTv, info.SpecTv)
+	}
+	// Fields after SourceTV's still line up.
+	if info.Ext.GameModeDescription != "payload" || info.Ext.Port != 27015 {
+		t.Errorf("unexpected extended info: %+v", info.Ext)
+	}
+
+	info = &ServerInfo{}
+	if err := (&ServerQuerier{}).parse_a2s_info_reply(info, encodeSourceInfo(makeTestInfo())); err != nil {
+		t.Fatal(err)
+	}
+	if info.SpecTv != nil {
+		t.Errorf("expected no SourceTV fields, got %+v", info.SpecTv)
+	}
+}
+
+func TestParsePlayersCountMismatch(t *testing.T) {
+	listed := []Player{
+		{Index: 0, Name: "Bob", Score: 7, Duration: 60},
+		{Index: 1, Name: "Alice", Score: 3, Duration: 30},
+	}
+
+	// Declares more players than are listed.
+	reply := encodePlayers(listed)
+	reply[5] = 5
+	players, err := ParsePlayers(reply)
+	if err != ErrPartialResponse || !reflect.DeepEqual(players, listed) {
+		t.Errorf("expected both players with ErrPartialResponse, got %+v, %v", players, err)
+	}
+
+	// Declares fewer players than are listed.
+	reply = encodePlayers(listed)
+	reply[5] = 1
+	players, err = ParsePlayers(reply)
+	if err != ErrPartialResponse || !reflect.DeepEqual(players, listed[:1]) {
+		t.Errorf("expected only the first player with ErrPartialResponse, got %+v, %v", players, err)
+	}
+
+	// A player cut off partway isn't read.
+	reply = encodePlayers(listed)
+	players, err = ParsePlayers(reply[:len(reply)-3])
+	if err != ErrPartialResponse || !reflect.DeepEqual(players, listed[:1]) {
+		t.Errorf("expected only the first player with ErrPartialResponse, got %+v, %v", players, err)
+	}
+
+	// A count that matches is fine.
+	if players, err := ParsePlayers(encodePlayers(listed)); err != nil || len(players) != 2 {
+		t.Errorf("expected both players, got %+v, %v", players, err)
+	}
+}
+
+func TestQueryTiming(t *testing.T) {
+	respond := respondToInfoAndPlayers(encodeSourceInfo(makeTestInfo()), nil)
+	server := newMockServer(t, func(request []byte) [][]byte {
+		// The handshake is quick and the reply is slow.
+		if bytes.HasSuffix(request, kTestChallenge) {
+			time.Sleep(time.Millisecond * 120)
+		} else {
+			time.Sleep(time.Millisecond * 20)
+		}
+		return respond(request)
+	})
+
+	querier, err := NewServerQuerier(server.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+
+	info, err := querier.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timing := querier.Timing()
+	if timing.Dial <= 0 {
+		t.Errorf("expected the dial to be timed, got %v", timing.Dial)
+	}
+	if timing.Challenge < time.Millisecond*20 || timing.Challenge >= timing.Response {
+		t.Errorf("expected the challenge to take about 20ms, got %v", timing.Challenge)
+	}
+	if timing.Response < time.Millisecond*120 || timing.Response != info.Ping {
+		t.Errorf("expected the reply to take about 120ms, got %v (ping %v)", timing.Response, info.Ping)
+	}
+}
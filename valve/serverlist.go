@@ -0,0 +1,51 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Read a list of "ip:port" addresses, separated by newlines or commas, such as
+// a list saved from an earlier scan. Blank lines and lines starting with # are
+// skipped. An invalid address fails with its line number.
+func ParseServerListFile(r io.Reader) (ServerList, error) {
+	servers := ServerList{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		for _, field := range strings.Split(text, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+
+			addr, err := net.ResolveTCPAddr("tcp", field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if ip4 := addr.IP.To4(); ip4 != nil {
+				addr.IP = ip4
+			}
+			servers = append(servers, addr)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
@@ -0,0 +1,35 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseServerListFile(t *testing.T) {
+	input := strings.Join([]string{
+		"# Saved from the last scan",
+		"10.0.0.1:27015",
+		"",
+		"10.0.0.2:27015, 10.0.0.3:27016",
+	}, "\n")
+
+	servers, err := ParseServerListFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[10.0.0.1:27015 10.0.0.2:27015 10.0.0.3:27016]"
+	if fmt.Sprint(servers) != expected {
+		t.Errorf("expected %s, got %v", expected, servers)
+	}
+
+	_, err = ParseServerListFile(strings.NewReader(input + "\nnot-an-address\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 5:") {
+		t.Errorf("expected an error on line 5, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"sync"
+)
+
+// Counts the sockets ServerQueriers have open in this process, and makes new
+// ones wait while the count is at the cap.
+type socketLimit struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	open int
+	max  int
+}
+
+var sSocketLimit = newSocketLimit()
+
+func newSocketLimit() *socketLimit {
+	limit := &socketLimit{}
+	limit.cond = sync.NewCond(&limit.lock)
+	return limit
+}
+
+// Cap the number of ServerQuerier sockets open at once across the whole
+// process, to stay under the OS file descriptor limit. Creating a querier past
+// the cap blocks until another one is closed, or its context is done. Master
+// sockets don't count: there are only a few, and they stay open for a whole
+// scan. 0, the default, means no cap.
+func SetMaxOpenSockets(max int) {
+	sSocketLimit.lock.Lock()
+	defer sSocketLimit.lock.Unlock()
+
+	sSocketLimit.max = max
+	sSocketLimit.cond.Broadcast()
+}
+
+// Returns the number of ServerQuerier sockets that are currently open.
+func OpenSockets() int {
+	sSocketLimit.lock.Lock()
+	defer sSocketLimit.lock.Unlock()
+
+	return sSocketLimit.open
+}
+
+// Take a slot, waiting while the count is at the cap. Fails with the
+// context's error if it is done first.
+func (this *socketLimit) acquire(ctx context.Context) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.max > 0 && this.open >= this.max && ctx.Done() != nil {
+		// Wake the wait below if the context is done first.
+		stop := make(chan struct{})
+		defer close(stop)
+		go (func() {
+			select {
+			case <-ctx.Done():
+				this.lock.Lock()
+				this.cond.Broadcast()
+				this.lock.Unlock()
+			case <-stop:
+			}
+		})()
+	}
+
+	for this.max > 0 && this.open >= this.max {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		this.cond.Wait()
+	}
+	this.open++
+	return nil
+}
+
+func (this *socketLimit) release() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.open--
+	// A waiter whose context is done may take the wakeup and leave, so wake
+	// every waiter rather than one.
+	this.cond.Broadcast()
+}
@@ -0,0 +1,108 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxOpenSockets(t *testing.T) {
+	// The server never answers, so every query times out and is retried on
+	// a new socket.
+	server := newMockServer(t, func(request []byte) [][]byte {
+		return nil
+	})
+
+	const kCap = 3
+	baseline := OpenSockets()
+	SetMaxOpenSockets(baseline + kCap)
+	defer SetMaxOpenSockets(0)
+
+	var lock sync.Mutex
+	peak := 0
+	sample := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if open := OpenSockets() - baseline; open > peak {
+			peak = open
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			querier, err := NewServerQuerier(server.Addr(), time.Millisecond*10)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer querier.Close()
+			sample()
+
+			for retry := 0; retry < 3; retry++ {
+				if _, err := querier.QueryInfo(); err == nil {
+					t.Error("expected a timeout")
+				}
+				if err := querier.Reconnect(); err != nil {
+					t.Error(err)
+					return
+				}
+				sample()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak > kCap {
+		t.Errorf("expected at most %d open sockets, saw %d", kCap, peak)
+	}
+	if open := OpenSockets() - baseline; open != 0 {
+		t.Errorf("expected every socket to be released, %d still open", open)
+	}
+}
+
+func TestMaxOpenSocketsIgnoresMasters(t *testing.T) {
+	master := newMockMaster(t, []ServerList{makeServerList(1, 1)})
+	querier := newTestMasterQuerier(t, master)
+	server := newMockServer(t, respondToInfo(encodeSourceInfo(makeTestInfo())))
+
+	// The master's socket is open, but a server query still gets the one
+	// slot, and the master can redial while it's taken.
+	SetMaxOpenSockets(OpenSockets() + 1)
+	defer SetMaxOpenSockets(0)
+
+	first, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if err := querier.redialMaster(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.QueryInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second server query waits for the slot, until its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := NewBoundServerQuerierContext(ctx, server.Addr(), "", time.Millisecond*200); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+
+	first.Close()
+	second, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+}
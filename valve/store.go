@@ -0,0 +1,81 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+)
+
+// Persists batches of servers, for example to a database.
+type StoreSink interface {
+	StoreBatch(ctx context.Context, servers ServerList) error
+}
+
+// Where a master query had got to, for resuming it later.
+type Checkpoint struct {
+	// Pass this to SetStartAddress to carry on after the last batch.
+	Seed string
+	// Servers delivered to the callback so far.
+	Servers int
+	// Batches delivered so far.
+	Batches int
+}
+
+// Persists checkpoints, so that a long scan can be resumed after a crash.
+type CheckpointSink interface {
+	SaveCheckpoint(ctx context.Context, checkpoint Checkpoint) error
+}
+
+// Save a checkpoint to the sink after every n batches of Query or
+// QueryContext, once the callback has seen them. The end of the list isn't
+// checkpointed, since there is nothing left to resume. A sink error ends the
+// query. A nil sink or n of 0 turns checkpoints off.
+//
+// Seeds only carry over within a single filter list, so this is most useful
+// with at most one filter list and no parallel seeds.
+func (this *MasterServerQuerier) SetCheckpointSink(sink CheckpointSink, n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.checkpointSink = sink
+	this.checkpointEvery = n
+}
+
+// Count a delivered batch, and save a checkpoint if one is due. This must be
+// called with the lock held.
+func (this *MasterServerQuerier) checkpoint(ctx context.Context, seed string, servers int) error {
+	this.progress.Seed = seed
+	this.progress.Servers += servers
+	this.progress.Batches++
+
+	if this.checkpointSink == nil || this.checkpointEvery <= 0 {
+		return nil
+	}
+	if this.progress.Batches%this.checkpointEvery != 0 {
+		return nil
+	}
+	return this.checkpointSink.SaveCheckpoint(ctx, this.progress)
+}
+
+// Query the master and store every server it returns. Master batches are
+// coalesced so that each StoreBatch call gets up to batchSize servers, except
+// for the last. If batchSize is 0 or less, each master batch is stored as-is.
+func (this *MasterServerQuerier) QueryToStore(ctx context.Context, sink StoreSink, batchSize int) error {
+	store, flush := chunkServers(func(batch ServerList) error {
+		if len(batch) == 0 {
+			return nil
+		}
+		return sink.StoreBatch(ctx, batch)
+	}, batchSize)
+
+	err := this.QueryContext(ctx, store)
+
+	// Store whatever was received, even if the query failed partway.
+	if flushErr := flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
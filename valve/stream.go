@@ -0,0 +1,125 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/alliedmodders/blaster/batch"
+)
+
+// One server listed by the master, along with its A2S_INFO reply.
+type StreamedServer struct {
+	Address string
+	Info    *ServerInfo // nil if the query failed.
+	Err     error
+}
+
+// Queries servers as the master lists them, without ever holding the whole
+// list. Each batch from the master goes straight to the workers, and the
+// master isn't asked for more once too many servers are waiting to be
+// queried or for their results to be read. A slow reader therefore slows
+// down paging through the master too.
+type InfoStream struct {
+	master      MasterQuerier
+	concurrency int
+	bufferSize  int
+	timeout     time.Duration
+	filter      func(info *ServerInfo) bool
+}
+
+// Create a stream that queries every server listed by the given master, which
+// should already have its filters set.
+func NewInfoStream(master MasterQuerier) *InfoStream {
+	return &InfoStream{
+		master:      master,
+		concurrency: 20,
+		bufferSize:  1000,
+		timeout:     time.Second * 3,
+	}
+}
+
+// Set how many servers are queried at once. The default is 20.
+func (this *InfoStream) SetConcurrency(n int) {
+	this.concurrency = n
+}
+
+// Set how many servers can be listed by the master but not yet read from the
+// results, which bounds memory use. The default is 1000.
+func (this *InfoStream) SetBufferSize(n int) {
+	this.bufferSize = n
+}
+
+// Set how long to wait for each server to answer. The default is three
+// seconds.
+func (this *InfoStream) SetQueryTimeout(timeout time.Duration) {
+	this.timeout = timeout
+}
+
+// Only send results whose A2S_INFO reply passes the filter. Servers that
+// didn't answer are still sent, since the filter can't judge them. Nil, the
+// default, sends everything.
+func (this *InfoStream) SetResultFilter(filter func(info *ServerInfo) bool) {
+	this.filter = filter
+}
+
+// Query every server the master lists, sending each result to the channel,
+// which is closed when Run returns. Results arrive in no particular order.
+// Stops early if the context is cancelled or the master query fails.
+func (this *InfoStream) Run(ctx context.Context, results chan<- *StreamedServer) error {
+	defer close(results)
+
+	concurrency, bufferSize := this.concurrency, this.bufferSize
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	// A slot is taken for each server before it is handed to the workers, and
+	// given back once its result has been read.
+	slots := make(chan struct{}, bufferSize)
+	bp := batch.NewBatchProcessor(func(item interface{}) {
+		defer (func() { <-slots })()
+
+		server := this.queryServer(ctx, item.(*net.TCPAddr))
+		if server.Info != nil && this.filter != nil && !this.filter(server.Info) {
+			return
+		}
+		select {
+		case results <- server:
+		case <-ctx.Done():
+		}
+	}, concurrency)
+
+	err := this.master.QueryContext(ctx, func(servers ServerList) error {
+		for _, addr := range servers {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			bp.AddBatch(ServerList{addr})
+		}
+		return nil
+	})
+	bp.Finish()
+	return err
+}
+
+func (this *InfoStream) queryServer(ctx context.Context, addr *net.TCPAddr) *StreamedServer {
+	server := &StreamedServer{Address: addr.String()}
+	querier, err := NewBoundServerQuerierContext(ctx, addr.String(), "", this.timeout)
+	if err == nil {
+		defer querier.Close()
+		server.Info, err = querier.QueryInfoContext(ctx)
+	}
+	server.Err = err
+	return server
+}
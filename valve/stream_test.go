@@ -0,0 +1,86 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInfoStream(t *testing.T) {
+	batches := []ServerList{}
+	for i := 0; i < 5; i++ {
+		batches = append(batches, ServerList{
+			newOrchestratorTestServer(t, "server", nil),
+			newOrchestratorTestServer(t, "server", nil),
+		})
+	}
+	master := newMockMaster(t, batches)
+	querier := newTestMasterQuerier(t, master)
+
+	stream := NewInfoStream(querier)
+	stream.SetBufferSize(2)
+	stream.SetQueryTimeout(time.Second)
+	results := make(chan *StreamedServer)
+	done := make(chan error, 1)
+	go (func() {
+		done <- stream.Run(context.Background(), results)
+	})()
+
+	// Nothing is reading, so the stream stops asking the master for more
+	// once two servers are waiting.
+	time.Sleep(time.Millisecond * 100)
+	if queries := len(master.Queries()); queries > 2 {
+		t.Errorf("expected the master to wait for the reader, got %d queries", queries)
+	}
+
+	seen := map[string]bool{}
+	for server := range results {
+		if server.Err != nil || server.Info == nil {
+			t.Errorf("expected an A2S_INFO reply from %s, got %v", server.Address, server.Err)
+		}
+		seen[server.Address] = true
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 10 {
+		t.Errorf("expected all 10 servers, got %d", len(seen))
+	}
+	if queries := len(master.Queries()); queries != 5 {
+		t.Errorf("expected the full list to be fetched, got %d queries", queries)
+	}
+}
+
+func TestInfoStreamResultFilter(t *testing.T) {
+	dustbowl := newOrchestratorTestServer(t, "dustbowl", func(info *ServerInfo) { info.MapName = "cp_dustbowl" })
+	twofort := newOrchestratorTestServer(t, "2fort", func(info *ServerInfo) { info.MapName = "ctf_2fort" })
+	master := newMockMaster(t, []ServerList{{dustbowl, twofort}})
+	querier := newTestMasterQuerier(t, master)
+
+	stream := NewInfoStream(querier)
+	stream.SetQueryTimeout(time.Second)
+	stream.SetResultFilter(func(info *ServerInfo) bool {
+		return info.MapName == "cp_dustbowl"
+	})
+	results := make(chan *StreamedServer)
+	done := make(chan error, 1)
+	go (func() {
+		done <- stream.Run(context.Background(), results)
+	})()
+
+	seen := []string{}
+	for server := range results {
+		seen = append(seen, server.Address)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || seen[0] != dustbowl.String() {
+		t.Errorf("expected only %s, got %v", dustbowl, seen)
+	}
+}
@@ -0,0 +1,130 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrFrameTooLarge = errors.New("framed packet is larger than any datagram")
+
+// How a socket carries packets to the remote address.
+type SocketProtocol int
+
+const (
+	// One packet per UDP datagram. This is the default, and what Valve's
+	// servers speak.
+	ProtocolUDP SocketProtocol = iota
+	// Packets over a TCP stream, each prefixed with its length as a 4-byte
+	// little-endian integer. Some mirrors and tools serve master and A2S
+	// replies this way.
+	ProtocolTCP
+)
+
+// Create a socket that speaks the given protocol. NewUdpSocket is the same as
+// passing ProtocolUDP.
+func NewSocket(address string, timeout time.Duration, protocol SocketProtocol) (*UdpSocket, error) {
+	if protocol != ProtocolTCP {
+		return NewUdpSocket(address, timeout)
+	}
+
+	addr, err := ResolveUDPAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	cn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+	if err != nil {
+		return nil, err
+	}
+
+	// The stream only ever has the one peer, so there is no source to check.
+	return &UdpSocket{
+		timeout:     timeout,
+		cn:          &framedConn{conn: cn},
+		remote:      addr,
+		buffer:      make([]byte, kMaxPacketSize+1),
+		clock:       realClock{},
+		unconnected: true,
+		protocol:    ProtocolTCP,
+	}, nil
+}
+
+// Carries length-prefixed packets over a stream. This implements
+// net.PacketConn for UdpSocket. A read that times out partway through a packet
+// picks up where it left off next time, so the stream stays in step.
+type framedConn struct {
+	conn   net.Conn
+	header [4]byte
+	frame  []byte
+	got    int // Bytes of the current header and frame read so far.
+}
+
+func (this *framedConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	for this.got < len(this.header) {
+		n, err := this.conn.Read(this.header[this.got:])
+		this.got += n
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if this.frame == nil {
+		size := binary.LittleEndian.Uint32(this.header[:])
+		if size > kMaxDatagramSize {
+			return 0, nil, ErrFrameTooLarge
+		}
+		this.frame = make([]byte, size)
+	}
+	for this.got < len(this.header)+len(this.frame) {
+		n, err := this.conn.Read(this.frame[this.got-len(this.header):])
+		this.got += n
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// Like a datagram, whatever doesn't fit in the buffer is dropped.
+	n := copy(buffer, this.frame)
+	this.frame = nil
+	this.got = 0
+	return n, this.conn.RemoteAddr(), nil
+}
+
+func (this *framedConn) WriteTo(buffer []byte, addr net.Addr) (int, error) {
+	packet := make([]byte, len(this.header)+len(buffer))
+	binary.LittleEndian.PutUint32(packet, uint32(len(buffer)))
+	copy(packet[len(this.header):], buffer)
+
+	n, err := this.conn.Write(packet)
+	if n -= len(this.header); n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (this *framedConn) LocalAddr() net.Addr {
+	return this.conn.LocalAddr()
+}
+
+func (this *framedConn) SetDeadline(deadline time.Time) error {
+	return this.conn.SetDeadline(deadline)
+}
+
+func (this *framedConn) SetReadDeadline(deadline time.Time) error {
+	return this.conn.SetReadDeadline(deadline)
+}
+
+func (this *framedConn) SetWriteDeadline(deadline time.Time) error {
+	return this.conn.SetWriteDeadline(deadline)
+}
+
+func (this *framedConn) Close() error {
+	return this.conn.Close()
+}
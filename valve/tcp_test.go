@@ -0,0 +1,92 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMasterOverTcp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	querier, err := NewMasterServerQuerierProtocol(listener.Addr().String(), ProtocolTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+	querier.cn.wait = 0
+	querier.cn.SetTimeout(time.Second)
+
+	cn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The mock master only needs a PacketConn, so serve it over the stream.
+	batches := []ServerList{makeServerList(1, 3), makeServerList(2, 3)}
+	master := &mockMaster{
+		conn:    &framedConn{conn: cn},
+		batches: batches,
+	}
+	go master.serve()
+	defer cn.Close()
+
+	servers := ServerList{}
+	err = querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 6 || servers[5].String() != batches[1][2].String() {
+		t.Errorf("expected both batches, got %v", servers)
+	}
+	if len(master.Queries()) != 2 {
+		t.Errorf("expected 2 queries, got %d", len(master.Queries()))
+	}
+}
+
+func TestFramedConnPartialRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := &framedConn{conn: client}
+	payload := []byte("hello")
+	packet := append([]byte{byte(len(payload)), 0, 0, 0}, payload...)
+
+	// Send the packet in two pieces, with the first read timing out between.
+	go server.Write(packet[:6])
+	buffer := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	if _, _, err := conn.ReadFrom(buffer); err == nil {
+		t.Fatal("expected a timeout on a partial packet")
+	}
+
+	go server.Write(packet[6:])
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer[:n], payload) {
+		t.Errorf("expected %q, got %q", payload, buffer[:n])
+	}
+
+	// Too large to be a packet.
+	go server.Write([]byte{0xff, 0xff, 0xff, 0x7f})
+	if _, _, err := conn.ReadFrom(buffer); err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"sync"
+)
+
+// Player counts summed over many servers.
+type PlayerTotals struct {
+	Servers    int
+	Players    int // Includes bots.
+	Bots       int
+	Humans     int
+	MaxPlayers int
+}
+
+// A report on a whole scan, as printed at the end of one.
+type ScanSummary struct {
+	PlayerTotals
+
+	Found     int            // Servers the scan tried to query.
+	Responded int            // Servers that answered; the same as Servers.
+	Maps      int            // Distinct maps being played.
+	Games     map[string]int // Servers for each game name.
+}
+
+// Keeps running player totals during a scan. Servers may be added from
+// multiple goroutines.
+type PlayerTally struct {
+	lock     sync.Mutex
+	totals   PlayerTotals
+	failures int
+	maps     map[string]bool
+	games    map[string]int
+}
+
+// Add a successfully queried server to the totals.
+func (this *PlayerTally) Add(info *ServerInfo) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.totals.Servers++
+	this.totals.Players += int(info.Players)
+	this.totals.Bots += int(info.Bots)
+	this.totals.MaxPlayers += int(info.MaxPlayers)
+
+	// Some servers report more bots than players.
+	if humans := int(info.Players) - int(info.Bots); humans > 0 {
+		this.totals.Humans += humans
+	}
+
+	if this.maps == nil {
+		this.maps = map[string]bool{}
+		this.games = map[string]int{}
+	}
+	this.maps[info.MapName] = true
+	this.games[info.Game]++
+}
+
+// Count a server that couldn't be queried. It only shows in the summary.
+func (this *PlayerTally) AddFailure() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.failures++
+}
+
+// Returns the totals so far.
+func (this *PlayerTally) Totals() PlayerTotals {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.totals
+}
+
+// Returns a summary of everything added so far.
+func (this *PlayerTally) Summary() ScanSummary {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	games := map[string]int{}
+	for game, count := range this.games {
+		games[game] = count
+	}
+	return ScanSummary{
+		PlayerTotals: this.totals,
+		Found:        this.totals.Servers + this.failures,
+		Responded:    this.totals.Servers,
+		Maps:         len(this.maps),
+		Games:        games,
+	}
+}
+
+// Summarize the results of a scan, where servers that didn't answer are nil.
+func SummarizeScan(results []*ServerInfo) ScanSummary {
+	tally := &PlayerTally{}
+	for _, info := range results {
+		if info == nil {
+			tally.AddFailure()
+		} else {
+			tally.Add(info)
+		}
+	}
+	return tally.Summary()
+}
@@ -0,0 +1,93 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlayerTally(t *testing.T) {
+	counts := [][3]uint8{
+		// Players, bots, max players.
+		{12, 2, 24},
+		{0, 0, 16},
+		{3, 5, 32},
+	}
+
+	tally := &PlayerTally{}
+	var wg sync.WaitGroup
+	for _, count := range counts {
+		info := makeTestInfo()
+		info.Players, info.Bots, info.MaxPlayers = count[0], count[1], count[2]
+		server := newMockServer(t, respondToInfo(encodeSourceInfo(info)))
+
+		wg.Add(1)
+		go (func() {
+			defer wg.Done()
+
+			querier, err := NewServerQuerier(server.Addr(), time.Millisecond*200)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer querier.Close()
+
+			info, err := querier.QueryInfo()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tally.Add(info)
+		})()
+	}
+	wg.Wait()
+
+	expected := PlayerTotals{
+		Servers:    3,
+		Players:    15,
+		Bots:       7,
+		Humans:     10,
+		MaxPlayers: 72,
+	}
+	if totals := tally.Totals(); totals != expected {
+		t.Errorf("expected %+v, got %+v", expected, totals)
+	}
+}
+
+func TestSummarizeScan(t *testing.T) {
+	server := func(game string, mapName string, players uint8, bots uint8) *ServerInfo {
+		return &ServerInfo{Game: game, MapName: mapName, Players: players, Bots: bots, MaxPlayers: 24}
+	}
+	results := []*ServerInfo{
+		server("Team Fortress", "cp_badlands", 20, 0),
+		nil,
+		server("Team Fortress", "ctf_2fort", 10, 4),
+		server("Counter-Strike", "de_dust2", 3, 5),
+		nil,
+		server("Team Fortress", "cp_badlands", 1, 0),
+	}
+
+	summary := SummarizeScan(results)
+	if summary.Found != 6 || summary.Responded != 4 || summary.Servers != 4 {
+		t.Errorf("expected 4 of 6 servers to respond, got %+v", summary)
+	}
+	if summary.Players != 34 || summary.Humans != 27 || summary.Bots != 9 || summary.MaxPlayers != 96 {
+		t.Errorf("unexpected player totals: %+v", summary.PlayerTotals)
+	}
+	if summary.Maps != 3 {
+		t.Errorf("expected 3 maps, got %d", summary.Maps)
+	}
+	if !reflect.DeepEqual(summary.Games, map[string]int{"Team Fortress": 3, "Counter-Strike": 1}) {
+		t.Errorf("unexpected game counts: %v", summary.Games)
+	}
+
+	if empty := SummarizeScan(nil); empty.Found != 0 || empty.Maps != 0 || len(empty.Games) != 0 {
+		t.Errorf("expected an empty summary, got %+v", empty)
+	}
+}
@@ -6,7 +6,16 @@
 package valve
 
 import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
 	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // A list of IP addresses and ports.
@@ -22,6 +31,273 @@ func (this ServerList) Item(index int) interface{} {
 	return this[index]
 }
 
+// Returns the addresses to send queries to. The master lists game ports as
+// TCP addresses, but queries go over UDP to the same IP and port.
+func (this ServerList) UDPAddrs() []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, 0, len(this))
+	for _, addr := range this {
+		addrs = append(addrs, ToUDPAddr(addr))
+	}
+	return addrs
+}
+
+// Convert a server's address from the master into the address to query it
+// on. IPv4 addresses are always in their 4-byte form, and the IP is copied, so
+// the result doesn't share memory with the original.
+func ToUDPAddr(addr *net.TCPAddr) *net.UDPAddr {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.UDPAddr{
+		IP:   append(net.IP{}, ip...),
+		Port: addr.Port,
+		Zone: addr.Zone,
+	}
+}
+
+// Shuffle the list in place, so that servers from the same netblock, which
+// the master tends to list together, aren't queried in a burst. If rng is nil,
+// the global source is used.
+func (this ServerList) Shuffle(rng *rand.Rand) {
+	swap := func(i, j int) {
+		this[i], this[j] = this[j], this[i]
+	}
+	if rng == nil {
+		rand.Shuffle(len(this), swap)
+	} else {
+		rng.Shuffle(len(this), swap)
+	}
+}
+
+// Bucket the list by network, using the first maskBits of each address, to see
+// how many servers share a netblock. Keys are in CIDR form, like 10.0.1.0/24.
+func (this ServerList) GroupBySubnet(maskBits int) map[string]ServerList {
+	groups := map[string]ServerList{}
+	for _, addr := range this {
+		bits := 8 * net.IPv6len
+		ip := addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			bits, ip = 8*net.IPv4len, ip4
+		}
+
+		network := &net.IPNet{
+			IP:   ip.Mask(net.CIDRMask(maskBits, bits)),
+			Mask: net.CIDRMask(maskBits, bits),
+		}
+		key := network.String()
+		groups[key] = append(groups[key], addr)
+	}
+	return groups
+}
+
+// Compare this list to a newer one. Servers only in the newer list are added,
+// and servers only in this list are removed. Order is kept.
+func (this ServerList) Diff(other ServerList) (added ServerList, removed ServerList) {
+	before := map[string]bool{}
+	for _, addr := range this {
+		before[addr.String()] = true
+	}
+	after := map[string]bool{}
+	for _, addr := range other {
+		after[addr.String()] = true
+	}
+
+	added, removed = ServerList{}, ServerList{}
+	for _, addr := range other {
+		if !before[addr.String()] {
+			added = append(added, addr)
+		}
+	}
+	for _, addr := range this {
+		if !after[addr.String()] {
+			removed = append(removed, addr)
+		}
+	}
+	return added, removed
+}
+
+// Combine lists into one, such as the results of scans for several games or
+// regions. Each server appears once, where it was first seen.
+func MergeServerLists(lists ...ServerList) ServerList {
+	size := 0
+	for _, list := range lists {
+		size += len(list)
+	}
+
+	seen := make(map[string]bool, size)
+	merged := make(ServerList, 0, size)
+	for _, list := range lists {
+		for _, addr := range list {
+			key := addr.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, addr)
+		}
+	}
+	return merged
+}
+
+var ErrBadServerAddress = fmt.Errorf("bad server address")
+var ErrNoGameVersion = fmt.Errorf("server did not report a game version")
+var ErrBadGameVersion = fmt.Errorf("game version is not numeric")
+var ErrNoRuleChunks = fmt.Errorf("no numbered rules with the given prefix")
+var ErrMissingRuleChunk = fmt.Errorf("numbered rule is missing")
+
+// The JSON form of one ServerList entry.
+type serverListEntry struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+// Encodes the list as an array of {"ip", "port"} objects.
+func (this ServerList) MarshalJSON() ([]byte, error) {
+	entries := make([]serverListEntry, 0, len(this))
+	for _, addr := range this {
+		entries = append(entries, serverListEntry{
+			IP:   addr.IP.String(),
+			Port: addr.Port,
+		})
+	}
+	return json.Marshal(entries)
+}
+
+// Decodes a list written by MarshalJSON. Every entry must have a valid IP
+// address and port.
+func (this *ServerList) UnmarshalJSON(data []byte) error {
+	var entries []serverListEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	servers := make(ServerList, 0, len(entries))
+	for i, entry := range entries {
+		ip := net.ParseIP(entry.IP)
+		if ip == nil || entry.Port < 0 || entry.Port > 65535 {
+			return fmt.Errorf("server %d: %w", i, ErrBadServerAddress)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		servers = append(servers, &net.TCPAddr{
+			IP:   ip,
+			Port: entry.Port,
+		})
+	}
+	*this = servers
+	return nil
+}
+
+// A mapping of cvar names to values, as returned by A2S_RULES.
+type Rules map[string]string
+
+// Returns a rule's value as an integer. The second value is false if the rule
+// is missing or is not an integer.
+func (this Rules) Int(key string) (int, bool) {
+	value, ok := this[key]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Returns a rule's value as a float. The second value is false if the rule
+// is missing or is not a number.
+func (this Rules) Float(key string) (float64, bool) {
+	value, ok := this[key]
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+// Returns a rule's value as a boolean. Besides "true" and "false", any number
+// is accepted, where non-zero is true. The second value is false if the rule
+// is missing or is not a boolean.
+func (this Rules) Bool(key string) (bool, bool) {
+	value, ok := this[key]
+	if !ok {
+		return false, false
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b, true
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f != 0, true
+	}
+	return false, false
+}
+
+// Join a value that a server split across numbered rules, such as "rule0",
+// "rule1" and so on, since a single rule value can't be very long. Rules that
+// start with the prefix but aren't followed by a number are ignored. Numbering
+// must start at 0, and a gap fails with ErrMissingRuleChunk.
+func ReassembleChunkedRules(rules map[string]string, prefix string) (string, error) {
+	count := 0
+	for key := range rules {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		suffix := key[len(prefix):]
+		n, err := strconv.Atoi(suffix)
+		if err != nil || n < 0 || strconv.Itoa(n) != suffix {
+			continue
+		}
+		if n >= len(rules) {
+			// There aren't enough rules for every chunk up to this one, so
+			// there is a gap at or before len(rules). Rules come from the
+			// server, so this also keeps a huge suffix from overflowing.
+			n = len(rules)
+		}
+		if n >= count {
+			count = n + 1
+		}
+	}
+	if count == 0 {
+		return "", fmt.Errorf("%w: %q", ErrNoRuleChunks, prefix)
+	}
+
+	var value strings.Builder
+	for i := 0; i < count; i++ {
+		key := prefix + strconv.Itoa(i)
+		chunk, ok := rules[key]
+		if !ok {
+			return "", fmt.Errorf("%w: %q", ErrMissingRuleChunk, key)
+		}
+		value.WriteString(chunk)
+	}
+	return value.String(), nil
+}
+
+// A player on a server, as returned by A2S_PLAYER.
+type Player struct {
+	Index    uint8
+	Name     string
+	Score    int32
+	Duration float32 // Seconds connected.
+
+	// A best-effort guess, since replies don't mark bots at all. It is made
+	// for GoldSrc servers (see looksLikeGoldSrcBot), and from the bot count
+	// if SetGuessBotsFromCount is enabled.
+	IsBot bool
+}
+
+// Returns how long the player has been connected. Fractional seconds are
+// kept, rather than truncated by converting the float to an integer first.
+func (this *Player) PlayTime() time.Duration {
+	return time.Duration(float64(this.Duration) * float64(time.Second))
+}
+
 // The game engine (either HL1 or HL2).
 type GameEngine int
 
@@ -54,7 +330,8 @@ func (this ServerType) String() string {
 	}
 }
 
-// The server operating system (windows, linux, or mac).
+// The server operating system (windows, linux, or mac), from the environment
+// byte in an A2S_INFO reply.
 type ServerOS int
 
 const (
@@ -64,6 +341,20 @@ const (
 	ServerOS_Mac
 )
 
+// Mac servers send 'm', though older ones send 'o'. Anything else is Unknown.
+func osFromByte(value uint8) ServerOS {
+	switch value {
+	case 'l':
+		return ServerOS_Linux
+	case 'w':
+		return ServerOS_Windows
+	case 'm', 'o':
+		return ServerOS_Mac
+	default:
+		return ServerOS_Unknown
+	}
+}
+
 // Returns the operating system as a string.
 func (this ServerOS) String() string {
 	switch this {
@@ -78,18 +369,66 @@ func (this ServerOS) String() string {
 	}
 }
 
+// Whether a server is password protected, from the visibility byte in an
+// A2S_INFO reply. Values other than 0 and 1 are Unknown, as is the zero
+// value, so info that wasn't read from a reply isn't taken to be public.
+type ServerVisibility int
+
+const (
+	ServerVisibility_Unknown ServerVisibility = iota
+	ServerVisibility_Public
+	ServerVisibility_Private
+)
+
+func visibilityFromByte(value uint8) ServerVisibility {
+	switch value {
+	case 0:
+		return ServerVisibility_Public
+	case 1:
+		return ServerVisibility_Private
+	default:
+		return ServerVisibility_Unknown
+	}
+}
+
+// Returns the visibility as a string.
+func (this ServerVisibility) String() string {
+	switch this {
+	case ServerVisibility_Public:
+		return "public"
+	case ServerVisibility_Private:
+		return "private"
+	default:
+		return "unknown"
+	}
+}
+
+// The first four bytes of every packet, as a little-endian int32. Replies
+// that don't fit in one packet are split, and use a different header.
+const PacketHeaderSimple int32 = -1
+const PacketHeaderSplit int32 = -2
+
 // OOB request packet types.
+const A2M_GET_SERVERS_BATCH2 uint8 = 0x31
 const A2S_INFO uint8 = 0x54
+const A2S_PLAYER uint8 = 0x55
 const A2S_RULES uint8 = 0x56
 
 // Official versions of the A2S_INFO reply.
 const S2A_INFO_GOLDSRC uint8 = 0x6d
 const S2A_INFO_SOURCE uint8 = 0x49
 
+// An older GoldSrc detailed info reply, sent by some servers alongside 0x6d.
+const S2A_INFO_GOLDSRC_OLD uint8 = 0x6c
+
 // Other OOB response packet types.
 const S2C_CHALLENGE uint8 = 0x41
 const S2A_PLAYER uint8 = 0x44
 const S2A_RULES uint8 = 0x45
+const M2A_SERVER_BATCH uint8 = 0x66
+
+// The header of every master server response packet.
+var HeaderMasterResponse = []byte{0xff, 0xff, 0xff, 0xff, M2A_SERVER_BATCH, 0x0a}
 
 // Optional mod information returned by S2A_INFO_GOLDSRC.
 type ModInfo struct {
@@ -108,7 +447,8 @@ type TheShipInfo struct {
 	Duration  uint8 `json:"duration"`
 }
 
-// Optional information available with S2A_INFO_SOURCE.
+// The SourceTV relay's port and name, sent with S2A_INFO_SOURCE when the
+// server is running one. Otherwise, ServerInfo.SpecTv is nil.
 type SpecTvInfo struct {
 	Port uint16
 	Name string
@@ -137,22 +477,93 @@ type ServerInfo struct {
 	// One of the A2S_INFO constants.
 	InfoVersion uint8
 
-	Protocol   uint8
-	Name       string
-	MapName    string
-	Folder     string
-	Game       string
+	Protocol uint8
+	Name     string
+	MapName  string
+
+	// The game's directory, such as "tf", and its full name, such as "Team
+	// Fortress". They're adjacent in the reply, in that order.
+	Folder string
+	Game   string
+
 	Players    uint8
 	MaxPlayers uint8
 	Bots       uint8
 	Type       ServerType
 	OS         ServerOS
-	Visibility uint8
+	Visibility ServerVisibility
 	Vac        uint8
 	Mod        *ModInfo
 	TheShip    *TheShipInfo
 	SpecTv     *SpecTvInfo
 	Ext        *ExtendedInfo
+
+	// The environment and visibility bytes as they were on the wire, since
+	// OS and Visibility can't tell apart the odd values some servers send.
+	RawOS         uint8
+	RawVisibility uint8
+
+	// Anything in the reply after the last field the parser knows about,
+	// such as the extra data some SourceTV and HLTV proxies send. Nil if
+	// there was nothing more.
+	Trailing []byte
+
+	// True if the reply ended early, in the fixed fields after MaxPlayers.
+	// Fields that weren't present are left as zero or unknown.
+	Truncated bool
+
+	// The name of the game from its AppId, if it is a well-known one. This is
+	// computed locally and is not from the wire.
+	KnownAppName string
+
+	// How long the server took to answer the A2S_INFO request, not counting
+	// any challenge round trip. This is also computed locally.
+	Ping time.Duration
+}
+
+// Sort server info replies by ascending ping. Servers with the same ping keep
+// their order.
+func SortByPing(infos []*ServerInfo) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Ping < infos[j].Ping
+	})
+}
+
+// Group server info replies by tag, for looking up every server with a given
+// tag. Each server is listed once per tag, at the address it was queried on.
+// Replies without a usable IPv4 address are left out.
+func IndexByTag(infos []*ServerInfo) map[string]ServerList {
+	index := map[string]ServerList{}
+	for _, info := range infos {
+		addr, err := parseSeedAddress(info.Address)
+		if err != nil {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, tag := range info.Tags() {
+			if seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			index[tag] = append(index[tag], addr)
+		}
+	}
+	return index
+}
+
+// Returns the server's tags (sv_tags, or the keywords field of A2S_INFO),
+// lowercased since servers don't agree on case. Nil if there are none.
+func (this *ServerInfo) Tags() []string {
+	if this.Ext == nil {
+		return nil
+	}
+	var tags []string
+	for _, tag := range strings.Split(this.Ext.GameModeDescription, ",") {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
 }
 
 // Attempt to guess the game engine version.
@@ -177,3 +588,124 @@ func (this *ServerInfo) IsPreOrangeBox() bool {
 	}
 	return false
 }
+
+// Returns a steam://connect URL for joining the server. This uses the game
+// port if the server reported one, and otherwise the port that was queried.
+func (this *ServerInfo) ConnectURL() string {
+	address := this.Address
+	if host, port, err := net.SplitHostPort(this.Address); err == nil {
+		if this.Ext != nil && this.Ext.Port != 0 {
+			port = strconv.Itoa(int(this.Ext.Port))
+		}
+		address = net.JoinHostPort(host, port)
+	}
+	return "steam://connect/" + address
+}
+
+// Same as ConnectURL, but includes the password if the server requires one.
+func (this *ServerInfo) ConnectURLWithPassword(password string) string {
+	if this.Visibility == ServerVisibility_Public || password == "" {
+		return this.ConnectURL()
+	}
+	return this.ConnectURL() + "/" + url.PathEscape(password)
+}
+
+// Returns true if every player slot is taken. Bots take up slots too.
+func (this *ServerInfo) IsFull() bool {
+	return this.Players >= this.MaxPlayers
+}
+
+// Returns true if there are no human players. Players includes bots.
+func (this *ServerInfo) IsEmpty() bool {
+	return this.HumanPlayers() == 0
+}
+
+// Returns the number of players that aren't bots. This is never negative,
+// even if the server reports more bots than players.
+func (this *ServerInfo) HumanPlayers() int {
+	if this.Bots > this.Players {
+		return 0
+	}
+	return int(this.Players) - int(this.Bots)
+}
+
+// Returns true if the server requires a password to join. Servers with an
+// unknown visibility are assumed to.
+func (this *ServerInfo) HasPassword() bool {
+	return this.Visibility != ServerVisibility_Public
+}
+
+// Returns true if the name is valid UTF-8. Names are kept exactly as the
+// server sent them, and many use extended ASCII or are cut off mid-character.
+func (this *ServerInfo) NameValid() bool {
+	return utf8.ValidString(this.Name)
+}
+
+// Returns the name with each byte of invalid UTF-8 replaced by U+FFFD, for
+// display. This matches what encoding/json does when marshalling.
+func (this *ServerInfo) SanitizedName() string {
+	if utf8.ValidString(this.Name) {
+		return this.Name
+	}
+	var name strings.Builder
+	for _, r := range this.Name {
+		// Ranging over a string yields utf8.RuneError for each bad byte.
+		name.WriteRune(r)
+	}
+	return name.String()
+}
+
+// Splits the game version, such as "1.2.3.4", into its numbers. A version
+// without dots, like the build number "7648638", has a single component.
+// Versions with anything other than digits between the dots return
+// ErrBadGameVersion.
+func (this *ServerInfo) ParsedVersion() ([]int, error) {
+	if this.Ext == nil || this.Ext.GameVersion == "" {
+		return nil, ErrNoGameVersion
+	}
+
+	parts := strings.Split(this.Ext.GameVersion, ".")
+	version := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || strings.Trim(part, "0123456789") != "" {
+			return nil, fmt.Errorf("%q: %w", this.Ext.GameVersion, ErrBadGameVersion)
+		}
+		version = append(version, n)
+	}
+	return version, nil
+}
+
+// Describes the fields that differ between two snapshots of a server, such as
+// "map changed from cp_badlands to cp_dustbowl". Only fields that are
+// meaningful to players are compared; the address and reply metadata are
+// ignored. The result is empty if nothing changed.
+func (this *ServerInfo) Diff(other *ServerInfo) []string {
+	changes := []string{}
+	compare := func(field string, before interface{}, after interface{}) {
+		if before != after {
+			changes = append(changes, fmt.Sprintf("%s changed from %v to %v", field, before, after))
+		}
+	}
+
+	compare("name", this.Name, other.Name)
+	compare("map", this.MapName, other.MapName)
+	compare("game", this.Game, other.Game)
+	compare("players", this.Players, other.Players)
+	compare("max players", this.MaxPlayers, other.MaxPlayers)
+	compare("bots", this.Bots, other.Bots)
+	compare("protocol", this.Protocol, other.Protocol)
+	compare("type", this.Type, other.Type)
+	compare("os", this.OS, other.OS)
+	compare("password", this.HasPassword(), other.HasPassword())
+	compare("vac", this.Vac, other.Vac)
+
+	version := func(info *ServerInfo) string {
+		if info.Ext == nil {
+			return ""
+		}
+		return info.Ext.GameVersion
+	}
+	compare("version", version(this), version(other))
+	return changes
+}
@@ -0,0 +1,457 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRulesCoercion(t *testing.T) {
+	rules := Rules{
+		"mp_timelimit":   "45",
+		"sv_gravity":     "800.5",
+		"sv_cheats":      "0",
+		"sv_alltalk":     "1",
+		"sv_contact":     "admin@example.com",
+		"tf_bot_enabled": "true",
+	}
+
+	if n, ok := rules.Int("mp_timelimit"); !ok || n != 45 {
+		t.Errorf("expected mp_timelimit to be 45, got %d (%v)", n, ok)
+	}
+	if f, ok := rules.Float("sv_gravity"); !ok || f != 800.5 {
+		t.Errorf("expected sv_gravity to be 800.5, got %f (%v)", f, ok)
+	}
+	if b, ok := rules.Bool("sv_cheats"); !ok || b {
+		t.Errorf("expected sv_cheats to be false, got %v (%v)", b, ok)
+	}
+	if b, ok := rules.Bool("sv_alltalk"); !ok || !b {
+		t.Errorf("expected sv_alltalk to be true, got %v (%v)", b, ok)
+	}
+	if b, ok := rules.Bool("tf_bot_enabled"); !ok || !b {
+		t.Errorf("expected tf_bot_enabled to be true, got %v (%v)", b, ok)
+	}
+
+	// Non-numeric values.
+	if _, ok := rules.Int("sv_contact"); ok {
+		t.Errorf("expected sv_contact to not be an integer")
+	}
+	if _, ok := rules.Float("sv_contact"); ok {
+		t.Errorf("expected sv_contact to not be a float")
+	}
+	if _, ok := rules.Bool("sv_contact"); ok {
+		t.Errorf("expected sv_contact to not be a boolean")
+	}
+
+	// Missing keys.
+	if _, ok := rules.Int("mp_fraglimit"); ok {
+		t.Errorf("expected missing key to fail")
+	}
+	if _, ok := rules.Bool("mp_fraglimit"); ok {
+		t.Errorf("expected missing key to fail")
+	}
+}
+
+func TestServerListUDPAddrs(t *testing.T) {
+	servers := ServerList{
+		{IP: net.IPv4(10, 0, 1, 2), Port: 27015},
+		{IP: net.ParseIP("2001:db8::1"), Port: 27016},
+	}
+	addrs := servers.UDPAddrs()
+	if len(addrs) != 2 {
+		t.Fatalf("expected 2 addresses, got %v", addrs)
+	}
+	if len(addrs[0].IP) != net.IPv4len || addrs[0].String() != "10.0.1.2:27015" {
+		t.Errorf("expected a 4-byte 10.0.1.2:27015, got %v (%d bytes)", addrs[0], len(addrs[0].IP))
+	}
+	if addrs[1].String() != "[2001:db8::1]:27016" {
+		t.Errorf("expected [2001:db8::1]:27016, got %v", addrs[1])
+	}
+
+	// The result doesn't alias the list.
+	addrs[0].IP[3] = 99
+	if servers[0].IP.String() != "10.0.1.2" {
+		t.Errorf("expected the original address to be unchanged, got %v", servers[0])
+	}
+}
+
+func TestReassembleChunkedRules(t *testing.T) {
+	rules := Rules{
+		"tags1":      "oad,alltalk",
+		"tags0":      "increased_maxplayers,nocrits,payl",
+		"tags2":      ",respawntimes",
+		"tags_other": "ignored",
+		"sv_tags":    "ignored",
+	}
+	value, err := ReassembleChunkedRules(rules, "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "increased_maxplayers,nocrits,payload,alltalk,respawntimes"; value != expected {
+		t.Errorf("expected %q, got %q", expected, value)
+	}
+
+	if _, err := ReassembleChunkedRules(rules, "missing"); !errors.Is(err, ErrNoRuleChunks) {
+		t.Errorf("expected ErrNoRuleChunks, got %v", err)
+	}
+	delete(rules, "tags1")
+	if _, err := ReassembleChunkedRules(rules, "tags"); !errors.Is(err, ErrMissingRuleChunk) {
+		t.Errorf("expected ErrMissingRuleChunk, got %v", err)
+	}
+
+	// A suffix too big for the rules there are can't be complete, even one
+	// that would overflow the count.
+	for _, key := range []string{"big1000000", "big9223372036854775807"} {
+		huge := Rules{"big0": "a", key: "b"}
+		if _, err := ReassembleChunkedRules(huge, "big"); !errors.Is(err, ErrMissingRuleChunk) {
+			t.Errorf("%s: expected ErrMissingRuleChunk, got %v", key, err)
+		}
+	}
+}
+
+func TestConnectURL(t *testing.T) {
+	info := &ServerInfo{
+		Address: "192.168.1.20:27016",
+	}
+	if url := info.ConnectURL(); url != "steam://connect/192.168.1.20:27016" {
+		t.Errorf("unexpected connect URL: %s", url)
+	}
+
+	info.Ext = &ExtendedInfo{
+		Port: 27015,
+	}
+	if url := info.ConnectURL(); url != "steam://connect/192.168.1.20:27015" {
+		t.Errorf("unexpected connect URL with game port: %s", url)
+	}
+
+	info.Visibility = ServerVisibility_Public
+	if url := info.ConnectURLWithPassword("hunter2"); url != "steam://connect/192.168.1.20:27015" {
+		t.Errorf("public servers should not include a password: %s", url)
+	}
+	info.Visibility = ServerVisibility_Private
+	if url := info.ConnectURLWithPassword("hunter2"); url != "steam://connect/192.168.1.20:27015/hunter2" {
+		t.Errorf("unexpected connect URL with password: %s", url)
+	}
+}
+
+func TestServerInfoOccupancy(t *testing.T) {
+	// Full, partly with bots.
+	info := &ServerInfo{
+		Players:    24,
+		MaxPlayers: 24,
+		Bots:       4,
+	}
+	if !info.IsFull() || info.IsEmpty() {
+		t.Errorf("expected a full, non-empty server")
+	}
+	if humans := info.HumanPlayers(); humans != 20 {
+		t.Errorf("expected 20 human players, got %d", humans)
+	}
+
+	// Only bots.
+	info = &ServerInfo{
+		Players:    6,
+		MaxPlayers: 24,
+		Bots:       6,
+	}
+	if info.IsFull() || !info.IsEmpty() {
+		t.Errorf("expected a bots-only server to be empty and not full")
+	}
+
+	if humans := info.HumanPlayers(); humans != 0 {
+		t.Errorf("expected no human players, got %d", humans)
+	}
+
+	// Some servers report more bots than players.
+	info.Bots = 8
+	if !info.IsEmpty() {
+		t.Errorf("expected a server with more bots than players to be empty")
+	}
+	if humans := info.HumanPlayers(); humans != 0 {
+		t.Errorf("expected no human players with extra bots, got %d", humans)
+	}
+
+	// Info that wasn't read from a reply has an unknown visibility, which is
+	// taken to mean a password.
+	if info.Visibility != ServerVisibility_Unknown || !info.HasPassword() {
+		t.Errorf("expected an unknown visibility to require a password, got %v", info.Visibility)
+	}
+	info.Visibility = ServerVisibility_Public
+	if info.HasPassword() {
+		t.Errorf("expected no password")
+	}
+	info.Visibility = ServerVisibility_Private
+	if !info.HasPassword() {
+		t.Errorf("expected a password")
+	}
+}
+
+func TestProtocolConstants(t *testing.T) {
+	expected := []byte{0xff, 0xff, 0xff, 0xff, 0x66, 0x0a}
+	if !bytes.Equal(HeaderMasterResponse, expected) {
+		t.Errorf("expected master response header %x, got %x", expected, HeaderMasterResponse)
+	}
+	if PacketHeaderSimple != -1 || PacketHeaderSplit != -2 {
+		t.Errorf("unexpected packet headers")
+	}
+	if A2M_GET_SERVERS_BATCH2 != 0x31 || A2S_INFO != 0x54 || A2S_PLAYER != 0x55 || A2S_RULES != 0x56 {
+		t.Errorf("unexpected request types")
+	}
+}
+
+func TestServerInfoDiff(t *testing.T) {
+	before := &ServerInfo{
+		Address:    "10.0.0.1:27015",
+		Name:       "My Server",
+		MapName:    "cp_badlands",
+		Players:    10,
+		MaxPlayers: 24,
+	}
+	after := *before
+	after.MapName = "cp_dustbowl"
+	after.Players = 3
+	after.Address = "10.0.0.1:27016"
+
+	expected := []string{
+		"map changed from cp_badlands to cp_dustbowl",
+		"players changed from 10 to 3",
+	}
+	if changes := before.Diff(&after); fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, changes)
+	}
+	if changes := before.Diff(before); len(changes) != 0 {
+		t.Errorf("expected no changes, got %q", changes)
+	}
+}
+
+func TestServerListShuffle(t *testing.T) {
+	servers := ServerList{}
+	for i := 1; i <= 20; i++ {
+		servers = append(servers, &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 27015})
+	}
+	original := fmt.Sprint(servers)
+
+	shuffled := append(ServerList{}, servers...)
+	shuffled.Shuffle(rand.New(rand.NewSource(1)))
+	if fmt.Sprint(shuffled) == original {
+		t.Errorf("expected the order to change")
+	}
+
+	seen := map[string]bool{}
+	for _, addr := range shuffled {
+		seen[addr.String()] = true
+	}
+	if len(seen) != len(servers) {
+		t.Errorf("expected all %d servers after shuffling, got %d", len(servers), len(seen))
+	}
+
+	// The same seed gives the same order.
+	again := append(ServerList{}, servers...)
+	again.Shuffle(rand.New(rand.NewSource(1)))
+	if fmt.Sprint(again) != fmt.Sprint(shuffled) {
+		t.Errorf("expected a fixed seed to be deterministic")
+	}
+}
+
+func TestGroupBySubnet(t *testing.T) {
+	servers := append(makeServerList(1, 3), makeServerList(2, 2)...)
+	groups := servers.GroupBySubnet(24)
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 subnets, got %v", groups)
+	}
+	if len(groups["10.0.1.0/24"]) != 3 || len(groups["10.0.2.0/24"]) != 2 {
+		t.Errorf("unexpected bucket sizes: %v", groups)
+	}
+	if groups := servers.GroupBySubnet(16); len(groups["10.0.0.0/16"]) != 5 {
+		t.Errorf("expected one /16 with every server, got %v", groups)
+	}
+}
+
+func TestServerListDiff(t *testing.T) {
+	// 10.0.1.1-4 before, 10.0.1.3-6 after.
+	before := makeServerList(1, 4)
+	after := append(ServerList{}, before[2:]...)
+	for i := 5; i <= 6; i++ {
+		after = append(after, &net.TCPAddr{IP: net.IPv4(10, 0, 1, byte(i)), Port: 27015})
+	}
+
+	added, removed := before.Diff(after)
+	if fmt.Sprint(added) != "[10.0.1.5:27015 10.0.1.6:27015]" {
+		t.Errorf("unexpected added servers: %v", added)
+	}
+	if fmt.Sprint(removed) != "[10.0.1.1:27015 10.0.1.2:27015]" {
+		t.Errorf("unexpected removed servers: %v", removed)
+	}
+}
+
+func TestMergeServerLists(t *testing.T) {
+	// 10.0.1.1-3, 10.0.1.2-4, then 10.0.1.4 and 10.0.2.1.
+	first := makeServerList(1, 3)
+	second := makeServerList(1, 4)[1:]
+	third := ServerList{
+		// A separate copy, to check that addresses match by value.
+		{IP: net.IPv4(10, 0, 1, 4), Port: 27015},
+		{IP: net.IPv4(10, 0, 2, 1), Port: 27015},
+	}
+
+	merged := MergeServerLists(first, second, third)
+	expected := "[10.0.1.1:27015 10.0.1.2:27015 10.0.1.3:27015 10.0.1.4:27015 10.0.2.1:27015]"
+	if fmt.Sprint(merged) != expected {
+		t.Errorf("expected %s, got %v", expected, merged)
+	}
+	if merged := MergeServerLists(); len(merged) != 0 {
+		t.Errorf("expected an empty list, got %v", merged)
+	}
+}
+
+func TestPlayerPlayTime(t *testing.T) {
+	player := Player{Duration: 3725.0}
+	if got, want := player.PlayTime(), time.Hour+2*time.Minute+5*time.Second; got != want {
+		t.Fatalf("play time: got %v, want %v", got, want)
+	}
+
+	player.Duration = 1.5
+	if got := player.PlayTime(); got != 1500*time.Millisecond {
+		t.Fatalf("fractional play time: got %v", got)
+	}
+}
+
+func TestServerListJSON(t *testing.T) {
+	servers := ServerList{
+		{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 27015},
+		{IP: net.ParseIP("2001:db8::1"), Port: 27016},
+	}
+
+	data, err := json.Marshal(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[{"ip":"10.0.0.1","port":27015},{"ip":"2001:db8::1","port":27016}]`; string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+
+	var decoded ServerList
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, servers) {
+		t.Errorf("round trip mismatch: %v != %v", decoded, servers)
+	}
+
+	err = json.Unmarshal([]byte(`[{"ip":"10.0.0.300","port":27015}]`), &decoded)
+	if !errors.Is(err, ErrBadServerAddress) {
+		t.Errorf("expected ErrBadServerAddress, got %v", err)
+	}
+}
+
+func TestParsedVersion(t *testing.T) {
+	cases := map[string][]int{
+		"1.2.3.4": {1, 2, 3, 4},
+		"7648638": {7648638},
+	}
+	for version, expected := range cases {
+		info := &ServerInfo{Ext: &ExtendedInfo{GameVersion: version}}
+		parsed, err := info.ParsedVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, expected) {
+			t.Errorf("%s: expected %v, got %v", version, expected, parsed)
+		}
+	}
+
+	for _, version := range []string{"1.0b", "1..2", "-1", "v2"} {
+		info := &ServerInfo{Ext: &ExtendedInfo{GameVersion: version}}
+		if _, err := info.ParsedVersion(); !errors.Is(err, ErrBadGameVersion) {
+			t.Errorf("%s: expected ErrBadGameVersion, got %v", version, err)
+		}
+	}
+	if _, err := (&ServerInfo{}).ParsedVersion(); err != ErrNoGameVersion {
+		t.Errorf("expected ErrNoGameVersion, got %v", err)
+	}
+}
+
+func TestInvalidUTF8Name(t *testing.T) {
+	expected := makeTestInfo()
+	expected.Name = "caf\xe9 \xff\xfe server"
+	server := newMockServer(t, respondToInfo(encodeSourceInfo(expected)))
+	querier := newTestServerQuerier(t, server)
+
+	info, err := querier.QueryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != expected.Name {
+		t.Fatalf("expected the raw name %q, got %q", expected.Name, info.Name)
+	}
+	if info.NameValid() {
+		t.Errorf("expected the name to be invalid UTF-8")
+	}
+	if name := info.SanitizedName(); name != "caf\uFFFD \uFFFD\uFFFD server" {
+		t.Errorf("unexpected sanitized name %q", name)
+	}
+
+	buf, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ServerInfo
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != info.SanitizedName() {
+		t.Errorf("expected JSON to carry the sanitized name, got %q", decoded.Name)
+	}
+
+	if info := makeTestInfo(); !info.NameValid() || info.SanitizedName() != info.Name {
+		t.Errorf("expected a valid name to be left alone")
+	}
+}
+
+func TestIndexByTag(t *testing.T) {
+	makeInfo := func(address string, tags string) *ServerInfo {
+		return &ServerInfo{
+			Address: address,
+			Ext:     &ExtendedInfo{AppId: App_TF2, GameModeDescription: tags},
+		}
+	}
+	infos := []*ServerInfo{
+		makeInfo("10.0.0.1:27015", "alltalk,payload"),
+		makeInfo("10.0.0.2:27015", "AllTalk, cp ,alltalk"),
+		makeInfo("10.0.0.3:27015", ""),
+		makeInfo("not an address", "alltalk"),
+		{Address: "10.0.0.4:27015"},
+	}
+
+	if tags := infos[1].Tags(); !reflect.DeepEqual(tags, []string{"alltalk", "cp", "alltalk"}) {
+		t.Errorf("unexpected tags %q", tags)
+	}
+	if tags := infos[4].Tags(); tags != nil {
+		t.Errorf("expected no tags without extended info, got %q", tags)
+	}
+
+	index := IndexByTag(infos)
+	if len(index) != 3 {
+		t.Errorf("expected 3 tags, got %v", index)
+	}
+	if alltalk := index["alltalk"]; len(alltalk) != 2 || alltalk[0].String() != "10.0.0.1:27015" || alltalk[1].String() != "10.0.0.2:27015" {
+		t.Errorf("expected both alltalk servers once each, got %v", alltalk)
+	}
+	if cp := index["cp"]; len(cp) != 1 || cp[0].String() != "10.0.0.2:27015" {
+		t.Errorf("unexpected cp servers %v", cp)
+	}
+	if payload := index["payload"]; len(payload) != 1 {
+		t.Errorf("unexpected payload servers %v", payload)
+	}
+}
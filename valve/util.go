@@ -6,9 +6,43 @@
 package valve
 
 import (
+	"context"
 	"fmt"
+	"time"
 )
 
+// A source of time. Anything that waits goes through this, so tests can
+// replace it and run without real delays.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// Same as Sleep, but returns the context's error early if it is done
+	// first.
+	SleepContext(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func tryAndCatch(fn func() error) error {
 	var outErr error
 	(func() {
@@ -0,0 +1,134 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+
+// Package valvetest provides fake Valve servers for testing code that uses the
+// valve package, without touching the network beyond localhost.
+package valvetest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+var errNotMasterQuery = errors.New("not a master query")
+
+// A master query as received by MockMaster.
+type MasterQuery struct {
+	Region byte
+	Seed   string
+	Filter string
+}
+
+// A fake master server on localhost. Each query is answered with the batch
+// following the seed address, and the last batch ends with the terminator.
+type MockMaster struct {
+	conn    net.PacketConn
+	batches []valve.ServerList
+
+	lock    sync.Mutex
+	queries []MasterQuery
+}
+
+// Start a mock master serving the given batches, and return it along with its
+// address. Like httptest.NewServer, this panics if it can't listen. Queriers
+// talking to it should disable rate limiting with SetRateLimit(0).
+func NewMockMaster(batches []valve.ServerList) (*MockMaster, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("valvetest: failed to listen: %v", err))
+	}
+
+	master := &MockMaster{
+		conn:    conn,
+		batches: batches,
+	}
+	go master.serve()
+	return master, conn.LocalAddr().String()
+}
+
+// Return every query received so far.
+func (this *MockMaster) Queries() []MasterQuery {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]MasterQuery{}, this.queries...)
+}
+
+// Stop serving.
+func (this *MockMaster) Close() {
+	this.conn.Close()
+}
+
+func (this *MockMaster) serve() {
+	buffer := make([]byte, 1400)
+	for {
+		n, addr, err := this.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		query, err := parseMasterQuery(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		this.lock.Lock()
+		this.queries = append(this.queries, query)
+		this.lock.Unlock()
+
+		this.conn.WriteTo(this.reply(query.Seed), addr)
+	}
+}
+
+func (this *MockMaster) reply(seed string) []byte {
+	index := 0
+	if seed != "0.0.0.0:0" {
+		index = -1
+		for i, batch := range this.batches {
+			if len(batch) > 0 && batch[len(batch)-1].String() == seed {
+				index = i + 1
+				break
+			}
+		}
+	}
+	if index < 0 || index >= len(this.batches) {
+		return EncodeMasterResponse(nil, true)
+	}
+	return EncodeMasterResponse(this.batches[index], index == len(this.batches)-1)
+}
+
+func parseMasterQuery(packet []byte) (query MasterQuery, err error) {
+	err = valve.Try(func() error {
+		reader := valve.NewPacketReader(packet)
+		if reader.ReadUint8() != valve.A2M_GET_SERVERS_BATCH2 {
+			return errNotMasterQuery
+		}
+		query.Region = reader.ReadUint8()
+		query.Seed = reader.ReadString()
+		query.Filter = reader.ReadString()
+		return nil
+	})
+	return query, err
+}
+
+// Encode a master response packet for a list of IPv4 servers, optionally
+// ending it with the null terminator.
+func EncodeMasterResponse(servers valve.ServerList, terminate bool) []byte {
+	packet := valve.PacketBuilder{}
+	packet.WriteBytes(valve.HeaderMasterResponse)
+	for _, addr := range servers {
+		packet.WriteBytes(addr.IP.To4())
+		packet.WriteByte(byte(addr.Port >> 8))
+		packet.WriteByte(byte(addr.Port))
+	}
+	if terminate {
+		packet.WriteBytes([]byte{0, 0, 0, 0, 0, 0})
+	}
+	return packet.Bytes()
+}
@@ -0,0 +1,64 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valvetest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alliedmodders/blaster/valve"
+)
+
+func TestMockMaster(t *testing.T) {
+	var batches []valve.ServerList
+	for block := 1; block <= 3; block++ {
+		batch := valve.ServerList{}
+		for i := 1; i <= 2; i++ {
+			batch = append(batch, &net.TCPAddr{
+				IP:   net.IPv4(10, 0, byte(block), byte(i)).To4(),
+				Port: 27015,
+			})
+		}
+		batches = append(batches, batch)
+	}
+
+	master, addr := NewMockMaster(batches)
+	defer master.Close()
+
+	querier, err := valve.NewMasterServerQuerier(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+	querier.SetRateLimit(0)
+	querier.SetTimeout(time.Second)
+	querier.FilterAppIds([]valve.AppId{valve.App_TF2})
+
+	var servers valve.ServerList
+	err = querier.Query(func(batch valve.ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers) != 6 {
+		t.Fatalf("expected 6 servers, got %d", len(servers))
+	}
+	if servers[0].String() != "10.0.1.1:27015" || servers[5].String() != "10.0.3.2:27015" {
+		t.Errorf("unexpected servers: %v", servers)
+	}
+
+	queries := master.Queries()
+	if len(queries) != 3 {
+		t.Fatalf("expected 3 queries, got %d", len(queries))
+	}
+	if queries[0].Seed != "0.0.0.0:0" || queries[0].Filter != "\\appid\\440" {
+		t.Errorf("unexpected first query: %+v", queries[0])
+	}
+}
@@ -0,0 +1,252 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const WebApiServer = "https://api.steampowered.com"
+
+// The most servers the Web API will return for one request.
+const kDefaultWebApiLimit = 10000
+
+// Class for querying the server list through the Steam Web API, as a fallback
+// for the UDP master server. This requires a Steam Web API key.
+type WebMasterQuerier struct {
+	lock     sync.Mutex
+	apiKey   string
+	endpoint string
+	client   *http.Client
+	limit    int
+	filters  []string
+}
+
+// Create a new Web API querier with the given API key.
+func NewWebMasterQuerier(apiKey string) *WebMasterQuerier {
+	return &WebMasterQuerier{
+		apiKey:   apiKey,
+		endpoint: WebApiServer,
+		client:   http.DefaultClient,
+		limit:    kDefaultWebApiLimit,
+	}
+}
+
+// Change the base URL of the Web API.
+func (this *WebMasterQuerier) SetEndpoint(endpoint string) {
+	this.endpoint = strings.TrimRight(endpoint, "/")
+}
+
+// Change the HTTP client used for requests.
+func (this *WebMasterQuerier) SetClient(client *http.Client) {
+	this.client = client
+}
+
+// Adds by AppIds to the filter list.
+func (this *WebMasterQuerier) FilterAppIds(appIds []AppId) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, appId := range appIds {
+		this.filters = append(this.filters, fmt.Sprintf("\\appid\\%d", appId))
+	}
+}
+
+// Sets the filter list to a single Valve-style filter string.
+func (this *WebMasterQuerier) SetFilterString(filter string) error {
+	filters, err := parseFilterList(filter)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.filters = filters
+	return nil
+}
+
+func (this *WebMasterQuerier) ClearFilters() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.filters = []string{}
+}
+
+// Query the Web API. Like MasterServerQuerier, the callback is invoked once
+// per filter.
+func (this *WebMasterQuerier) Query(callback MasterQueryCallback) error {
+	return this.QueryContext(context.Background(), callback)
+}
+
+// Query the Web API, stopping early if the context is cancelled.
+func (this *WebMasterQuerier) QueryContext(ctx context.Context, callback MasterQueryCallback) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	filters := this.filters
+	if len(filters) == 0 {
+		filters = []string{""}
+	}
+
+	for _, filter := range filters {
+		servers, err := this.getServerList(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if err := callback(servers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var ErrSteamIdNotFound = fmt.Errorf("no server is listed with that steam id")
+
+// One server as the Web API describes it. Counts are plain ints, since some
+// games have more than 255 slots.
+type webServer struct {
+	Addr       string `json:"addr"`
+	GamePort   uint16 `json:"gameport"`
+	Name       string `json:"name"`
+	AppId      AppId  `json:"appid"`
+	GameDir    string `json:"gamedir"`
+	Version    string `json:"version"`
+	Product    string `json:"product"`
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"max_players"`
+	Bots       int    `json:"bots"`
+	Map        string `json:"map"`
+	Secure     bool   `json:"secure"`
+	Dedicated  bool   `json:"dedicated"`
+	OS         string `json:"os"`
+	GameType   string `json:"gametype"`
+}
+
+type webServerListResponse struct {
+	Response struct {
+		Servers []webServer `json:"servers"`
+	} `json:"response"`
+}
+
+// Look up a server by its steam id, as found in ServerInfo.Ext.SteamId, and
+// build its info from what the Web API lists. This works for servers that
+// can't be queried directly, such as those only reachable through Steam
+// Datagram Relay. Only fields the Web API reports are filled in; for example,
+// visibility is unknown and Ping is zero. Fails with ErrSteamIdNotFound if the
+// server isn't listed, which happens when it is offline.
+func (this *WebMasterQuerier) QueryServerBySteamID(ctx context.Context, steamId uint64) (*ServerInfo, error) {
+	servers, err := this.getServers(ctx, fmt.Sprintf("\\steamid\\%d", steamId))
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, ErrSteamIdNotFound
+	}
+	server := servers[0]
+
+	info := &ServerInfo{
+		Address:    server.Addr,
+		Name:       server.Name,
+		MapName:    server.Map,
+		Folder:     server.GameDir,
+		Game:       server.Product,
+		Players:    clampCount(server.Players),
+		MaxPlayers: clampCount(server.MaxPlayers),
+		Bots:       clampCount(server.Bots),
+		Type:       ServerType_Listen,
+		Visibility: ServerVisibility_Unknown,
+		Ext: &ExtendedInfo{
+			AppId:               server.AppId,
+			GameVersion:         server.Version,
+			Port:                server.GamePort,
+			SteamId:             steamId,
+			GameModeDescription: server.GameType,
+		},
+	}
+	if server.Dedicated {
+		info.Type = ServerType_Dedicated
+	}
+	if server.Secure {
+		info.Vac = 1
+	}
+	if len(server.OS) == 1 {
+		info.RawOS = server.OS[0]
+	}
+	info.OS = osFromByte(info.RawOS)
+	return info, nil
+}
+
+// Fit a count from the Web API into A2S_INFO's single byte. Counts too big
+// for it are capped at 255.
+func clampCount(count int) uint8 {
+	if count < 0 {
+		return 0
+	}
+	if count > 0xff {
+		return 0xff
+	}
+	return uint8(count)
+}
+
+func (this *WebMasterQuerier) getServerList(ctx context.Context, filter string) (ServerList, error) {
+	list, err := this.getServers(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := ServerList{}
+	for _, server := range list {
+		addr, err := net.ResolveTCPAddr("tcp", server.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			addr.IP = ip4
+		}
+		servers = append(servers, addr)
+	}
+	return servers, nil
+}
+
+func (this *WebMasterQuerier) getServers(ctx context.Context, filter string) ([]webServer, error) {
+	params := url.Values{}
+	params.Set("key", this.apiKey)
+	params.Set("limit", strconv.Itoa(this.limit))
+	if filter != "" {
+		params.Set("filter", filter)
+	}
+
+	address := this.endpoint + "/IGameServersService/GetServerList/v1/?" + params.Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := this.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("web api request failed: %s", response.Status)
+	}
+
+	var reply webServerListResponse
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	return reply.Response.Servers, nil
+}
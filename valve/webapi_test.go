@@ -0,0 +1,124 @@
+// vim: set ts=4 sw=4 tw=99 noet:
+//
+// Blaster (C) Copyright 2014 AlliedModders LLC
+// Licensed under the GNU General Public License, version 3 or higher.
+// See LICENSE.txt for more details.
+package valve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebMasterQuerier(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/IGameServersService/GetServerList/v1/" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query().Get("key") + " " + r.URL.Query().Get("filter")
+		// Some games have more slots than A2S_INFO can count.
+		fmt.Fprint(w, `{"response":{"servers":[
+			{"addr":"192.168.1.20:27015","gameport":27015,"appid":440,"name":"One"},
+			{"addr":"192.168.1.21:27016","gameport":27016,"appid":440,"name":"Two","players":300,"max_players":500}
+		]}}`)
+	}))
+	defer server.Close()
+
+	querier := NewWebMasterQuerier("secret")
+	querier.SetEndpoint(server.URL)
+	querier.FilterAppIds([]AppId{App_TF2})
+
+	servers := ServerList{}
+	err := querier.Query(func(batch ServerList) error {
+		servers = append(servers, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "secret \\appid\\440" {
+		t.Errorf("unexpected key and filter: %q", query)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 servers, got %d", len(servers))
+	}
+	if servers[0].String() != "192.168.1.20:27015" || servers[1].String() != "192.168.1.21:27016" {
+		t.Errorf("unexpected servers: %v", servers)
+	}
+	if len(servers[0].IP) != 4 {
+		t.Errorf("expected a 4-byte address")
+	}
+}
+
+func TestWebQueryServerBySteamID(t *testing.T) {
+	var filter string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter = r.URL.Query().Get("filter")
+		if filter != "\\steamid\\90071996842377216" {
+			fmt.Fprint(w, `{"response":{}}`)
+			return
+		}
+		fmt.Fprint(w, `{"response":{"servers":[{
+			"addr":"169.254.1.2:27015","gameport":27015,"steamid":"90071996842377216",
+			"name":"Relay Only","appid":730,"gamedir":"csgo","version":"1.38.7.9",
+			"product":"csgo","region":255,"players":10,"max_players":24,"bots":2,
+			"map":"de_mirage","secure":true,"dedicated":true,"os":"l",
+			"gametype":"competitive,valve_ds"
+		}]}}`)
+	}))
+	defer server.Close()
+
+	querier := NewWebMasterQuerier("secret")
+	querier.SetEndpoint(server.URL)
+
+	info, err := querier.QueryServerBySteamID(context.Background(), 90071996842377216)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Address != "169.254.1.2:27015" || info.Name != "Relay Only" || info.MapName != "de_mirage" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if info.Players != 10 || info.MaxPlayers != 24 || info.Bots != 2 || info.Vac != 1 {
+		t.Errorf("unexpected counts: %+v", info)
+	}
+	if info.Type != ServerType_Dedicated || info.OS != ServerOS_Linux {
+		t.Errorf("unexpected type or os: %v %v", info.Type, info.OS)
+	}
+	if info.Ext.AppId != App_CSGO || info.Ext.SteamId != 90071996842377216 || info.Ext.GameModeDescription != "competitive,valve_ds" {
+		t.Errorf("unexpected extended info: %+v", info.Ext)
+	}
+
+	if _, err := querier.QueryServerBySteamID(context.Background(), 1); err != ErrSteamIdNotFound {
+		t.Errorf("expected ErrSteamIdNotFound, got %v", err)
+	}
+}
+
+func TestWebQueryLargeServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"response":{"servers":[{
+			"addr":"192.168.1.30:28015","gameport":28015,"name":"Big","appid":252490,
+			"players":320,"max_players":500,"bots":0,"os":"o"
+		}]}}`)
+	}))
+	defer server.Close()
+
+	querier := NewWebMasterQuerier("secret")
+	querier.SetEndpoint(server.URL)
+
+	info, err := querier.QueryServerBySteamID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Players != 255 || info.MaxPlayers != 255 || info.Bots != 0 {
+		t.Errorf("expected counts to be capped at 255, got %d/%d", info.Players, info.MaxPlayers)
+	}
+	if info.OS != ServerOS_Mac || info.RawOS != 'o' {
+		t.Errorf("expected an old Mac server, got %v (raw %q)", info.OS, info.RawOS)
+	}
+}